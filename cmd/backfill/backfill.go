@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+
+	"google.golang.org/api/iterator"
+)
+
+// Source is an object to load.
+type Source struct {
+	Bucket     string
+	Name       string
+	Generation int64
+	Size       int64
+}
+
+// URI returns the gs:// URI of the object.
+func (s Source) URI() string {
+	return "gs://" + s.Bucket + "/" + s.Name
+}
+
+func (s Source) key() string {
+	return s.URI() + "\t" + strconv.FormatInt(s.Generation, 10)
+}
+
+// ParsePrefixURI splits gs://bucket/prefix into the bucket and the prefix.
+// The prefix may be empty to list the whole bucket.
+func ParsePrefixURI(uri string) (string, string, error) {
+	rest, ok := strings.CutPrefix(uri, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf("not a gs:// URI: %s", uri)
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("no bucket in URI: %s", uri)
+	}
+	return bucket, prefix, nil
+}
+
+// ListSources returns the objects under prefix in the bucket, in name order.
+// Objects whose names end with "/" are folder placeholders and are skipped.
+func ListSources(ctx context.Context, storageClient common.StorageClient, bucket string, prefix string) ([]Source, error) {
+	var sources []Source
+	it := storageClient.Bucket(bucket).Objects(ctx, prefix)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Objects: %v", err)
+		}
+		if strings.HasSuffix(attrs.Name, "/") {
+			continue
+		}
+		sources = append(sources, Source{
+			Bucket:     bucket,
+			Name:       attrs.Name,
+			Generation: attrs.Generation,
+			Size:       attrs.Size,
+		})
+	}
+	return sources, nil
+}
+
+// Progress records the sources that have been loaded, so that an interrupted
+// backfill can be resumed. Each line of the file is the URI and the
+// generation of a loaded source, separated by a tab.
+type Progress struct {
+	mu   sync.Mutex
+	done map[string]bool
+	file *os.File
+}
+
+// OpenProgress reads the progress file at path and opens it to record more
+// sources. The file is created if it does not exist. An empty path gives a
+// Progress that remembers nothing.
+func OpenProgress(path string) (*Progress, error) {
+	p := &Progress{done: map[string]bool{}}
+	if path == "" {
+		return p, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("OpenFile: %v", err)
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			p.done[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read %s: %v", path, err)
+	}
+	p.file = file
+
+	return p, nil
+}
+
+// Done reports whether the source has been loaded.
+func (p *Progress) Done(src Source) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done[src.key()]
+}
+
+// Pending returns the sources that have not been loaded.
+func (p *Progress) Pending(sources []Source) []Source {
+	var pending []Source
+	for _, src := range sources {
+		if !p.Done(src) {
+			pending = append(pending, src)
+		}
+	}
+	return pending
+}
+
+// Record records that the source has been loaded.
+func (p *Progress) Record(src Source) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done[src.key()] = true
+	if p.file == nil {
+		return nil
+	}
+	if _, err := p.file.WriteString(src.key() + "\n"); err != nil {
+		return fmt.Errorf("write progress: %v", err)
+	}
+	return nil
+}
+
+func (p *Progress) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Close()
+}
+
+// LoadFunc loads one source.
+type LoadFunc func(ctx context.Context, src Source) error
+
+// Run loads the sources that are not done yet with up to concurrency loads
+// at a time. A failed source does not stop the others; the errors of all the
+// failed sources are returned together.
+func Run(ctx context.Context, sources []Source, progress *Progress, concurrency int, load LoadFunc) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	queue := make(chan Source)
+	var mu sync.Mutex
+	var errs []error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for src := range queue {
+				if err := load(ctx, src); err != nil {
+					log.Printf("Failed to load %s: %v", src.URI(), err)
+					fail(fmt.Errorf("%s: %v", src.URI(), err))
+					continue
+				}
+				if err := progress.Record(src); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	skipped := 0
+	for _, src := range sources {
+		if progress.Done(src) {
+			skipped++
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- src
+	}
+	close(queue)
+	wg.Wait()
+
+	if skipped > 0 {
+		log.Printf("Skipped %d sources recorded in the progress file", skipped)
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/api/iterator"
+)
+
+type MockStorageClient struct {
+	mock.Mock
+}
+
+func (m *MockStorageClient) Bucket(name string) common.BucketHandle {
+	args := m.Called(name)
+	return args.Get(0).(common.BucketHandle)
+}
+
+type MockBucketHandle struct {
+	mock.Mock
+}
+
+func (m *MockBucketHandle) Object(name string) common.ObjectHandle {
+	args := m.Called(name)
+	return args.Get(0).(common.ObjectHandle)
+}
+
+func (m *MockBucketHandle) Objects(ctx context.Context, prefix string) common.ObjectIterator {
+	args := m.Called(ctx, prefix)
+	return args.Get(0).(common.ObjectIterator)
+}
+
+type MockObjectIterator struct {
+	Objects []*storage.ObjectAttrs
+}
+
+func (m *MockObjectIterator) Next() (*storage.ObjectAttrs, error) {
+	if len(m.Objects) == 0 {
+		return nil, iterator.Done
+	}
+	attrs := m.Objects[0]
+	m.Objects = m.Objects[1:]
+	return attrs, nil
+}
+
+func TestParsePrefixURI(t *testing.T) {
+	bucket, prefix, err := ParsePrefixURI("gs://bucket/2024/01/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bucket", bucket)
+		assert.Equal(t, "2024/01/", prefix)
+	}
+
+	bucket, prefix, err = ParsePrefixURI("gs://bucket")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bucket", bucket)
+		assert.Equal(t, "", prefix)
+	}
+
+	_, _, err = ParsePrefixURI("/bucket/2024")
+	assert.Error(t, err)
+}
+
+func TestListSources(t *testing.T) {
+	ctx := context.Background()
+
+	mockStorageClient := new(MockStorageClient)
+	mockBucketHandle := new(MockBucketHandle)
+	mockStorageClient.On("Bucket", "bucket").Return(mockBucketHandle)
+	mockBucketHandle.On("Objects", mock.Anything, "2024/").Return(&MockObjectIterator{
+		Objects: []*storage.ObjectAttrs{
+			{Name: "2024/", Generation: 1},
+			{Name: "2024/a.log", Generation: 2, Size: 10},
+			{Name: "2024/b.log", Generation: 3, Size: 20},
+		},
+	})
+
+	sources, err := ListSources(ctx, mockStorageClient, "bucket", "2024/")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Source{
+		{Bucket: "bucket", Name: "2024/a.log", Generation: 2, Size: 10},
+		{Bucket: "bucket", Name: "2024/b.log", Generation: 3, Size: 20},
+	}, sources)
+}
+
+func TestProgressResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backfill.progress")
+	a := Source{Bucket: "bucket", Name: "a.log", Generation: 1}
+	b := Source{Bucket: "bucket", Name: "b.log", Generation: 1}
+
+	progress, err := OpenProgress(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, progress.Record(a))
+	assert.NoError(t, progress.Close())
+
+	progress, err = OpenProgress(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer progress.Close()
+	assert.True(t, progress.Done(a))
+	assert.False(t, progress.Done(b))
+	// 世代が変われば再度読み込む
+	assert.False(t, progress.Done(Source{Bucket: "bucket", Name: "a.log", Generation: 2}))
+	assert.Equal(t, []Source{b}, progress.Pending([]Source{a, b}))
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	sources := []Source{
+		{Bucket: "bucket", Name: "a.log", Generation: 1},
+		{Bucket: "bucket", Name: "b.log", Generation: 1},
+		{Bucket: "bucket", Name: "c.log", Generation: 1},
+		{Bucket: "bucket", Name: "d.log", Generation: 1},
+	}
+
+	progress, err := OpenProgress("")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, progress.Record(sources[0]))
+
+	var mu sync.Mutex
+	var loaded []string
+	err = Run(ctx, sources, progress, 2, func(ctx context.Context, src Source) error {
+		mu.Lock()
+		defer mu.Unlock()
+		loaded = append(loaded, src.Name)
+		if src.Name == "c.log" {
+			return errors.New("job failed")
+		}
+		return nil
+	})
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "gs://bucket/c.log: job failed")
+	}
+	assert.ElementsMatch(t, []string{"b.log", "c.log", "d.log"}, loaded)
+	assert.True(t, progress.Done(sources[1]))
+	assert.False(t, progress.Done(sources[2]))
+	assert.True(t, progress.Done(sources[3]))
+}
@@ -0,0 +1,161 @@
+// Command backfill loads every object under a gs:// prefix into the logs
+// table, as load2logs does for a single object.
+//
+// It is configured by the same environment variables as the load2logs
+// function (PROJECT_ID, DATASET_ID, TABLE_ID, ...).
+//
+//	backfill [-concurrency 4] [-progress backfill.progress] [-mode replace] [-dry-run | -estimate] gs://bucket/prefix
+//
+// -estimate dry-runs the load scripts in BigQuery and reports the bytes that
+// the backfill would process, without loading anything.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/load2logs"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+)
+
+type options struct {
+	concurrency    int
+	progressPath   string
+	mode           string
+	dryRun         bool
+	estimate       bool
+	maxBytesBilled int64
+}
+
+func main() {
+	// 関数パッケージの init は JSON ログを標準出力に書くため、標準エラーに戻す
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	var opts options
+	flag.IntVar(&opts.concurrency, "concurrency", 4, "number of objects loaded at a time")
+	flag.StringVar(&opts.progressPath, "progress", "", "file that records the loaded objects to resume an interrupted backfill")
+	flag.StringVar(&opts.mode, "mode", "", "load mode, append or replace (default LOAD_MODE)")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "list the objects to load without loading them")
+	flag.BoolVar(&opts.estimate, "estimate", false, "dry-run the loads in BigQuery and report the bytes they would process")
+	flag.Int64Var(&opts.maxBytesBilled, "max-bytes-billed", 0, "fail a load that would bill more bytes (default MAX_BYTES_BILLED)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] gs://bucket/prefix\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(prefixURI string, opts options) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	bucket, prefix, err := ParsePrefixURI(prefixURI)
+	if err != nil {
+		return err
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer storageClient.Close()
+	realStorageClient := &common.RealStorageClient{Client: storageClient}
+
+	sources, err := ListSources(ctx, realStorageClient, bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	progress, err := OpenProgress(opts.progressPath)
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+
+	if opts.dryRun {
+		for _, src := range sources {
+			state := "todo"
+			if progress.Done(src) {
+				state = "done"
+			}
+			fmt.Printf("%s\t%s\t%d\t%d\n", state, src.URI(), src.Generation, src.Size)
+		}
+		return nil
+	}
+
+	envConfig, err := load2logs.NewEnvConfig()
+	if err != nil {
+		return fmt.Errorf("EnvConfig: %v", err)
+	}
+	if opts.mode != "" {
+		if err := load2logs.ValidateLoadMode(opts.mode); err != nil {
+			return err
+		}
+		envConfig.LoadMode = opts.mode
+	}
+	if opts.maxBytesBilled > 0 {
+		envConfig.MaxBytesBilled = opts.maxBytesBilled
+	}
+
+	client, err := bigquery.NewClient(ctx, envConfig.ProjectID)
+	if err != nil {
+		return fmt.Errorf("bigquery.NewClient: %v", err)
+	}
+	defer client.Close()
+	realClient := &common.RealBigQueryClient{Client: client}
+
+	if opts.estimate {
+		return estimate(ctx, realClient, realStorageClient, envConfig, progress.Pending(sources), opts.concurrency)
+	}
+
+	log.Printf("Loading %d objects under %s", len(sources), prefixURI)
+	return Run(ctx, sources, progress, opts.concurrency, func(ctx context.Context, src Source) error {
+		result, err := load2logs.Load2Bq(ctx, realClient, realStorageClient, src.URI(), src.Generation, envConfig.LoadOptions(src.Name))
+		if err != nil {
+			return err
+		}
+		log.Printf("Loaded %s (skipped: %t, rejected: %d, source rejected: %t, bytes processed: %d)", src.URI(), result.Skipped, result.Rejected, result.SourceRejected, result.TotalBytesProcessed)
+		return nil
+	})
+}
+
+// estimate dry-runs the loads of the sources and prints the estimated bytes
+// of each source and the total. The progress file is not updated.
+func estimate(ctx context.Context, client common.BigQueryClient, storageClient common.StorageClient, envConfig *load2logs.EnvConfig, sources []Source, concurrency int) error {
+	progress, err := OpenProgress("")
+	if err != nil {
+		return err
+	}
+
+	var total atomic.Int64
+	err = Run(ctx, sources, progress, concurrency, func(ctx context.Context, src Source) error {
+		opts := envConfig.LoadOptions(src.Name)
+		opts.DryRun = true
+		result, err := load2logs.Load2Bq(ctx, client, storageClient, src.URI(), src.Generation, opts)
+		if err != nil {
+			return err
+		}
+		total.Add(result.TotalBytesProcessed)
+		fmt.Printf("%s\t%d\t%t\n", src.URI(), result.TotalBytesProcessed, result.Skipped)
+		return nil
+	})
+	fmt.Printf("total\t%d\n", total.Load())
+	return err
+}
@@ -0,0 +1,122 @@
+// Command localpipeline runs the unzip → untar → load chain on the local
+// filesystem, without deploying to GCP.
+//
+// Directories under -root stand in for the buckets: drop a zip file into
+// <root>/zip and it is extracted to <root>/tgz, then to <root>/csv, and the
+// log files are handed to the sink.
+//
+//	localpipeline [-root local] [-sink jsonl] [-out records.jsonl] [-watch 2s]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+
+	"google.golang.org/api/iterator"
+)
+
+const defaultTimeZone = "Asia/Tokyo"
+
+func main() {
+	// 関数パッケージの init は JSON ログを標準出力に書くため、標準エラーに戻す
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	root := flag.String("root", "local", "directory that holds a directory per bucket")
+	sinkName := flag.String("sink", "jsonl", "sink of the log files: jsonl to write the parsed records, or summary to only count them")
+	out := flag.String("out", "", "file the jsonl sink writes to (default stdout)")
+	timeZone := flag.String("time-zone", defaultTimeZone, "time zone of the request times")
+	watch := flag.Duration("watch", 0, "interval to look for new zip files; the existing files are processed once when 0")
+	flag.Parse()
+
+	if err := run(*root, *sinkName, *out, *timeZone, *watch); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(root string, sinkName string, out string, timeZone string, watch time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return fmt.Errorf("time-zone: %v", err)
+	}
+
+	sink := &ParseSink{Location: loc}
+	switch sinkName {
+	case "jsonl":
+		sink.Out = os.Stdout
+		if out != "" {
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			sink.Out = f
+		}
+	case "summary":
+	default:
+		return fmt.Errorf("unknown sink %q", sinkName)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, ZipBucket), 0755); err != nil {
+		return err
+	}
+	client := &common.FileStorageClient{Root: root}
+	pipeline := NewPipeline(client, sink)
+
+	processed := map[string]int64{}
+	for {
+		if err := processNewZips(ctx, client, pipeline, processed); err != nil {
+			if watch == 0 {
+				return err
+			}
+			log.Print(err)
+		}
+		if watch == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watch):
+		}
+	}
+}
+
+// processNewZips runs the zip files that are not in processed, or have
+// changed since, through the pipeline.
+func processNewZips(ctx context.Context, client common.StorageClient, pipeline *Pipeline, processed map[string]int64) error {
+	var errs []error
+	it := client.Bucket(ZipBucket).Objects(ctx, "")
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Objects: %v", err)
+		}
+		if !strings.HasSuffix(strings.ToLower(attrs.Name), ".zip") || processed[attrs.Name] == attrs.Generation {
+			continue
+		}
+
+		log.Printf("Processing %s/%s", ZipBucket, attrs.Name)
+		if err := pipeline.ProcessZip(ctx, attrs.Name, attrs.Size, attrs.Generation); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", attrs.Name, err))
+		}
+		processed[attrs.Name] = attrs.Generation
+	}
+	return errors.Join(errs...)
+}
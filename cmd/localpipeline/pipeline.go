@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/common/go/schemata"
+	"github.com/takotakot/iswf_log_to_bq/untar"
+	"github.com/takotakot/iswf_log_to_bq/unzip"
+)
+
+// The buckets and topics of the local pipeline. They stand in for the
+// buckets and topics that terraform creates.
+const (
+	ZipBucket = "zip"
+	TgzBucket = "tgz"
+	CsvBucket = "csv"
+
+	tgzTopic = "tgz"
+	csvTopic = "csv"
+)
+
+// extractLimits are the limits that the deployed functions use by default.
+var extractLimits = common.ExtractLimits{
+	MaxEntries:          common.DefaultMaxEntries,
+	MaxTotalSize:        common.DefaultMaxTotalSize,
+	MaxCompressionRatio: common.DefaultMaxCompressionRatio,
+}
+
+// Sink loads a log file written by the pipeline, in place of load2logs.
+type Sink interface {
+	Load(ctx context.Context, client common.StorageClient, msg common.PubSubMessageData) error
+}
+
+// Pipeline chains unzip, untar and a Sink through a common.MessageBus, as the
+// Cloud Functions are chained through Pub/Sub.
+type Pipeline struct {
+	client common.StorageClient
+	bus    *common.MessageBus
+}
+
+func NewPipeline(client common.StorageClient, sink Sink) *Pipeline {
+	p := &Pipeline{client: client, bus: common.NewMessageBus()}
+
+	p.bus.Subscribe(tgzTopic, func(ctx context.Context, msg common.PubSubMessageData) error {
+		return untar.ExtractTgzAndUpload(ctx, client, msg.Bucket, msg.FilePath, CsvBucket, p.bus.Sender(ctx, csvTopic), untar.ExtractOptions{EntryNamePolicy: common.EntryNamePolicyReject, Limits: extractLimits})
+	})
+	p.bus.Subscribe(csvTopic, func(ctx context.Context, msg common.PubSubMessageData) error {
+		return sink.Load(ctx, client, msg)
+	})
+
+	return p
+}
+
+// ProcessZip runs the generation of the zip object in ZipBucket through every
+// stage.
+func (p *Pipeline) ProcessZip(ctx context.Context, name string, size int64, generation int64) error {
+	return unzip.ExtractAndUpload(ctx, p.client, ZipBucket, name, size, generation, TgzBucket, p.bus.Sender(ctx, tgzTopic), unzip.ExtractOptions{EntryNamePolicy: common.EntryNamePolicyReject, Name: common.ZipNameOptions{Charset: common.CharsetAuto}, Limits: extractLimits})
+}
+
+// ParseSink parses the log files with the Go parser and writes the records
+// as JSON lines to Out. Only the number of records is logged when Out is nil.
+// Lines that cannot be parsed are logged and skipped.
+type ParseSink struct {
+	Location *time.Location
+	Out      io.Writer
+
+	mu sync.Mutex
+}
+
+func (s *ParseSink) Load(ctx context.Context, client common.StorageClient, msg common.PubSubMessageData) error {
+	object := client.Bucket(msg.Bucket).Object(msg.FilePath)
+	// load2logs と同じく、展開したときの内容であることを確かめる
+	if msg.CRC32C != "" {
+		if err := common.VerifyObject(ctx, object, msg.Generation, msg.CRC32C); err != nil {
+			return fmt.Errorf("VerifyObject: %v", err)
+		}
+	}
+	reader, err := object.NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("NewReader: %v", err)
+	}
+	defer reader.Close()
+
+	br := bufio.NewReader(reader)
+	var records []*common.AccessLogRecord
+	var parser *common.AccessLogParser
+	rejected := 0
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("ReadString: %v", err)
+		}
+		if line == "" {
+			break
+		}
+
+		if parser == nil {
+			layout, err := schemata.DetectStagingLayout(line)
+			if err != nil {
+				return fmt.Errorf("DetectStagingLayout: %v", err)
+			}
+			parser, err = common.NewAccessLogParser(layout.ColumnNames(), s.Location)
+			if err != nil {
+				return fmt.Errorf("NewAccessLogParser: %v", err)
+			}
+			if layout.HasHeader {
+				continue
+			}
+		}
+
+		if strings.TrimSpace(line) != "" {
+			record, parseErr := parser.Parse(lineNumber, line)
+			if parseErr != nil {
+				log.Printf("Reject %s: %v", msg.FilePath, parseErr)
+				rejected++
+			} else {
+				records = append(records, record)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	log.Printf("Loaded %d records of gs://%s/%s (rejected: %d)", len(records), msg.Bucket, msg.FilePath, rejected)
+
+	if s.Out == nil {
+		return nil
+	}
+
+	// 複数のファイルが並行して届くため、ファイル単位でまとめて書き出す
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	encoder := json.NewEncoder(s.Out)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("Encode: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testLogLine = "2024/01/08\t09:15:30\tHTTPS\t192.0.2.10\tsales\ttaro\t-\tProxied\t-\t200\twww.example.com\t35\t512\t2048\t-\ttext/html\tcategory\tbusiness\t-\t-\t-\thttps://www.example.com/\t-\t-\t-\n"
+
+func writeTestZip(t *testing.T, path string, csv string) {
+	var tgz bytes.Buffer
+	gw := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gw)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "access.log", Mode: 0644, Size: int64(len(csv)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte(csv))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Create("access.tgz")
+	assert.NoError(t, err)
+	_, err = fw.Write(tgz.Bytes())
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+}
+
+func TestPipeline(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, ZipBucket, "2024/01/08.zip"), testLogLine+"broken\n"+testLogLine)
+
+	var out bytes.Buffer
+	client := &common.FileStorageClient{Root: root}
+	pipeline := NewPipeline(client, &ParseSink{Location: time.UTC, Out: &out})
+
+	processed := map[string]int64{}
+	assert.NoError(t, processNewZips(ctx, client, pipeline, processed))
+
+	assert.FileExists(t, filepath.Join(root, TgzBucket, "2024/01/08.zip/access.tgz"))
+	assert.FileExists(t, filepath.Join(root, CsvBucket, "2024/01/08.zip/access.tgz/access.log"))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		var record map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+		assert.Equal(t, "www.example.com", record["FQDN"])
+		assert.Equal(t, "2024-01-08T09:15:30Z", record["RequestTime"])
+	}
+
+	// 処理済みのファイルは再度処理しない
+	out.Reset()
+	assert.NoError(t, processNewZips(ctx, client, pipeline, processed))
+	assert.Empty(t, out.String())
+}
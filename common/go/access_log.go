@@ -0,0 +1,234 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/takotakot/iswf_log_to_bq/common/go/schemata"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	accessLogDateLayout = "2006/01/02"
+	accessLogTimeLayout = "15:04:05.999999999"
+	// accessLogNullValue is written by ISWF for a missing value.
+	accessLogNullValue = "-"
+)
+
+// AccessLogRecord is one line of an ISWF access log.
+// Fields mirror the columns of the logs table.
+type AccessLogRecord struct {
+	RequestTime           time.Time
+	Protocol              string
+	ClientIP              bigquery.NullString
+	GroupName             string
+	AccountName           string
+	TransferStatus        string
+	StatusCode            int64
+	FQDN                  string
+	TransferTimeMs        int64
+	RequestLength         int64
+	ResponseLength        int64
+	FileType              bigquery.NullString
+	ContentType           bigquery.NullString
+	CategorizationReason  string
+	DeterminationCategory string
+	RequestURL            string
+}
+
+// ParseError reports where a line of an access log could not be parsed.
+type ParseError struct {
+	// Line is the 1-based line number.
+	Line int
+	// Column is the 1-based column number, or 0 if the error is about the whole line.
+	Column int
+	// Field is the name of the column, if any.
+	Field string
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d, column %d (%s): %v", e.Line, e.Column, e.Field, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+var errRequiredValue = errors.New("required value is empty")
+
+// accessLogColumns are the columns that AccessLogParser reads.
+var accessLogColumns = []string{
+	"request_date",
+	"request_time",
+	"protocol",
+	"client_ip",
+	"group_name",
+	"account_name",
+	"transfer_status",
+	"status_code",
+	"fqdn",
+	"transfer_time_ms",
+	"request_length",
+	"response_length",
+	"file_type",
+	"content_type",
+	"categorization_reason",
+	"determination_category",
+	"request_url",
+}
+
+// AccessLogParser parses tab-separated ISWF access log lines.
+type AccessLogParser struct {
+	index    map[string]int
+	columns  int
+	location *time.Location
+}
+
+// NewAccessLogParser returns a parser for lines whose columns are named by
+// columns, in order. Request times are interpreted in loc.
+func NewAccessLogParser(columns []string, loc *time.Location) (*AccessLogParser, error) {
+	index := map[string]int{}
+	for i, name := range columns {
+		index[name] = i
+	}
+
+	var missing []string
+	for _, name := range accessLogColumns {
+		if _, ok := index[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing columns: %s", strings.Join(missing, ", "))
+	}
+
+	return &AccessLogParser{
+		index:    index,
+		columns:  len(columns),
+		location: loc,
+	}, nil
+}
+
+// DefaultAccessLogParser returns a parser for the default staging layout.
+func DefaultAccessLogParser(loc *time.Location) (*AccessLogParser, error) {
+	layout, err := schemata.Staging()
+	if err != nil {
+		return nil, fmt.Errorf("schemata.Staging: %v", err)
+	}
+	return NewAccessLogParser(layout.ColumnNames(), loc)
+}
+
+// Parse parses one line. lineNumber is only used for error reporting.
+func (p *AccessLogParser) Parse(lineNumber int, line string) (*AccessLogRecord, error) {
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+	if len(fields) != p.columns {
+		return nil, &ParseError{Line: lineNumber, Err: fmt.Errorf("%d columns, want %d", len(fields), p.columns)}
+	}
+
+	lp := lineParser{parser: p, fields: fields, line: lineNumber}
+	record := &AccessLogRecord{
+		RequestTime:           lp.requestTime(),
+		Protocol:              lp.string("protocol"),
+		ClientIP:              lp.clientIP(),
+		GroupName:             lp.string("group_name"),
+		AccountName:           lp.string("account_name"),
+		TransferStatus:        lp.string("transfer_status"),
+		StatusCode:            lp.int64("status_code"),
+		FQDN:                  lp.string("fqdn"),
+		TransferTimeMs:        lp.int64("transfer_time_ms"),
+		RequestLength:         lp.int64("request_length"),
+		ResponseLength:        lp.int64("response_length"),
+		FileType:              lp.nullString("file_type"),
+		ContentType:           lp.nullString("content_type"),
+		CategorizationReason:  lp.string("categorization_reason"),
+		DeterminationCategory: lp.string("determination_category"),
+		RequestURL:            lp.string("request_url"),
+	}
+	if lp.err != nil {
+		return nil, lp.err
+	}
+
+	return record, nil
+}
+
+// lineParser keeps the first error found while reading the fields of a line.
+type lineParser struct {
+	parser *AccessLogParser
+	fields []string
+	line   int
+	err    error
+}
+
+func (lp *lineParser) value(name string) (string, int) {
+	i := lp.parser.index[name]
+	return lp.fields[i], i + 1
+}
+
+func (lp *lineParser) fail(name string, column int, err error) {
+	if lp.err == nil {
+		lp.err = &ParseError{Line: lp.line, Column: column, Field: name, Err: err}
+	}
+}
+
+func (lp *lineParser) string(name string) string {
+	v, column := lp.value(name)
+	if v == "" {
+		lp.fail(name, column, errRequiredValue)
+	}
+	return v
+}
+
+func (lp *lineParser) nullString(name string) bigquery.NullString {
+	v, _ := lp.value(name)
+	if v == "" || v == accessLogNullValue {
+		return bigquery.NullString{}
+	}
+	return bigquery.NullString{StringVal: v, Valid: true}
+}
+
+func (lp *lineParser) clientIP() bigquery.NullString {
+	ip := lp.nullString("client_ip")
+	if ip.Valid {
+		ip.StringVal = NormalizeClientIP(ip.StringVal)
+	}
+	return ip
+}
+
+func (lp *lineParser) int64(name string) int64 {
+	v, column := lp.value(name)
+	if v == "" {
+		lp.fail(name, column, errRequiredValue)
+		return 0
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		lp.fail(name, column, err)
+	}
+	return n
+}
+
+func (lp *lineParser) requestTime() time.Time {
+	date, dateColumn := lp.value("request_date")
+	d, err := time.ParseInLocation(accessLogDateLayout, date, time.UTC)
+	if err != nil {
+		lp.fail("request_date", dateColumn, err)
+		return time.Time{}
+	}
+
+	clock, timeColumn := lp.value("request_time")
+	c, err := time.ParseInLocation(accessLogTimeLayout, clock, time.UTC)
+	if err != nil {
+		lp.fail("request_time", timeColumn, err)
+		return time.Time{}
+	}
+
+	return time.Date(d.Year(), d.Month(), d.Day(), c.Hour(), c.Minute(), c.Second(), c.Nanosecond(), lp.parser.location)
+}
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/takotakot/iswf_log_to_bq/common/go/schemata"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAccessLogFields() []string {
+	return []string{
+		"2024/01/08",               // request_date
+		"09:15:30",                 // request_time
+		"HTTPS",                    // protocol
+		"192.0.2.10",               // client_ip
+		"sales",                    // group_name
+		"taro",                     // account_name
+		"-",                        // reserved_1
+		"Proxied",                  // transfer_status
+		"-",                        // reserved_2
+		"200",                      // status_code
+		"www.example.com",          // fqdn
+		"35",                       // transfer_time_ms
+		"512",                      // request_length
+		"2048",                     // response_length
+		"-",                        // file_type
+		"text/html",                // content_type
+		"category",                 // categorization_reason
+		"business",                 // determination_category
+		"-",                        // reserved_4
+		"-",                        // reserved_5
+		"-",                        // reserved_6
+		"https://www.example.com/", // request_url
+		"-",                        // reserved_7
+		"-",                        // reserved_8
+		"-",                        // reserved_9
+	}
+}
+
+func TestAccessLogParserParse(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	p, err := DefaultAccessLogParser(tokyo)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	record, err := p.Parse(1, strings.Join(testAccessLogFields(), "\t")+"\r\n")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.True(t, record.RequestTime.Equal(time.Date(2024, 1, 8, 0, 15, 30, 0, time.UTC)))
+	assert.Equal(t, "HTTPS", record.Protocol)
+	assert.Equal(t, bigquery.NullString{StringVal: "192.0.2.10", Valid: true}, record.ClientIP)
+	assert.Equal(t, "sales", record.GroupName)
+	assert.Equal(t, "taro", record.AccountName)
+	assert.Equal(t, "Proxied", record.TransferStatus)
+	assert.Equal(t, int64(200), record.StatusCode)
+	assert.Equal(t, "www.example.com", record.FQDN)
+	assert.Equal(t, int64(35), record.TransferTimeMs)
+	assert.Equal(t, int64(512), record.RequestLength)
+	assert.Equal(t, int64(2048), record.ResponseLength)
+	assert.False(t, record.FileType.Valid)
+	assert.True(t, record.ContentType.Valid)
+	assert.Equal(t, "text/html", record.ContentType.StringVal)
+	assert.Equal(t, "category", record.CategorizationReason)
+	assert.Equal(t, "business", record.DeterminationCategory)
+	assert.Equal(t, "https://www.example.com/", record.RequestURL)
+}
+
+func TestAccessLogParserParseError(t *testing.T) {
+	p, err := DefaultAccessLogParser(time.UTC)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	for _, tc := range []struct {
+		name   string
+		column int
+		value  string
+		field  string
+	}{
+		{name: "bad date", column: 1, value: "2024-01-08", field: "request_date"},
+		{name: "bad time", column: 2, value: "25:00:00", field: "request_time"},
+		{name: "bad status code", column: 10, value: "OK", field: "status_code"},
+		{name: "empty fqdn", column: 11, value: "", field: "fqdn"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fields := testAccessLogFields()
+			fields[tc.column-1] = tc.value
+
+			_, err := p.Parse(7, strings.Join(fields, "\t"))
+
+			var parseErr *ParseError
+			if assert.True(t, errors.As(err, &parseErr)) {
+				assert.Equal(t, 7, parseErr.Line)
+				assert.Equal(t, tc.column, parseErr.Column)
+				assert.Equal(t, tc.field, parseErr.Field)
+			}
+		})
+	}
+
+	_, err = p.Parse(3, "a\tb")
+	var parseErr *ParseError
+	if assert.True(t, errors.As(err, &parseErr)) {
+		assert.Equal(t, 3, parseErr.Line)
+		assert.Equal(t, 0, parseErr.Column)
+	}
+}
+
+// The parser must treat NULL the same way as the load script does.
+func TestAccessLogParserMatchesSchemata(t *testing.T) {
+	layout, err := schemata.Staging()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, projection := range layout.Projections {
+		if projection.NullIf != nil {
+			assert.Equal(t, accessLogNullValue, *projection.NullIf, projection.Name)
+		}
+	}
+
+	table, err := schemata.LogsTable()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	p, err := DefaultAccessLogParser(time.UTC)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, c := range table {
+		i, ok := p.index[c.Name]
+		if !ok || !c.Required() {
+			continue
+		}
+		fields := testAccessLogFields()
+		fields[i] = ""
+		_, err := p.Parse(1, strings.Join(fields, "\t"))
+		assert.Error(t, err, c.Name)
+	}
+}
+
+func TestNewAccessLogParserMissingColumns(t *testing.T) {
+	_, err := NewAccessLogParser([]string{"request_date", "request_time"}, time.UTC)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "protocol")
+	}
+}
@@ -10,19 +10,54 @@ import (
 
 type BigQueryClient interface {
 	Query(q string) BigQueryQueryHandle
+	Dataset(id string) BigQueryDatasetHandle
 }
 
 type BigQueryQueryHandle interface {
 	Run(ctx context.Context) (j BigQueryJobHandle, err error)
 	SetParameters(p []bigquery.QueryParameter)
+	// SetDryRun makes Run validate the query and estimate its cost without
+	// executing it. The result is given by the LastStatus of the job.
+	SetDryRun(dryRun bool)
+	// SetMaxBytesBilled makes the query fail without being billed if it
+	// would bill more bytes. 0 means the project default.
+	SetMaxBytesBilled(n int64)
 }
 
 type BigQueryJobHandle interface {
 	Wait(ctx context.Context) (BigQueryJobStatusHandle, error)
+	Read(ctx context.Context) (BigQueryRowIterator, error)
+	// LastStatus returns the status of the job when it was last retrieved,
+	// e.g. the result of a dry run.
+	LastStatus() BigQueryJobStatusHandle
 }
 
 type BigQueryJobStatusHandle interface {
 	Err() error
+	// Statistics returns the statistics of the job, or nil if there are none.
+	Statistics() *bigquery.JobStatistics
+}
+
+type BigQueryDatasetHandle interface {
+	Tables(ctx context.Context) BigQueryTableIterator
+	Table(id string) BigQueryTableHandle
+}
+
+// The BigQueryTableIterator interface is defined for the *bigquery.TableIterator type.
+// Next returns iterator.Done when there are no more tables.
+type BigQueryTableIterator interface {
+	Next() (BigQueryTableHandle, error)
+}
+
+type BigQueryTableHandle interface {
+	TableID() string
+	Metadata(ctx context.Context) (*bigquery.TableMetadata, error)
+	Delete(ctx context.Context) error
+}
+
+// The BigQueryRowIterator interface is defined for the *bigquery.RowIterator type.
+type BigQueryRowIterator interface {
+	Next(dst interface{}) error
 }
 
 type RealBigQueryClient struct {
@@ -41,10 +76,26 @@ type RealBigQueryJobStatusHandle struct {
 	status *bigquery.JobStatus
 }
 
+type RealBigQueryDatasetHandle struct {
+	dataset *bigquery.Dataset
+}
+
+type RealBigQueryTableIterator struct {
+	it *bigquery.TableIterator
+}
+
+type RealBigQueryTableHandle struct {
+	table *bigquery.Table
+}
+
 func (r *RealBigQueryClient) Query(q string) BigQueryQueryHandle {
 	return &RealBigQueryQueryHandle{query: r.Client.Query(q)}
 }
 
+func (r *RealBigQueryClient) Dataset(id string) BigQueryDatasetHandle {
+	return &RealBigQueryDatasetHandle{dataset: r.Client.Dataset(id)}
+}
+
 func (r *RealBigQueryQueryHandle) Run(ctx context.Context) (j BigQueryJobHandle, err error) {
 	job, err := r.query.Run(ctx)
 	return &RealBigQueryJobHandle{job}, err
@@ -54,11 +105,62 @@ func (r *RealBigQueryQueryHandle) SetParameters(p []bigquery.QueryParameter) {
 	r.query.Parameters = p
 }
 
+func (r *RealBigQueryQueryHandle) SetDryRun(dryRun bool) {
+	r.query.DryRun = dryRun
+}
+
+func (r *RealBigQueryQueryHandle) SetMaxBytesBilled(n int64) {
+	r.query.MaxBytesBilled = n
+}
+
 func (s *RealBigQueryJobHandle) Wait(ctx context.Context) (BigQueryJobStatusHandle, error) {
 	status, err := s.job.Wait(ctx)
 	return &RealBigQueryJobStatusHandle{status}, err
 }
 
+func (s *RealBigQueryJobHandle) Read(ctx context.Context) (BigQueryRowIterator, error) {
+	return s.job.Read(ctx)
+}
+
+func (s *RealBigQueryJobHandle) LastStatus() BigQueryJobStatusHandle {
+	return &RealBigQueryJobStatusHandle{s.job.LastStatus()}
+}
+
 func (s *RealBigQueryJobStatusHandle) Err() error {
 	return s.status.Err()
 }
+
+func (s *RealBigQueryJobStatusHandle) Statistics() *bigquery.JobStatistics {
+	if s.status == nil {
+		return nil
+	}
+	return s.status.Statistics
+}
+
+func (d *RealBigQueryDatasetHandle) Tables(ctx context.Context) BigQueryTableIterator {
+	return &RealBigQueryTableIterator{it: d.dataset.Tables(ctx)}
+}
+
+func (d *RealBigQueryDatasetHandle) Table(id string) BigQueryTableHandle {
+	return &RealBigQueryTableHandle{table: d.dataset.Table(id)}
+}
+
+func (i *RealBigQueryTableIterator) Next() (BigQueryTableHandle, error) {
+	table, err := i.it.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &RealBigQueryTableHandle{table: table}, nil
+}
+
+func (t *RealBigQueryTableHandle) TableID() string {
+	return t.table.TableID
+}
+
+func (t *RealBigQueryTableHandle) Metadata(ctx context.Context) (*bigquery.TableMetadata, error) {
+	return t.table.Metadata(ctx)
+}
+
+func (t *RealBigQueryTableHandle) Delete(ctx context.Context) error {
+	return t.table.Delete(ctx)
+}
@@ -0,0 +1,216 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+const (
+	// CharsetAuto detects CharsetUTF8 or CharsetCP932 from the beginning of
+	// the content.
+	CharsetAuto = "auto"
+	// CharsetUTF8 leaves the content as is.
+	CharsetUTF8 = "utf-8"
+	// CharsetCP932 is Shift_JIS with the Windows extensions, written by
+	// Windows hosts with the Japanese locale.
+	CharsetCP932 = "cp932"
+)
+
+// charsetSampleSize is the size of the content read to detect the charset.
+const charsetSampleSize = 64 * 1024
+
+// maxReportedInvalidLines bounds the line numbers kept in a TranscodeReport.
+const maxReportedInvalidLines = 10
+
+var charsetAliases = map[string]string{
+	"auto":        CharsetAuto,
+	"utf-8":       CharsetUTF8,
+	"utf8":        CharsetUTF8,
+	"cp932":       CharsetCP932,
+	"windows-31j": CharsetCP932,
+	"shift_jis":   CharsetCP932,
+	"sjis":        CharsetCP932,
+}
+
+// NormalizeCharset returns the canonical name of a charset name or alias.
+func NormalizeCharset(name string) (string, error) {
+	charset, ok := charsetAliases[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return "", fmt.Errorf("unknown charset %q, want %s, %s or %s", name, CharsetAuto, CharsetUTF8, CharsetCP932)
+	}
+	return charset, nil
+}
+
+// DetectCharset returns CharsetUTF8 if sample is valid UTF-8, and
+// CharsetCP932 otherwise. A rune cut at the end of the sample is ignored.
+func DetectCharset(sample []byte) string {
+	if utf8.Valid(trimIncompleteRune(sample)) {
+		return CharsetUTF8
+	}
+	return CharsetCP932
+}
+
+func trimIncompleteRune(b []byte) []byte {
+	for i := 1; i <= utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return b[:len(b)-i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// TranscodeReport tells how the content was transcoded.
+type TranscodeReport struct {
+	// Charset is the charset the content was read as.
+	Charset string
+	// InvalidSequences is the number of byte sequences that are not valid
+	// in Charset. They are replaced with U+FFFD when transcoded from
+	// CharsetCP932, and left as is in CharsetUTF8.
+	InvalidSequences int
+	// InvalidLines are the 1-based numbers of the first lines that have
+	// invalid sequences.
+	InvalidLines []int
+	// Binary is true when the content is compressed or binary. It is then
+	// read as is.
+	Binary bool
+}
+
+// Transcoder reads the content of a log file in UTF-8. The content is
+// transcoded line by line: the bytes of a line feed never appear in a
+// multibyte character of CP932. A line longer than the buffer is transcoded
+// in chunks, and a character cut at the end of a chunk is carried over to the
+// next one.
+type Transcoder struct {
+	r       *bufio.Reader
+	charset string
+	binary  bool
+	decoder transform.Transformer
+	// carry is the incomplete character at the end of the previous chunk.
+	carry   []byte
+	pending []byte
+	// line is the number of the lines read to the end, and lineInvalid is
+	// true when the line being read has been reported.
+	line        int
+	lineInvalid bool
+	err         error
+	report      TranscodeReport
+}
+
+// NewTranscoder returns a Transcoder that reads r in charset, which may be
+// any name accepted by NormalizeCharset. Compressed or binary content, such
+// as a .log.gz in an archive, is read as is whatever the charset.
+func NewTranscoder(r io.Reader, charset string) (*Transcoder, error) {
+	charset, err := NormalizeCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(r, charsetSampleSize)
+	sample, err := br.Peek(charsetSampleSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("Peek: %v", err)
+	}
+	if isBinary(sample) {
+		return &Transcoder{r: br, binary: true, report: TranscodeReport{Binary: true}}, nil
+	}
+	if charset == CharsetAuto {
+		charset = DetectCharset(sample)
+	}
+
+	return &Transcoder{r: br, charset: charset, report: TranscodeReport{Charset: charset}}, nil
+}
+
+// isBinary reports whether sample is compressed or binary content. NUL does
+// not appear in the text of either charset.
+func isBinary(sample []byte) bool {
+	return DetectCompression(sample) != CompressionNone || bytes.IndexByte(sample, 0) >= 0
+}
+
+func (t *Transcoder) Read(p []byte) (int, error) {
+	if t.binary {
+		return t.r.Read(p)
+	}
+	for len(t.pending) == 0 {
+		if t.err != nil {
+			return 0, t.err
+		}
+		chunk, err := t.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			t.err = err
+		}
+		// 行末か内容の終わりでなければ、切れた文字を次のチャンクに回す
+		eol := len(chunk) > 0 && chunk[len(chunk)-1] == '\n'
+		if len(t.carry) > 0 {
+			chunk = append(t.carry, chunk...)
+			t.carry = nil
+		}
+		t.pending = t.transcode(chunk, eol || t.err != nil)
+		if eol {
+			t.line++
+			t.lineInvalid = false
+		}
+	}
+
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+// transcode returns chunk in UTF-8. The incomplete character at the end of
+// chunk is kept in t.carry unless atEnd is true.
+func (t *Transcoder) transcode(chunk []byte, atEnd bool) []byte {
+	var out []byte
+	invalid := 0
+	if t.charset == CharsetCP932 {
+		if t.decoder == nil {
+			t.decoder = japanese.ShiftJIS.NewDecoder()
+		}
+		// 半角カナや置き換えた U+FFFD は 1 バイトから 3 バイトになる
+		out = make([]byte, len(chunk)*utf8.UTFMax)
+		nDst, nSrc, err := t.decoder.Transform(out, chunk, atEnd)
+		if err != nil && err != transform.ErrShortSrc {
+			// デコーダは不正なバイトを置き換えるため、ここには来ない
+			nDst, nSrc = copy(out, chunk), len(chunk)
+		}
+		out = out[:nDst]
+		t.carry = bytes.Clone(chunk[nSrc:])
+		invalid = bytes.Count(out, []byte(string(utf8.RuneError)))
+	} else {
+		out = chunk
+		if !atEnd {
+			out = trimIncompleteRune(chunk)
+			t.carry = bytes.Clone(chunk[len(out):])
+		}
+		for rest := out; len(rest) > 0; {
+			r, size := utf8.DecodeRune(rest)
+			if r == utf8.RuneError && size == 1 {
+				invalid++
+			}
+			rest = rest[size:]
+		}
+	}
+
+	if invalid > 0 {
+		t.report.InvalidSequences += invalid
+		if !t.lineInvalid && len(t.report.InvalidLines) < maxReportedInvalidLines {
+			t.report.InvalidLines = append(t.report.InvalidLines, t.line+1)
+		}
+		t.lineInvalid = true
+	}
+	return out
+}
+
+// Report returns the report of the content read so far.
+func (t *Transcoder) Report() TranscodeReport {
+	return t.report
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/japanese"
+)
+
+func encodeCP932(t *testing.T, s string) []byte {
+	b, err := japanese.ShiftJIS.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNormalizeCharset(t *testing.T) {
+	for name, want := range map[string]string{
+		"":            "",
+		"AUTO":        CharsetAuto,
+		"UTF8":        CharsetUTF8,
+		"Shift_JIS":   CharsetCP932,
+		"Windows-31J": CharsetCP932,
+	} {
+		charset, err := NormalizeCharset(name)
+		if want == "" {
+			assert.Error(t, err, name)
+			continue
+		}
+		assert.NoError(t, err, name)
+		assert.Equal(t, want, charset, name)
+	}
+}
+
+func TestDetectCharset(t *testing.T) {
+	assert.Equal(t, CharsetUTF8, DetectCharset([]byte("営業部\ttaro\n")))
+	assert.Equal(t, CharsetCP932, DetectCharset(encodeCP932(t, "営業部\tｶﾅ\n")))
+	// 末尾で切れた文字は無視する
+	assert.Equal(t, CharsetUTF8, DetectCharset([]byte("営業部")[:8]))
+	assert.Equal(t, CharsetUTF8, DetectCharset(nil))
+}
+
+func TestTranscoderCP932(t *testing.T) {
+	content := append(encodeCP932(t, "営業部\t①髙\n"), 0x81, '\n')
+	content = append(content, encodeCP932(t, "経理部\n")...)
+
+	transcoder, err := NewTranscoder(bytes.NewReader(content), CharsetAuto)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	out, err := io.ReadAll(transcoder)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "営業部\t①髙\n�\n経理部\n", string(out))
+	assert.Equal(t, TranscodeReport{Charset: CharsetCP932, InvalidSequences: 1, InvalidLines: []int{2}}, transcoder.Report())
+}
+
+func TestTranscoderUTF8(t *testing.T) {
+	content := "営業部\n" + strings.Repeat("a", charsetSampleSize) + "\xff\n"
+
+	transcoder, err := NewTranscoder(strings.NewReader(content), CharsetUTF8)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	out, err := io.ReadAll(transcoder)
+
+	assert.NoError(t, err)
+	// UTF-8 はそのまま書き出す
+	assert.Equal(t, content, string(out))
+	assert.Equal(t, TranscodeReport{Charset: CharsetUTF8, InvalidSequences: 1, InvalidLines: []int{2}}, transcoder.Report())
+}
+
+func TestTranscoderBinary(t *testing.T) {
+	// CP932 と判定されても圧縮ファイルは変換しない
+	for _, content := range [][]byte{
+		append([]byte{0x1f, 0x8b, 0x08, 0x00}, encodeCP932(t, "営業部\n")...),
+		append(encodeCP932(t, "営業部"), 0x00, 0xff, '\n'),
+	} {
+		transcoder, err := NewTranscoder(bytes.NewReader(content), CharsetCP932)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		out, err := io.ReadAll(transcoder)
+
+		assert.NoError(t, err)
+		assert.Equal(t, content, out)
+		assert.Equal(t, TranscodeReport{Binary: true}, transcoder.Report())
+	}
+}
+
+func TestTranscoderLongLine(t *testing.T) {
+	// 改行のない行はバッファの大きさごとに変換し、境界で切れた文字は次に回す
+	line := "a" + strings.Repeat("営業部", charsetSampleSize/3)
+	for _, tc := range []struct {
+		charset string
+		content []byte
+	}{
+		{CharsetCP932, encodeCP932(t, line+"\n"+line)},
+		{CharsetUTF8, []byte(line + "\n" + line)},
+	} {
+		transcoder, err := NewTranscoder(bytes.NewReader(tc.content), tc.charset)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		out, err := io.ReadAll(transcoder)
+
+		assert.NoError(t, err, tc.charset)
+		assert.Equal(t, line+"\n"+line, string(out), tc.charset)
+		assert.Equal(t, TranscodeReport{Charset: tc.charset}, transcoder.Report(), tc.charset)
+	}
+
+	// 切れたまま終わる文字は不正なバイト列として数える
+	transcoder, err := NewTranscoder(bytes.NewReader(append(encodeCP932(t, line), 0x81)), CharsetCP932)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	out, err := io.ReadAll(transcoder)
+
+	assert.NoError(t, err)
+	assert.Equal(t, line+"�", string(out))
+	assert.Equal(t, TranscodeReport{Charset: CharsetCP932, InvalidSequences: 1, InvalidLines: []int{1}}, transcoder.Report())
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// crc32cTable is the Castagnoli table that Cloud Storage uses for CRC32C.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrStaleObject is returned by VerifyObject when the object has been
+// replaced by another generation.
+var ErrStaleObject = errors.New("object has been replaced")
+
+// ChecksumCRC32C returns the CRC32C of data.
+func ChecksumCRC32C(data []byte) uint32 {
+	return crc32.Checksum(data, crc32cTable)
+}
+
+// EncodeCRC32C encodes crc as the JSON API and the notifications of Cloud
+// Storage do: base64 of the big-endian bytes.
+func EncodeCRC32C(crc uint32) string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc))
+}
+
+// DecodeCRC32C decodes a CRC32C encoded by EncodeCRC32C.
+func DecodeCRC32C(s string) (uint32, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, fmt.Errorf("invalid CRC32C %q", s)
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// CRC32CWriter is implemented by the writers that check the content against
+// a CRC32C given before it is written, other than *storage.Writer.
+type CRC32CWriter interface {
+	io.WriteCloser
+	SetCRC32C(crc uint32)
+}
+
+// SetWriterCRC32C makes w send crc with the content, so that the upload
+// fails if the stored content does not match. It must be called before the
+// first Write, and returns false if w cannot send a checksum.
+func SetWriterCRC32C(w io.WriteCloser, crc uint32) bool {
+	switch w := w.(type) {
+	case *storage.Writer:
+		w.CRC32C = crc
+		w.SendCRC32C = true
+		return true
+	case CRC32CWriter:
+		w.SetCRC32C(crc)
+		return true
+	}
+	return false
+}
+
+// WrittenCRC32C returns the CRC32C of the object written by w, or false if
+// w has not been closed yet or does not report attributes.
+func WrittenCRC32C(w io.WriteCloser) (uint32, bool) {
+	aw, ok := w.(ObjectAttrsWriter)
+	if !ok {
+		return 0, false
+	}
+	attrs := aw.Attrs()
+	if attrs == nil {
+		return 0, false
+	}
+	return attrs.CRC32C, true
+}
+
+// WriteObject writes the content of r to the object of name. The CRC32C of
+// the content is computed while it is written, and compared with the one
+// of the stored object when the writer reports it. The object is deleted
+// when they differ, so that a corrupted object is not loaded.
+func WriteObject(ctx context.Context, object ObjectHandle, name string, r io.Reader) (UploadResult, error) {
+	return writeObject(ctx, object, name, r, 0, false)
+}
+
+// writeObject is WriteObject that also sends crc with the content if send
+// is true.
+func writeObject(ctx context.Context, object ObjectHandle, name string, r io.Reader, crc uint32, send bool) (UploadResult, error) {
+	// 失敗したときに書きかけのオブジェクトを確定させない
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := object.NewWriter(ctx)
+	if send {
+		SetWriterCRC32C(w, crc)
+	}
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(w, io.TeeReader(r, hash)); err != nil {
+		cancel()
+		w.Close()
+		return UploadResult{}, fmt.Errorf("writing %s: %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return UploadResult{}, fmt.Errorf("closing %s: %v", name, err)
+	}
+
+	result := UploadResult{Name: name, Generation: WrittenGeneration(w), CRC32C: hash.Sum32()}
+	// 送れなかった場合は書き込み後に確かめ、壊れたオブジェクトは消して失敗させる
+	if stored, ok := WrittenCRC32C(w); ok && stored != result.CRC32C {
+		err := fmt.Errorf("%s: stored CRC32C %s does not match the written %s", name, EncodeCRC32C(stored), EncodeCRC32C(result.CRC32C))
+		if deleteErr := object.Delete(ctx); deleteErr != nil && !errors.Is(deleteErr, storage.ErrObjectNotExist) {
+			return UploadResult{}, fmt.Errorf("%v, and Delete: %v", err, deleteErr)
+		}
+		return UploadResult{}, err
+	}
+	return result, nil
+}
+
+// VerifyObject checks that the object is still the generation, if it is not
+// 0, and has the CRC32C encoded as by EncodeCRC32C. It returns an error
+// wrapping ErrStaleObject if the object has been replaced.
+func VerifyObject(ctx context.Context, object ObjectHandle, generation int64, crc32c string) error {
+	want, err := DecodeCRC32C(crc32c)
+	if err != nil {
+		return err
+	}
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("Attrs: %v", err)
+	}
+	if generation != 0 && attrs.Generation != generation {
+		return fmt.Errorf("%w: generation %d, want %d", ErrStaleObject, attrs.Generation, generation)
+	}
+	if attrs.CRC32C != want {
+		return fmt.Errorf("CRC32C %s does not match %s", EncodeCRC32C(attrs.CRC32C), crc32c)
+	}
+	return nil
+}
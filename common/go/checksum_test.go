@@ -0,0 +1,103 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeCRC32C(t *testing.T) {
+	// "hello" の CRC32C (gsutil hash と同じ表記)
+	crc := ChecksumCRC32C([]byte("hello"))
+	assert.Equal(t, uint32(0x9a71bb4c), crc)
+	assert.Equal(t, "mnG7TA==", EncodeCRC32C(crc))
+
+	decoded, err := DecodeCRC32C("mnG7TA==")
+	assert.NoError(t, err)
+	assert.Equal(t, crc, decoded)
+
+	_, err = DecodeCRC32C("AAAA")
+	assert.Error(t, err)
+}
+
+func TestWriteObjectAndVerify(t *testing.T) {
+	ctx := context.Background()
+	client := &FileStorageClient{Root: t.TempDir()}
+	object := client.Bucket("bucket").Object("a.log")
+
+	result, err := WriteObject(ctx, object, "a.log", strings.NewReader("hello"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ChecksumCRC32C([]byte("hello")), result.CRC32C)
+	assert.NotZero(t, result.Generation)
+
+	assert.NoError(t, VerifyObject(ctx, object, result.Generation, EncodeCRC32C(result.CRC32C)))
+	assert.NoError(t, VerifyObject(ctx, object, 0, EncodeCRC32C(result.CRC32C)))
+	assert.ErrorContains(t, VerifyObject(ctx, object, result.Generation, EncodeCRC32C(0)), "does not match")
+	err = VerifyObject(ctx, object, result.Generation+1, EncodeCRC32C(result.CRC32C))
+	assert.True(t, errors.Is(err, ErrStaleObject))
+}
+
+// corruptingObjectHandle stores the content with its first byte changed.
+type corruptingObjectHandle struct {
+	ObjectHandle
+}
+
+func (o *corruptingObjectHandle) NewWriter(ctx context.Context) io.WriteCloser {
+	return &corruptingWriter{ObjectAttrsWriter: o.ObjectHandle.NewWriter(ctx).(ObjectAttrsWriter)}
+}
+
+type corruptingWriter struct {
+	ObjectAttrsWriter
+	written bool
+}
+
+func (w *corruptingWriter) Write(p []byte) (int, error) {
+	if w.written || len(p) == 0 {
+		return w.ObjectAttrsWriter.Write(p)
+	}
+	w.written = true
+	corrupted := bytes.Clone(p)
+	corrupted[0] ^= 1
+	return w.ObjectAttrsWriter.Write(corrupted)
+}
+
+func TestWriteObjectDeletesCorrupted(t *testing.T) {
+	ctx := context.Background()
+	client := &FileStorageClient{Root: t.TempDir()}
+	object := client.Bucket("bucket").Object("a.log")
+
+	// 書き込み後のチェックサムが合わなければオブジェクトを消す
+	_, err := WriteObject(ctx, &corruptingObjectHandle{object}, "a.log", strings.NewReader("hello"))
+	assert.ErrorContains(t, err, "does not match")
+	_, err = object.Attrs(ctx)
+	assert.Error(t, err)
+}
+
+func TestFileObjectWriterCRC32C(t *testing.T) {
+	ctx := context.Background()
+	client := &FileStorageClient{Root: t.TempDir()}
+	object := client.Bucket("bucket").Object("a.log")
+
+	// 送ったチェックサムと内容が合わなければ書き込みを拒む
+	w := object.NewWriter(ctx)
+	assert.True(t, SetWriterCRC32C(w, ChecksumCRC32C([]byte("hello"))))
+	w.Write([]byte("jello"))
+	assert.ErrorContains(t, w.Close(), "does not match")
+	_, err := object.Attrs(ctx)
+	assert.Error(t, err)
+
+	w = object.NewWriter(ctx)
+	SetWriterCRC32C(w, ChecksumCRC32C([]byte("hello")))
+	w.Write([]byte("hello"))
+	assert.NoError(t, w.Close())
+	crc, ok := WrittenCRC32C(w)
+	assert.True(t, ok)
+	assert.Equal(t, ChecksumCRC32C([]byte("hello")), crc)
+}
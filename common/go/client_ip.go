@@ -0,0 +1,45 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	// ClientIPModeRaw stores the normalized client IP address.
+	ClientIPModeRaw = "raw"
+	// ClientIPModeHMAC stores the hex encoded HMAC-SHA256 of the normalized
+	// client IP address, so requests from the same host can still be
+	// correlated without revealing the address.
+	ClientIPModeHMAC = "hmac"
+)
+
+func ValidateClientIPMode(mode string) error {
+	if mode != ClientIPModeRaw && mode != ClientIPModeHMAC {
+		return fmt.Errorf("unknown client IP mode %q, want %s or %s", mode, ClientIPModeRaw, ClientIPModeHMAC)
+	}
+	return nil
+}
+
+// NormalizeClientIP returns the canonical text form of an IPv4 or IPv6
+// address. IPv4-mapped IPv6 addresses are turned into plain IPv4. A value
+// that is not an IP address is returned as is.
+//
+// It matches the client_ip projection of the staging layouts.
+func NormalizeClientIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Zone() != "" {
+		return ip
+	}
+	return addr.Unmap().String()
+}
+
+// PseudonymizeClientIP returns the hex encoded HMAC-SHA256 of the normalized ip.
+func PseudonymizeClientIP(key []byte, ip string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(NormalizeClientIP(ip)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeClientIP(t *testing.T) {
+	for input, want := range map[string]string{
+		"192.0.2.10":           "192.0.2.10",
+		"::ffff:192.0.2.10":    "192.0.2.10",
+		"2001:DB8:0:0:0:0:0:1": "2001:db8::1",
+		"2001:0db8:0000::0001": "2001:db8::1",
+		"fe80::1%eth0":         "fe80::1%eth0",
+		"-":                    "-",
+		"not an address":       "not an address",
+	} {
+		assert.Equal(t, want, NormalizeClientIP(input), input)
+	}
+}
+
+func TestPseudonymizeClientIP(t *testing.T) {
+	key := []byte("secret")
+
+	assert.Equal(t, PseudonymizeClientIP(key, "192.0.2.10"), PseudonymizeClientIP(key, "::ffff:192.0.2.10"))
+	assert.NotEqual(t, PseudonymizeClientIP(key, "192.0.2.10"), PseudonymizeClientIP(key, "192.0.2.11"))
+	assert.NotEqual(t, PseudonymizeClientIP(key, "192.0.2.10"), PseudonymizeClientIP([]byte("other"), "192.0.2.10"))
+}
@@ -16,11 +16,42 @@ type StorageClient interface {
 
 type BucketHandle interface {
 	Object(name string) ObjectHandle
+	Objects(ctx context.Context, prefix string) ObjectIterator
+}
+
+// The ObjectIterator interface is defined for the *storage.ObjectIterator type.
+// Next returns iterator.Done when there are no more objects.
+type ObjectIterator interface {
+	Next() (*storage.ObjectAttrs, error)
 }
 
 type ObjectHandle interface {
 	NewReader(ctx context.Context) (io.ReadCloser, error)
+	// NewRangeReader reads length bytes from offset, or to the end of the
+	// object if length is negative.
+	NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error)
 	NewWriter(ctx context.Context) io.WriteCloser
+	Attrs(ctx context.Context) (*storage.ObjectAttrs, error)
+	// Delete returns storage.ErrObjectNotExist if the object does not exist.
+	Delete(ctx context.Context) error
+}
+
+// GenerationObjectHandle is implemented by the object handles that can be
+// pinned to a generation of the object, like *storage.ObjectHandle.
+type GenerationObjectHandle interface {
+	ObjectHandle
+	Generation(gen int64) ObjectHandle
+}
+
+// ObjectGeneration returns the handle of the generation gen of object, whose
+// reads fail once the object is replaced instead of returning the content of
+// another generation. object is returned as is when gen is 0 or object
+// cannot be pinned.
+func ObjectGeneration(object ObjectHandle, gen int64) ObjectHandle {
+	if g, ok := object.(GenerationObjectHandle); ok && gen != 0 {
+		return g.Generation(gen)
+	}
+	return object
 }
 
 type ObjectWriter interface {
@@ -28,6 +59,27 @@ type ObjectWriter interface {
 	Close() error
 }
 
+// ObjectAttrsWriter is implemented by writers that report the attributes of
+// the object they have written, such as *storage.Writer.
+type ObjectAttrsWriter interface {
+	io.WriteCloser
+	Attrs() *storage.ObjectAttrs
+}
+
+// WrittenGeneration returns the generation of the object written by w.
+// It returns 0 if w has not been closed yet or does not report attributes.
+func WrittenGeneration(w io.WriteCloser) int64 {
+	aw, ok := w.(ObjectAttrsWriter)
+	if !ok {
+		return 0
+	}
+	attrs := aw.Attrs()
+	if attrs == nil {
+		return 0
+	}
+	return attrs.Generation
+}
+
 // Map the abstract interfaces to the real implementation
 
 type RealStorageClient struct {
@@ -46,6 +98,11 @@ func (rbh *RealStorageBucketHandle) Object(name string) ObjectHandle {
 	return &RealStorageObjectHandle{object: rbh.bucket.Object(name)}
 }
 
+// Objects lists the objects whose names begin with prefix.
+func (rbh *RealStorageBucketHandle) Objects(ctx context.Context, prefix string) ObjectIterator {
+	return rbh.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+}
+
 type RealStorageObjectHandle struct {
 	object *storage.ObjectHandle
 }
@@ -54,6 +111,22 @@ func (roh *RealStorageObjectHandle) NewReader(ctx context.Context) (io.ReadClose
 	return roh.object.NewReader(ctx)
 }
 
+func (roh *RealStorageObjectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	return roh.object.NewRangeReader(ctx, offset, length)
+}
+
 func (roh *RealStorageObjectHandle) NewWriter(ctx context.Context) io.WriteCloser {
 	return roh.object.NewWriter(ctx)
 }
+
+func (roh *RealStorageObjectHandle) Attrs(ctx context.Context) (*storage.ObjectAttrs, error) {
+	return roh.object.Attrs(ctx)
+}
+
+func (roh *RealStorageObjectHandle) Delete(ctx context.Context) error {
+	return roh.object.Delete(ctx)
+}
+
+func (roh *RealStorageObjectHandle) Generation(gen int64) ObjectHandle {
+	return &RealStorageObjectHandle{object: roh.object.Generation(gen)}
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compressions of single files, detected by their magic bytes.
+const (
+	CompressionNone  = ""
+	CompressionGzip  = "gzip"
+	CompressionBzip2 = "bzip2"
+	CompressionXz    = "xz"
+	CompressionZstd  = "zstd"
+)
+
+var compressionMagics = []struct {
+	compression string
+	magic       []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// compressionMagicLength is the length of the longest magic.
+const compressionMagicLength = 6
+
+// DetectCompression returns the compression whose magic bytes begin header,
+// or CompressionNone.
+func DetectCompression(header []byte) string {
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.compression
+		}
+	}
+	return CompressionNone
+}
+
+// SniffCompression detects the compression of the content of r. The
+// returned reader reads the whole content, including the bytes peeked at.
+func SniffCompression(r io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(compressionMagicLength)
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("Peek: %v", err)
+	}
+	return br, DetectCompression(header), nil
+}
+
+// NewDecompressor returns a reader of the content of r decompressed with the
+// compression. The content is read as is with CompressionNone.
+func NewDecompressor(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionBzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case CompressionXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// OpenDecompressed detects the compression of the content of r and returns
+// a reader of the decompressed content with the detected compression.
+func OpenDecompressed(r io.Reader) (io.ReadCloser, string, error) {
+	sniffed, compression, err := SniffCompression(r)
+	if err != nil {
+		return nil, "", err
+	}
+	dr, err := NewDecompressor(sniffed, compression)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", compression, err)
+	}
+	return dr, compression, nil
+}
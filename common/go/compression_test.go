@@ -0,0 +1,70 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+// "a\tb\n" compressed by bzip2 -c
+var bzip2Content = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x3e, 0xec, 0xb4, 0x9b, 0x00, 0x00,
+	0x01, 0x41, 0x00, 0x00, 0x30, 0x30, 0x00, 0x20, 0x00, 0x21, 0x9a, 0x68, 0x33, 0x4d, 0x32, 0xbc,
+	0x5d, 0xc9, 0x14, 0xe1, 0x42, 0x40, 0xfb, 0xb2, 0xd2, 0x6c,
+}
+
+func compress(t *testing.T, compression string, content string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch compression {
+	case CompressionNone:
+		return []byte(content)
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionBzip2:
+		return bzip2Content
+	case CompressionXz:
+		w, err = xz.NewWriter(&buf)
+	case CompressionZstd:
+		w, err = zstd.NewWriter(&buf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenDecompressed(t *testing.T) {
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionBzip2, CompressionXz, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			r, detected, err := OpenDecompressed(bytes.NewReader(compress(t, compression, "a\tb\n")))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer r.Close()
+			assert.Equal(t, compression, detected)
+
+			content, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "a\tb\n", string(content))
+		})
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	assert.Equal(t, CompressionNone, DetectCompression(nil))
+	assert.Equal(t, CompressionNone, DetectCompression([]byte("2024/01/08\t")))
+	assert.Equal(t, CompressionGzip, DetectCompression([]byte{0x1f, 0x8b}))
+}
@@ -0,0 +1,335 @@
+// Package config loads the configuration of the functions into a struct
+// from environment variables and an optional YAML file.
+//
+// The fields to load are tagged with the key they are read from:
+//
+//	type EnvConfig struct {
+//		ProjectID string        `env:"PROJECT_ID,required"`
+//		MaxAge    time.Duration `env:"MAX_AGE" default:"24h" validate:"min=1s"`
+//		MaxSize   int64         `env:"MAX_SIZE,size" default:"1GiB"`
+//		Buckets   []string      `env:"BUCKETS"`
+//		Mode      string        `env:"MODE" default:"append" validate:"oneof=append replace"`
+//	}
+//
+// The supported field types are strings, []byte, bool, integers, floats,
+// time.Duration, []string (comma separated) and the types that implement
+// encoding.TextUnmarshaler. Integers tagged with the size option accept
+// units such as 10MB and 1GiB.
+//
+// The YAML file named by the CONFIG_FILE environment variable has the same
+// keys. Environment variables take precedence over the file, and empty ones
+// are treated as unset. The fields whose keys are not set keep their values,
+// so defaults may also be assigned before Load.
+package config
+
+import (
+	"cmp"
+	"encoding"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv is the environment variable that names the YAML file.
+const FileEnv = "CONFIG_FILE"
+
+// Validator is implemented by the configurations that check their values
+// beyond the struct tags. Validate returns a *FieldError, or several of them
+// joined with errors.Join, for each invalid key.
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is a missing or invalid key.
+type FieldError struct {
+	Key string
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Error lists every missing or invalid key found by Load.
+type Error struct {
+	Errs []error
+}
+
+func (e *Error) Error() string {
+	messages := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		messages[i] = err.Error()
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+func (e *Error) Unwrap() []error {
+	return e.Errs
+}
+
+var errNotSet = errors.New("not set")
+
+// Load fills the tagged fields of the struct that dst points to from the
+// environment and the file named by CONFIG_FILE, then validates them. The
+// returned error is an *Error.
+func Load(dst any) error {
+	return load(dst, os.LookupEnv)
+}
+
+func load(dst any, lookupEnv func(string) (string, bool)) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config.Load: %T is not a pointer to a struct", dst)
+	}
+	v = v.Elem()
+
+	var errs []error
+
+	var file map[string]string
+	if path, ok := lookupEnv(FileEnv); ok && path != "" {
+		var err error
+		file, err = readFile(path)
+		if err != nil {
+			return &Error{Errs: []error{&FieldError{Key: FileEnv, Err: err}}}
+		}
+	}
+
+	known := map[string]bool{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		tag, ok := field.Tag.Lookup("env")
+		if !ok || !field.IsExported() {
+			continue
+		}
+		key, opts := parseTag(tag)
+		known[key] = true
+
+		raw, ok := lookupEnv(key)
+		if !ok || raw == "" {
+			raw, ok = file[key]
+		}
+		if !ok || raw == "" {
+			raw, ok = field.Tag.Lookup("default")
+		}
+		if !ok || raw == "" {
+			if opts["required"] {
+				errs = append(errs, &FieldError{Key: key, Err: errNotSet})
+			}
+			continue
+		}
+
+		if err := setValue(v.Field(i), raw, opts["size"]); err != nil {
+			errs = append(errs, &FieldError{Key: key, Err: fmt.Errorf("invalid value %q: %v", raw, err)})
+			continue
+		}
+		if err := validate(v.Field(i), field.Tag.Get("validate"), opts["size"]); err != nil {
+			errs = append(errs, &FieldError{Key: key, Err: err})
+		}
+	}
+
+	// ファイルの書き間違いは黙って無視しない
+	for key := range file {
+		if !known[key] {
+			errs = append(errs, &FieldError{Key: key, Err: fmt.Errorf("unknown key in %s", FileEnv)})
+		}
+	}
+
+	if validator, ok := dst.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			if joined, ok := err.(interface{ Unwrap() []error }); ok {
+				errs = append(errs, joined.Unwrap()...)
+			} else {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &Error{Errs: errs}
+	}
+	return nil
+}
+
+// parseTag splits an env tag into the key and its options.
+func parseTag(tag string) (string, map[string]bool) {
+	key, rest, _ := strings.Cut(tag, ",")
+	opts := map[string]bool{}
+	for _, opt := range strings.Split(rest, ",") {
+		if opt != "" {
+			opts[opt] = true
+		}
+	}
+	return key, opts
+}
+
+// readFile reads the YAML file into the raw values of the keys. Sequences
+// are joined with commas and mappings are written as key=value pairs, as
+// they are written in environment variables.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("yaml.Unmarshal: %v", err)
+	}
+
+	values := make(map[string]string, len(nodes))
+	for key, node := range nodes {
+		switch node.Kind {
+		case yaml.ScalarNode:
+			values[key] = node.Value
+		case yaml.SequenceNode:
+			items := make([]string, len(node.Content))
+			for i, item := range node.Content {
+				items[i] = item.Value
+			}
+			values[key] = strings.Join(items, ",")
+		case yaml.MappingNode:
+			var pairs []string
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				pairs = append(pairs, node.Content[i].Value+"="+node.Content[i+1].Value)
+			}
+			values[key] = strings.Join(pairs, ",")
+		default:
+			return nil, fmt.Errorf("%s: unsupported value", key)
+		}
+	}
+	return values, nil
+}
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+func setValue(v reflect.Value, raw string, size bool) error {
+	if v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(raw))
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		var err error
+		if size {
+			n, err = ParseSize(raw)
+		} else {
+			n, err = strconv.ParseInt(raw, 10, 64)
+		}
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return errors.New("out of range")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(n) {
+			return errors.New("out of range")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.Uint8:
+			v.SetBytes([]byte(raw))
+		case reflect.String:
+			var items []string
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items).Convert(v.Type()))
+		default:
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// validate checks v against the rules of a validate tag: min=N and max=N
+// for numbers and durations, and oneof=a b c for strings.
+func validate(v reflect.Value, rules string, size bool) error {
+	if rules == "" {
+		return nil
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "min", "max":
+			bound := reflect.New(v.Type()).Elem()
+			if err := setValue(bound, arg, size); err != nil {
+				return fmt.Errorf("rule %s: %v", rule, err)
+			}
+			c := compare(v, bound)
+			if name == "min" && c < 0 {
+				return fmt.Errorf("must be at least %s", arg)
+			}
+			if name == "max" && c > 0 {
+				return fmt.Errorf("must be at most %s", arg)
+			}
+		case "oneof":
+			choices := strings.Fields(arg)
+			if !slices.Contains(choices, v.String()) {
+				return fmt.Errorf("must be one of %s", strings.Join(choices, ", "))
+			}
+		default:
+			return fmt.Errorf("unknown rule %s", rule)
+		}
+	}
+	return nil
+}
+
+func compare(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp.Compare(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return cmp.Compare(a.Float(), b.Float())
+	}
+	return 0
+}
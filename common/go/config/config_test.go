@@ -0,0 +1,156 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testConfig struct {
+	ProjectID string                 `env:"PROJECT_ID,required"`
+	TopicID   string                 `env:"TOPIC_ID,required"`
+	MaxAge    time.Duration          `env:"MAX_AGE" default:"24h" validate:"min=1s"`
+	MaxSize   int64                  `env:"MAX_SIZE,size" default:"1MiB" validate:"min=1"`
+	Retries   int                    `env:"RETRIES" validate:"min=0,max=10"`
+	Buckets   []string               `env:"BUCKETS"`
+	Mode      string                 `env:"MODE" default:"append" validate:"oneof=append replace"`
+	DryRun    bool                   `env:"DRY_RUN"`
+	Key       []byte                 `env:"KEY"`
+	Overrides common.PrefixOverrides `env:"OVERRIDES"`
+	Ignored   string
+}
+
+func (c *testConfig) Validate() error {
+	if c.DryRun && c.Mode == "replace" {
+		return &FieldError{Key: "DRY_RUN", Err: errors.New("cannot be used with replace")}
+	}
+	return nil
+}
+
+func lookupMap(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	var c testConfig
+	err := load(&c, lookupMap(map[string]string{
+		"PROJECT_ID": "project",
+		"TOPIC_ID":   "topic",
+		"MAX_SIZE":   "10MB",
+		"RETRIES":    "3",
+		"BUCKETS":    "a, b,,c",
+		"MODE":       "",
+		"DRY_RUN":    "true",
+		"KEY":        "secret",
+		"OVERRIDES":  "tokyo/=cp932",
+	}))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, testConfig{
+			ProjectID: "project",
+			TopicID:   "topic",
+			MaxAge:    24 * time.Hour,
+			MaxSize:   10 * 1000 * 1000,
+			Retries:   3,
+			Buckets:   []string{"a", "b", "c"},
+			Mode:      "append",
+			DryRun:    true,
+			Key:       []byte("secret"),
+			Overrides: common.PrefixOverrides{"tokyo/": "cp932"},
+		}, c)
+	}
+}
+
+func TestLoadListsEveryError(t *testing.T) {
+	var c testConfig
+	err := load(&c, lookupMap(map[string]string{
+		"MAX_AGE":   "0s",
+		"MAX_SIZE":  "1XB",
+		"RETRIES":   "11",
+		"MODE":      "replace",
+		"DRY_RUN":   "true",
+		"OVERRIDES": "tokyo/",
+	}))
+
+	var configErr *Error
+	if assert.ErrorAs(t, err, &configErr) {
+		var keys []string
+		for _, err := range configErr.Errs {
+			var fieldErr *FieldError
+			if assert.ErrorAs(t, err, &fieldErr) {
+				keys = append(keys, fieldErr.Key)
+			}
+		}
+		assert.Equal(t, []string{"PROJECT_ID", "TOPIC_ID", "MAX_AGE", "MAX_SIZE", "RETRIES", "OVERRIDES", "DRY_RUN"}, keys)
+	}
+	assert.ErrorContains(t, err, "PROJECT_ID: not set")
+	assert.ErrorContains(t, err, "RETRIES: must be at most 10")
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+PROJECT_ID: project
+TOPIC_ID: file-topic
+MAX_AGE: 6h
+BUCKETS: [a, b]
+OVERRIDES:
+  tokyo/: cp932
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c testConfig
+	err = load(&c, lookupMap(map[string]string{
+		FileEnv:    path,
+		"TOPIC_ID": "env-topic",
+	}))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "project", c.ProjectID)
+		// 環境変数がファイルより優先される
+		assert.Equal(t, "env-topic", c.TopicID)
+		assert.Equal(t, 6*time.Hour, c.MaxAge)
+		assert.Equal(t, []string{"a", "b"}, c.Buckets)
+		assert.Equal(t, common.PrefixOverrides{"tokyo/": "cp932"}, c.Overrides)
+	}
+
+	err = os.WriteFile(path, []byte("PROJECT_ID: project\nTOPIC: topic\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = load(&c, lookupMap(map[string]string{FileEnv: path, "TOPIC_ID": "topic"}))
+	assert.ErrorContains(t, err, "TOPIC: unknown key in CONFIG_FILE")
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"512":   512,
+		"10MB":  10 * 1000 * 1000,
+		"1GiB":  1 << 30,
+		"2 kib": 2048,
+		"100B":  100,
+		"3TB":   3 * 1000 * 1000 * 1000 * 1000,
+	}
+	for s, want := range tests {
+		got, err := ParseSize(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, want, got, s)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "1.5GB", "10XB", "-1", "9223372036854775807KB"} {
+		_, err := ParseSize(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// EntryFilter selects the archive entries to extract by name and size.
+// Patterns use the syntax of path.Match. A pattern with a slash is matched
+// against the whole entry name and one without against its base name, so
+// that "*.log" matches "dir/a.log".
+type EntryFilter struct {
+	// Include are the patterns of the entries to extract; all entries when
+	// it is empty.
+	Include []string
+	// Exclude are the patterns of the entries to skip, even if included.
+	Exclude []string
+	// MinSize and MaxSize bound the uncompressed size of the entries.
+	// MaxSize 0 means no limit.
+	MinSize int64
+	MaxSize int64
+}
+
+// Validate checks the syntax of the patterns.
+func (f EntryFilter) Validate() error {
+	var errs []error
+	for _, pattern := range slices.Concat(f.Include, f.Exclude) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("pattern %q: %v", pattern, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Skip returns why the entry of name and size is skipped, or "" if it is
+// extracted. size is negative if it is unknown.
+func (f EntryFilter) Skip(name string, size int64) string {
+	if len(f.Include) > 0 && !matchEntryName(f.Include, name) {
+		return "not included"
+	}
+	if matchEntryName(f.Exclude, name) {
+		return "excluded"
+	}
+	if size >= 0 && size < f.MinSize {
+		return "smaller than min size"
+	}
+	if size >= 0 && f.MaxSize > 0 && size > f.MaxSize {
+		return "larger than max size"
+	}
+	return ""
+}
+
+func matchEntryName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SkippedEntries counts the skipped entries of an archive by reason.
+type SkippedEntries map[string]int
+
+// Add counts an entry skipped for reason.
+func (s SkippedEntries) Add(reason string) {
+	s[reason]++
+}
+
+// Total returns the number of the skipped entries.
+func (s SkippedEntries) Total() int {
+	total := 0
+	for _, n := range s {
+		total += n
+	}
+	return total
+}
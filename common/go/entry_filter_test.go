@@ -0,0 +1,51 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntryFilterSkip(t *testing.T) {
+	filter := EntryFilter{
+		Include: []string{"*.log", "logs/*.csv"},
+		Exclude: []string{"debug-*"},
+		MinSize: 1,
+		MaxSize: 100,
+	}
+
+	tests := []struct {
+		name string
+		size int64
+		want string
+	}{
+		{"a.log", 10, ""},
+		{"dir/a.log", 10, ""},
+		{"logs/a.csv", 10, ""},
+		{"dir/logs/a.csv", 10, "not included"},
+		{"README", 10, "not included"},
+		{"dir/debug-a.log", 10, "excluded"},
+		{"a.log", 0, "smaller than min size"},
+		{"a.log", 101, "larger than max size"},
+		{"a.log", -1, ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, filter.Skip(tt.name, tt.size), tt.name)
+	}
+
+	assert.Equal(t, "", EntryFilter{}.Skip("README", 0))
+}
+
+func TestEntryFilterValidate(t *testing.T) {
+	assert.NoError(t, EntryFilter{Include: []string{"*.log"}, Exclude: []string{"[a-z]*"}}.Validate())
+	assert.ErrorContains(t, EntryFilter{Exclude: []string{"[a-"}}.Validate(), `pattern "[a-"`)
+}
+
+func TestSkippedEntries(t *testing.T) {
+	skipped := SkippedEntries{}
+	skipped.Add("excluded")
+	skipped.Add("excluded")
+	skipped.Add("directory")
+	assert.Equal(t, 3, skipped.Total())
+	assert.Equal(t, 2, skipped["excluded"])
+}
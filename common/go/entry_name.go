@@ -0,0 +1,103 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Policies for the archive entry names that would escape the destination
+// prefix: absolute names, names with ".." elements, backslashes or drive
+// letters, and the names such as "." that name no file.
+const (
+	// EntryNamePolicyReject skips the entries with unsafe names.
+	EntryNamePolicyReject = "reject"
+	// EntryNamePolicyFlatten writes the entries with unsafe names under
+	// their base names.
+	EntryNamePolicyFlatten = "flatten"
+	// EntryNamePolicyRewrite writes the entries with unsafe names under
+	// their names without the unsafe elements.
+	EntryNamePolicyRewrite = "rewrite"
+)
+
+// ValidateEntryNamePolicy returns an error if policy is not a known policy.
+func ValidateEntryNamePolicy(policy string) error {
+	switch policy {
+	case EntryNamePolicyReject, EntryNamePolicyFlatten, EntryNamePolicyRewrite:
+		return nil
+	default:
+		return fmt.Errorf("unknown entry name policy %q", policy)
+	}
+}
+
+// EntryNameError is returned by SanitizeEntryName for a rejected entry.
+type EntryNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *EntryNameError) Error() string {
+	return fmt.Sprintf("unsafe entry name %q: %s", e.Name, e.Reason)
+}
+
+// SanitizeEntryName returns the relative slash separated name to write an
+// archive entry under. Safe names are returned as is. Unsafe names are
+// handled by policy, and EntryNamePolicyReject is used when it is empty.
+func SanitizeEntryName(name string, policy string) (string, error) {
+	reason := unsafeEntryName(name)
+	if reason == "" {
+		return name, nil
+	}
+
+	var elements []string
+	for _, element := range strings.Split(strings.ReplaceAll(name, `\`, "/"), "/") {
+		element = strings.ReplaceAll(element, "\x00", "")
+		if element == "" || element == "." || element == ".." || isDriveLetter(element) {
+			continue
+		}
+		elements = append(elements, element)
+	}
+
+	switch policy {
+	case EntryNamePolicyFlatten, EntryNamePolicyRewrite:
+		if len(elements) == 0 {
+			return "", &EntryNameError{Name: name, Reason: reason + ", and nothing is left"}
+		}
+		if policy == EntryNamePolicyFlatten {
+			return elements[len(elements)-1], nil
+		}
+		return path.Join(elements...), nil
+	default:
+		return "", &EntryNameError{Name: name, Reason: reason}
+	}
+}
+
+// unsafeEntryName returns why name is unsafe, or "" if it is safe.
+func unsafeEntryName(name string) string {
+	switch {
+	case name == "":
+		return "empty"
+	case strings.ContainsRune(name, 0):
+		return "NUL character"
+	case strings.Contains(name, `\`):
+		return "backslash"
+	case strings.HasPrefix(name, "/"):
+		return "absolute path"
+	case isDriveLetter(strings.SplitN(name, "/", 2)[0]):
+		return "drive letter"
+	case path.Clean(name) == ".":
+		return "no file name"
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return "parent directory element"
+		}
+	}
+	return ""
+}
+
+// isDriveLetter reports whether element is a Windows drive such as "C:".
+func isDriveLetter(element string) bool {
+	return len(element) == 2 && element[1] == ':' &&
+		('a' <= element[0] && element[0] <= 'z' || 'A' <= element[0] && element[0] <= 'Z')
+}
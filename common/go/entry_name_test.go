@@ -0,0 +1,56 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeEntryName(t *testing.T) {
+	tests := []struct {
+		name    string
+		flatten string
+		rewrite string
+	}{
+		{"dir/a.csv", "dir/a.csv", "dir/a.csv"},
+		{"../../other/x.csv", "x.csv", "other/x.csv"},
+		{"/etc/passwd", "passwd", "etc/passwd"},
+		{`logs\2024\a.csv`, "a.csv", "logs/2024/a.csv"},
+		{`C:\logs\a.csv`, "a.csv", "logs/a.csv"},
+		{"dir/../a\x00.csv", "a.csv", "dir/a.csv"},
+	}
+	for _, tt := range tests {
+		got, err := SanitizeEntryName(tt.name, EntryNamePolicyFlatten)
+		if assert.NoError(t, err, tt.name) {
+			assert.Equal(t, tt.flatten, got, tt.name)
+		}
+		got, err = SanitizeEntryName(tt.name, EntryNamePolicyRewrite)
+		if assert.NoError(t, err, tt.name) {
+			assert.Equal(t, tt.rewrite, got, tt.name)
+		}
+
+		got, err = SanitizeEntryName(tt.name, EntryNamePolicyReject)
+		if tt.name == tt.rewrite {
+			assert.NoError(t, err, tt.name)
+			assert.Equal(t, tt.name, got)
+		} else {
+			var nameErr *EntryNameError
+			assert.ErrorAs(t, err, &nameErr, tt.name)
+		}
+	}
+
+	_, err := SanitizeEntryName("../..", EntryNamePolicyRewrite)
+	assert.ErrorContains(t, err, "nothing is left")
+	_, err = SanitizeEntryName("../a.csv", "")
+	assert.ErrorContains(t, err, "parent directory element")
+	// 展開先そのものを指す名前も書き出さない
+	for _, name := range []string{".", "./", "./."} {
+		_, err = SanitizeEntryName(name, EntryNamePolicyFlatten)
+		assert.ErrorContains(t, err, "no file name", name)
+	}
+}
+
+func TestValidateEntryNamePolicy(t *testing.T) {
+	assert.NoError(t, ValidateEntryNamePolicy(EntryNamePolicyRewrite))
+	assert.Error(t, ValidateEntryNamePolicy("strip"))
+}
@@ -0,0 +1,237 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// DefaultMaxEntries is the default number of entries in an archive.
+	DefaultMaxEntries = 100000
+	// DefaultMaxTotalSize is the default number of bytes extracted from an
+	// archive. It is well above the logs of a day, and can be raised for
+	// larger archives.
+	DefaultMaxTotalSize = 4 << 30
+	// DefaultMaxCompressionRatio is the default ratio of the extracted bytes
+	// to the archive bytes. Log files seldom compress better than 100:1, while
+	// decompression bombs reach millions.
+	DefaultMaxCompressionRatio = 1000
+)
+
+// minRatioCheckSize is the number of extracted bytes under which the
+// compression ratio is not checked; small archives of sparse files have
+// large ratios but do no harm.
+const minRatioCheckSize = 1 << 20
+
+// RejectedMarkerSuffix is appended to the name of a rejected archive to name
+// the marker object that records why it was rejected.
+const RejectedMarkerSuffix = ".rejected.json"
+
+// ErrLimitExceeded is wrapped by the errors of ExtractBudget.
+var ErrLimitExceeded = errors.New("extraction limit exceeded")
+
+// ExtractLimits caps what is extracted from an archive. A zero field means
+// no limit.
+type ExtractLimits struct {
+	MaxEntries          int
+	MaxTotalSize        int64
+	MaxCompressionRatio float64
+}
+
+// LimitError is returned when an archive exceeds one of ExtractLimits.
+type LimitError struct {
+	Limit string
+	Value any
+	Max   any
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s %v exceeds %v", e.Limit, e.Value, e.Max)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// ExtractBudget checks ExtractLimits while the entries are streamed, so that
+// a decompression bomb is stopped before it is fully extracted.
+type ExtractBudget struct {
+	limits ExtractLimits
+	// compressed returns the number of archive bytes read so far.
+	compressed func() int64
+
+	entries int
+	total   int64
+	err     error
+}
+
+// NewExtractBudget returns an ExtractBudget. compressed returns the number of
+// archive bytes read so far, or the archive size if it is read at random.
+func NewExtractBudget(limits ExtractLimits, compressed func() int64) *ExtractBudget {
+	return &ExtractBudget{limits: limits, compressed: compressed}
+}
+
+// CheckEntries fails if n more entries would be too many. It rejects an
+// archive whose directory lists too many entries before any is extracted.
+func (b *ExtractBudget) CheckEntries(n int) error {
+	if b.limits.MaxEntries > 0 && b.entries+n > b.limits.MaxEntries {
+		b.err = &LimitError{Limit: "number of entries", Value: b.entries + n, Max: b.limits.MaxEntries}
+	}
+	return b.err
+}
+
+// AddEntry counts an entry, and fails if there are too many. Every entry is
+// counted, including those that are skipped.
+func (b *ExtractBudget) AddEntry() error {
+	b.entries++
+	if b.limits.MaxEntries > 0 && b.entries > b.limits.MaxEntries {
+		b.err = &LimitError{Limit: "number of entries", Value: b.entries, Max: b.limits.MaxEntries}
+	}
+	return b.err
+}
+
+// Exceeded returns the LimitError of the exceeded limit, or nil. It helps
+// when the error of Reader is reformatted by the readers that wrap it.
+func (b *ExtractBudget) Exceeded() error {
+	return b.err
+}
+
+// Reader returns a reader of the entry r that fails once the total size or
+// the compression ratio is exceeded.
+func (b *ExtractBudget) Reader(r io.Reader) io.Reader {
+	return &budgetReader{r: r, budget: b, compressedSize: -1}
+}
+
+// EntryReader is Reader for an entry whose compressed size is known, as in
+// a zip. It also fails once the entry alone exceeds the compression ratio,
+// so that a bomb is not hidden among entries that keep the ratio of the
+// whole archive low.
+func (b *ExtractBudget) EntryReader(r io.Reader, compressedSize int64) io.Reader {
+	return &budgetReader{r: r, budget: b, compressedSize: compressedSize}
+}
+
+// CheckEntryRatio fails if extracted bytes of an entry of compressedSize
+// bytes exceed the compression ratio.
+func (b *ExtractBudget) CheckEntryRatio(extracted int64, compressedSize int64) error {
+	if b.limits.MaxCompressionRatio > 0 && extracted > minRatioCheckSize {
+		if ratio := float64(extracted) / float64(max(compressedSize, 1)); ratio > b.limits.MaxCompressionRatio {
+			b.err = &LimitError{Limit: "compression ratio of an entry", Value: fmt.Sprintf("%.0f", ratio), Max: b.limits.MaxCompressionRatio}
+		}
+	}
+	return b.err
+}
+
+func (b *ExtractBudget) add(n int) error {
+	b.total += int64(n)
+	if b.limits.MaxTotalSize > 0 && b.total > b.limits.MaxTotalSize {
+		b.err = &LimitError{Limit: "extracted size", Value: b.total, Max: b.limits.MaxTotalSize}
+	}
+	if b.limits.MaxCompressionRatio > 0 && b.total > minRatioCheckSize {
+		compressed := max(b.compressed(), 1)
+		if ratio := float64(b.total) / float64(compressed); ratio > b.limits.MaxCompressionRatio {
+			b.err = &LimitError{Limit: "compression ratio", Value: fmt.Sprintf("%.0f", ratio), Max: b.limits.MaxCompressionRatio}
+		}
+	}
+	return b.err
+}
+
+type budgetReader struct {
+	r      io.Reader
+	budget *ExtractBudget
+	// compressedSize is the compressed size of the entry, or negative if it
+	// is unknown, and extracted is the number of bytes read from it.
+	compressedSize int64
+	extracted      int64
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.extracted += int64(n)
+	if limitErr := r.budget.add(n); limitErr != nil {
+		return n, limitErr
+	}
+	if r.compressedSize >= 0 {
+		if limitErr := r.budget.CheckEntryRatio(r.extracted, r.compressedSize); limitErr != nil {
+			return n, limitErr
+		}
+	}
+	return n, err
+}
+
+// CountingReader counts the bytes read from R.
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.R.Read(p)
+	r.N += int64(n)
+	return n, err
+}
+
+// RejectedArchive is the content of the marker of a rejected archive.
+type RejectedArchive struct {
+	Bucket     string    `json:"bucket"`
+	FilePath   string    `json:"filePath"`
+	Reason     string    `json:"reason"`
+	RejectedAt time.Time `json:"rejectedAt"`
+	TraceID    string    `json:"traceId,omitempty"`
+}
+
+// RejectArchive deletes the objects written from the archive at srcPath and
+// writes the marker srcPath + RejectedMarkerSuffix into destBucketName. It
+// returns nil once the archive is rejected, so that the stages return it
+// from the event and the archive is not retried, and the logged error
+// otherwise.
+func RejectArchive(ctx context.Context, client StorageClient, srcBucketName string, srcPath string, destBucketName string, written []string, reason error) error {
+	if err := rejectArchive(ctx, client, srcBucketName, srcPath, destBucketName, written, reason); err != nil {
+		Logger(ctx).Error("Failed to reject archive", "error", err)
+		return fmt.Errorf("RejectArchive: %v", err)
+	}
+	return nil
+}
+
+func rejectArchive(ctx context.Context, client StorageClient, srcBucketName string, srcPath string, destBucketName string, written []string, reason error) error {
+	logger := Logger(ctx)
+	destBucket := client.Bucket(destBucketName)
+
+	var errs []error
+	for _, name := range written {
+		if err := destBucket.Object(name).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			errs = append(errs, fmt.Errorf("Delete %s: %v", name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	marker, err := json.Marshal(RejectedArchive{
+		Bucket:     srcBucketName,
+		FilePath:   srcPath,
+		Reason:     reason.Error(),
+		RejectedAt: time.Now().UTC(),
+		TraceID:    TraceID(ctx),
+	})
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %v", err)
+	}
+	markerName := srcPath + RejectedMarkerSuffix
+	w := destBucket.Object(markerName).NewWriter(ctx)
+	if _, err := w.Write(marker); err != nil {
+		w.Close()
+		return fmt.Errorf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Close: %v", err)
+	}
+
+	logger.Warn("Rejected archive", "reason", reason, "deleted", len(written), "marker", markerName)
+	return nil
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractBudget(t *testing.T) {
+	budget := NewExtractBudget(ExtractLimits{MaxEntries: 2, MaxTotalSize: 10}, func() int64 { return 1 })
+
+	assert.NoError(t, budget.AddEntry())
+	n, err := io.Copy(io.Discard, budget.Reader(bytes.NewReader([]byte("12345"))))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	assert.NoError(t, budget.AddEntry())
+	_, err = io.Copy(io.Discard, budget.Reader(bytes.NewReader([]byte("123456"))))
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.EqualError(t, err, "extracted size 11 exceeds 10")
+	assert.Equal(t, err, budget.Exceeded())
+
+	budget = NewExtractBudget(ExtractLimits{MaxEntries: 1}, nil)
+	assert.NoError(t, budget.AddEntry())
+	assert.EqualError(t, budget.AddEntry(), "number of entries 2 exceeds 1")
+
+	budget = NewExtractBudget(ExtractLimits{MaxEntries: 3}, nil)
+	assert.NoError(t, budget.AddEntry())
+	assert.NoError(t, budget.CheckEntries(2))
+	assert.EqualError(t, budget.CheckEntries(3), "number of entries 4 exceeds 3")
+}
+
+func TestExtractBudgetCompressionRatio(t *testing.T) {
+	compressed := &CountingReader{R: bytes.NewReader(make([]byte, 1000))}
+	budget := NewExtractBudget(ExtractLimits{MaxCompressionRatio: 1000}, func() int64 { return compressed.N })
+	io.Copy(io.Discard, compressed)
+
+	// 小さいうちは圧縮率を問わない
+	_, err := io.Copy(io.Discard, budget.Reader(bytes.NewReader(make([]byte, 1<<20))))
+	assert.NoError(t, err)
+
+	_, err = io.Copy(io.Discard, budget.Reader(bytes.NewReader(make([]byte, 1<<20))))
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.ErrorContains(t, err, "compression ratio")
+}
+
+func TestExtractBudgetEntryCompressionRatio(t *testing.T) {
+	// アーカイブ全体の圧縮率が低くても、エントリごとの圧縮率で止める
+	budget := NewExtractBudget(ExtractLimits{MaxCompressionRatio: 1000}, func() int64 { return 1 << 30 })
+
+	_, err := io.Copy(io.Discard, budget.EntryReader(bytes.NewReader(make([]byte, 2<<20)), 1<<20))
+	assert.NoError(t, err)
+
+	_, err = io.Copy(io.Discard, budget.EntryReader(bytes.NewReader(make([]byte, 2<<20)), 1000))
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.ErrorContains(t, err, "compression ratio of an entry")
+}
+
+func TestRejectArchive(t *testing.T) {
+	ctx := context.Background()
+	client := &FileStorageClient{Root: t.TempDir()}
+	for _, name := range []string{"a.zip/b.log", "a.zip/c.log"} {
+		w := client.Bucket("dest").Object(name).NewWriter(ctx)
+		w.Write([]byte("x\n"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reason := &LimitError{Limit: "number of entries", Value: 3, Max: 2}
+	err := RejectArchive(ctx, client, "src", "a.zip", "dest", []string{"a.zip/b.log", "a.zip/c.log", "a.zip/d.log"}, reason)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = client.Bucket("dest").Object("a.zip/b.log").Attrs(ctx)
+	assert.Error(t, err)
+	r, err := client.Bucket("dest").Object("a.zip" + RejectedMarkerSuffix).NewReader(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	var marker RejectedArchive
+	assert.NoError(t, json.NewDecoder(r).Decode(&marker))
+	assert.Equal(t, "src", marker.Bucket)
+	assert.Equal(t, "a.zip", marker.FilePath)
+	assert.Equal(t, "number of entries 3 exceeds 2", marker.Reason)
+}
@@ -0,0 +1,292 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Map the abstract interfaces to the local filesystem. A directory under
+// Root stands in for a bucket, and the object names are slash separated
+// paths in the directory. It is meant for local runs and tests.
+
+type FileStorageClient struct {
+	Root string
+}
+
+func (c *FileStorageClient) Bucket(name string) BucketHandle {
+	return &FileBucketHandle{name: name, dir: filepath.Join(c.Root, name)}
+}
+
+type FileBucketHandle struct {
+	name string
+	dir  string
+}
+
+func (b *FileBucketHandle) Object(name string) ObjectHandle {
+	return &FileObjectHandle{bucket: b.name, dir: b.dir, name: name}
+}
+
+// Objects lists the regular files whose names begin with prefix, in name order.
+func (b *FileBucketHandle) Objects(ctx context.Context, prefix string) ObjectIterator {
+	it := &FileObjectIterator{}
+	err := filepath.WalkDir(b.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		// 書き込み中の一時ファイルは含めない
+		if !strings.HasPrefix(name, prefix) || strings.HasPrefix(d.Name(), tempFilePrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		it.objects = append(it.objects, fileObjectAttrs(b.name, name, info))
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		it.err = fmt.Errorf("WalkDir: %v", err)
+	}
+	sort.Slice(it.objects, func(i, j int) bool { return it.objects[i].Name < it.objects[j].Name })
+	return it
+}
+
+type FileObjectIterator struct {
+	objects []*storage.ObjectAttrs
+	err     error
+}
+
+func (it *FileObjectIterator) Next() (*storage.ObjectAttrs, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.objects) == 0 {
+		return nil, iterator.Done
+	}
+	attrs := it.objects[0]
+	it.objects = it.objects[1:]
+	return attrs, nil
+}
+
+type FileObjectHandle struct {
+	bucket string
+	dir    string
+	name   string
+	// generation is the generation the reads are pinned to, 0 for the live
+	// object.
+	generation int64
+}
+
+// Generation returns the handle of the generation gen of the object. Its
+// reads return storage.ErrObjectNotExist once the file is rewritten.
+func (o *FileObjectHandle) Generation(gen int64) ObjectHandle {
+	pinned := *o
+	pinned.generation = gen
+	return &pinned
+}
+
+func (o *FileObjectHandle) path() (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(o.name)) {
+		return "", fmt.Errorf("object name %q is outside the bucket", o.name)
+	}
+	return filepath.Join(o.dir, filepath.FromSlash(o.name)), nil
+}
+
+// open opens the file of the object, checking the generation if pinned.
+func (o *FileObjectHandle) open() (*os.File, error) {
+	p, err := o.path()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil || o.generation == 0 {
+		return f, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if generation := fileObjectAttrs(o.bucket, o.name, info).Generation; generation != o.generation {
+		f.Close()
+		return nil, storage.ErrObjectNotExist
+	}
+	return f, nil
+}
+
+func (o *FileObjectHandle) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return o.open()
+}
+
+func (o *FileObjectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	f, err := o.open()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (o *FileObjectHandle) Attrs(ctx context.Context) (*storage.ObjectAttrs, error) {
+	f, err := o.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	attrs := fileObjectAttrs(o.bucket, o.name, info)
+	attrs.CRC32C = hash.Sum32()
+	return attrs, nil
+}
+
+func (o *FileObjectHandle) Delete(ctx context.Context) error {
+	p, err := o.path()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return storage.ErrObjectNotExist
+	}
+	return err
+}
+
+// NewWriter returns a writer that makes the object visible only when it is
+// closed without an error before ctx is done, as Cloud Storage does.
+func (o *FileObjectHandle) NewWriter(ctx context.Context) io.WriteCloser {
+	return &FileObjectWriter{ctx: ctx, object: o}
+}
+
+const tempFilePrefix = ".tmp-"
+
+// FileObjectWriter writes an object of FileStorageClient. It implements
+// ObjectAttrsWriter so that WrittenGeneration works with it, and
+// CRC32CWriter to reject the content that does not match, as Cloud Storage
+// does.
+type FileObjectWriter struct {
+	ctx    context.Context
+	object *FileObjectHandle
+	file   *os.File
+	hash   hash.Hash32
+	attrs  *storage.ObjectAttrs
+	err    error
+
+	crc32c     uint32
+	sendCRC32C bool
+}
+
+// SetCRC32C makes Close fail if the content does not have the crc.
+func (w *FileObjectWriter) SetCRC32C(crc uint32) {
+	w.crc32c = crc
+	w.sendCRC32C = true
+}
+
+func (w *FileObjectWriter) open() error {
+	if w.file != nil || w.err != nil {
+		return w.err
+	}
+	p, err := w.object.path()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+	}
+	if err == nil {
+		w.file, err = os.CreateTemp(filepath.Dir(p), tempFilePrefix+"*")
+		w.hash = crc32.New(crc32cTable)
+	}
+	w.err = err
+	return err
+}
+
+func (w *FileObjectWriter) Write(p []byte) (int, error) {
+	if err := w.open(); err != nil {
+		return 0, err
+	}
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *FileObjectWriter) Close() error {
+	if err := w.open(); err != nil {
+		return err
+	}
+	tmp := w.file.Name()
+	if err := w.file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.ctx.Err(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if w.sendCRC32C && w.hash.Sum32() != w.crc32c {
+		os.Remove(tmp)
+		return fmt.Errorf("CRC32C %s of the content does not match %s", EncodeCRC32C(w.hash.Sum32()), EncodeCRC32C(w.crc32c))
+	}
+	p, _ := w.object.path()
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	w.attrs = fileObjectAttrs(w.object.bucket, w.object.name, info)
+	w.attrs.CRC32C = w.hash.Sum32()
+	return nil
+}
+
+// Attrs returns the attributes of the written object, or nil until the
+// writer is closed.
+func (w *FileObjectWriter) Attrs() *storage.ObjectAttrs {
+	return w.attrs
+}
+
+// fileObjectAttrs uses the modification time as the generation, which
+// changes when the file is rewritten like the generation of an object.
+func fileObjectAttrs(bucket string, name string, info fs.FileInfo) *storage.ObjectAttrs {
+	return &storage.ObjectAttrs{
+		Bucket:     bucket,
+		Name:       name,
+		Size:       info.Size(),
+		Generation: info.ModTime().UnixMicro(),
+		Updated:    info.ModTime(),
+	}
+}
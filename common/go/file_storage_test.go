@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iterator"
+)
+
+func TestFileStorageClient(t *testing.T) {
+	ctx := context.Background()
+	client := &FileStorageClient{Root: t.TempDir()}
+	bucket := client.Bucket("csv")
+
+	w := bucket.Object("a.zip/b.tgz/c.csv").NewWriter(ctx)
+	_, err := io.WriteString(w, "line\n")
+	assert.NoError(t, err)
+	// 閉じるまでは見えない
+	_, err = bucket.Objects(ctx, "").Next()
+	assert.Equal(t, iterator.Done, err)
+	assert.NoError(t, w.Close())
+	assert.NotZero(t, WrittenGeneration(w))
+
+	w = bucket.Object("a.zip/a.csv").NewWriter(ctx)
+	assert.NoError(t, w.Close())
+
+	r, err := bucket.Object("a.zip/b.tgz/c.csv").NewReader(ctx)
+	if assert.NoError(t, err) {
+		data, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "line\n", string(data))
+		r.Close()
+	}
+
+	var names []string
+	it := bucket.Objects(ctx, "a.zip/")
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+		assert.Equal(t, "csv", attrs.Bucket)
+		names = append(names, attrs.Name)
+	}
+	assert.Equal(t, []string{"a.zip/a.csv", "a.zip/b.tgz/c.csv"}, names)
+
+	_, err = client.Bucket("none").Objects(ctx, "").Next()
+	assert.Equal(t, iterator.Done, err)
+}
+
+func TestFileStorageClientOutsideBucket(t *testing.T) {
+	ctx := context.Background()
+	client := &FileStorageClient{Root: t.TempDir()}
+
+	_, err := client.Bucket("csv").Object("../escape").NewReader(ctx)
+	assert.ErrorContains(t, err, "outside the bucket")
+
+	w := client.Bucket("csv").Object("../escape").NewWriter(ctx)
+	assert.ErrorContains(t, w.Close(), "outside the bucket")
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Cloud Logging が構造化ログとして解釈するフィールド名
+// (See https://cloud.google.com/logging/docs/structured-logging#special-payload-fields)
+const (
+	severityKey = "severity"
+	messageKey  = "message"
+	traceKey    = "logging.googleapis.com/trace"
+)
+
+// Attribute keys of the values that identify the processed event.
+const (
+	LogKeyEventID      = "eventId"
+	LogKeySourceObject = "sourceObject"
+)
+
+// NewLogHandler returns a slog.Handler that writes Cloud Logging-compatible
+// JSON lines to w. The trace IDs of the records are written as the trace
+// resource name of projectID, so that Cloud Logging correlates the entries
+// of the stages.
+func NewLogHandler(w io.Writer, projectID string) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				return slog.String(severityKey, severity(a.Value.Any().(slog.Level)))
+			case slog.MessageKey:
+				a.Key = messageKey
+			case traceKey:
+				if projectID != "" {
+					return slog.String(traceKey, "projects/"+projectID+"/traces/"+a.Value.String())
+				}
+			}
+			return a
+		},
+	})
+}
+
+// severity maps the slog levels to the Cloud Logging severities.
+func severity(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// NewTraceID returns a new random trace ID, 32 hex digits as Cloud Trace
+// expects.
+func NewTraceID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+type loggerKey struct{}
+
+type traceIDKey struct{}
+
+// Logger returns the logger of ctx, or slog.Default if none is set.
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// WithLogger returns a copy of ctx that carries logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// TraceID returns the trace ID carried by ctx, or "" if none is set.
+func TraceID(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+// InitLogging makes the JSON logger of projectID to stdout the default
+// logger. The standard log package writes through it as well.
+func InitLogging(projectID string) {
+	slog.SetDefault(slog.New(NewLogHandler(os.Stdout, projectID)))
+}
+
+// StartEvent returns a copy of ctx for handling a CloudEvent. The context
+// carries traceID, or a new one when it is empty, and a logger that adds the
+// event ID, the source object when given and the trace ID to each record.
+func StartEvent(ctx context.Context, eventID, sourceObject, traceID string) context.Context {
+	if traceID == "" {
+		traceID = NewTraceID()
+	}
+	logger := Logger(ctx).With(LogKeyEventID, eventID, traceKey, traceID)
+	if sourceObject != "" {
+		logger = logger.With(LogKeySourceObject, sourceObject)
+	}
+	ctx = context.WithValue(ctx, traceIDKey{}, traceID)
+	return WithLogger(ctx, logger)
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := WithLogger(context.Background(), slog.New(NewLogHandler(&buf, "project")))
+
+	ctx = StartEvent(ctx, "event-1", "gs://bucket/a.zip", "0123456789abcdef0123456789abcdef")
+	Logger(ctx).Warn("Failed to read", "error", errors.New("broken"))
+
+	var entry map[string]any
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry)) {
+		assert.Equal(t, "WARNING", entry["severity"])
+		assert.Equal(t, "Failed to read", entry["message"])
+		assert.Equal(t, "broken", entry["error"])
+		assert.Equal(t, "event-1", entry["eventId"])
+		assert.Equal(t, "gs://bucket/a.zip", entry["sourceObject"])
+		assert.Equal(t, "projects/project/traces/0123456789abcdef0123456789abcdef", entry["logging.googleapis.com/trace"])
+		assert.NotContains(t, entry, "level")
+		assert.NotContains(t, entry, "msg")
+	}
+	assert.Equal(t, "0123456789abcdef0123456789abcdef", TraceID(ctx))
+}
+
+func TestStartEventNewTraceID(t *testing.T) {
+	ctx := StartEvent(context.Background(), "event-1", "gs://bucket/a.zip", "")
+
+	assert.Regexp(t, "^[0-9a-f]{32}$", TraceID(ctx))
+	assert.Equal(t, "", TraceID(context.Background()))
+}
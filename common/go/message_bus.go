@@ -0,0 +1,51 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MessageBus delivers PubSubMessageData in process, in place of Pub/Sub, for
+// local runs. Publish calls the handlers subscribed to the topic before it
+// returns, so an error of a handler is returned to the publisher.
+type MessageBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]func(context.Context, PubSubMessageData) error
+}
+
+func NewMessageBus() *MessageBus {
+	return &MessageBus{handlers: map[string][]func(context.Context, PubSubMessageData) error{}}
+}
+
+// Subscribe adds a handler of the messages published to the topic.
+func (b *MessageBus) Subscribe(topicID string, handler func(context.Context, PubSubMessageData) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[topicID] = append(b.handlers[topicID], handler)
+}
+
+// Publish delivers the message to every handler of the topic. A message to a
+// topic without handlers is dropped, as Pub/Sub does without subscriptions.
+func (b *MessageBus) Publish(ctx context.Context, topicID string, data PubSubMessageData) error {
+	b.mu.RLock()
+	handlers := b.handlers[topicID]
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, handler := range handlers {
+		if err := handler(ctx, data); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", topicID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sender returns a message sender for the topic, in place of
+// PubSubMessageSenderFactory.
+func (b *MessageBus) Sender(ctx context.Context, topicID string) func(PubSubMessageData) error {
+	return func(msgData PubSubMessageData) error {
+		return b.Publish(ctx, topicID, msgData)
+	}
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageBus(t *testing.T) {
+	ctx := context.Background()
+	bus := NewMessageBus()
+
+	var received []PubSubMessageData
+	bus.Subscribe("csv", func(ctx context.Context, data PubSubMessageData) error {
+		received = append(received, data)
+		return nil
+	})
+	bus.Subscribe("csv", func(ctx context.Context, data PubSubMessageData) error {
+		return errors.New("failed")
+	})
+
+	err := bus.Sender(ctx, "csv")(PubSubMessageData{Bucket: "b", FilePath: "f"})
+
+	assert.ErrorContains(t, err, "csv: failed")
+	assert.Equal(t, []PubSubMessageData{{Bucket: "b", FilePath: "f"}}, received)
+
+	// 購読者のいないトピックへのメッセージは捨てられる
+	assert.NoError(t, bus.Publish(ctx, "none", PubSubMessageData{}))
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultReadAheadSize is the size of the ranges ObjectReaderAt requests.
+	DefaultReadAheadSize = 1 << 20
+	// DefaultCachedRanges is the number of ranges ObjectReaderAt keeps.
+	DefaultCachedRanges = 4
+)
+
+// ObjectReaderAt reads an object with range requests, so that the object
+// need not fit in memory, e.g. for archive/zip. Each request reads ahead a
+// whole aligned range, and the most recently used ranges are kept; at most
+// rangeSize * cachedRanges bytes are held at a time.
+type ObjectReaderAt struct {
+	ctx          context.Context
+	object       ObjectHandle
+	size         int64
+	rangeSize    int64
+	cachedRanges int
+
+	mu sync.Mutex
+	// 最近使った順
+	ranges []*cachedRange
+}
+
+type cachedRange struct {
+	offset int64
+	data   []byte
+}
+
+// NewObjectReaderAt returns an ObjectReaderAt of the object of size bytes.
+// The range requests are made to the generation, if it is not 0, so that
+// the bytes of two generations are not mixed when the object is replaced
+// while it is read. DefaultReadAheadSize and DefaultCachedRanges are used
+// when rangeSize and cachedRanges are 0.
+func NewObjectReaderAt(ctx context.Context, object ObjectHandle, size int64, generation int64, rangeSize int64, cachedRanges int) *ObjectReaderAt {
+	if rangeSize <= 0 {
+		rangeSize = DefaultReadAheadSize
+	}
+	if cachedRanges <= 0 {
+		cachedRanges = DefaultCachedRanges
+	}
+	return &ObjectReaderAt{
+		ctx:          ctx,
+		object:       ObjectGeneration(object, generation),
+		size:         size,
+		rangeSize:    rangeSize,
+		cachedRanges: cachedRanges,
+	}
+}
+
+// Size returns the size of the object.
+func (r *ObjectReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *ObjectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("ObjectReaderAt.ReadAt: negative offset")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(p) && off+int64(n) < r.size {
+		pos := off + int64(n)
+		cached, err := r.rangeAt(pos - pos%r.rangeSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], cached.data[pos-cached.offset:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// rangeAt returns the range that begins at offset, from the cache or from
+// a new range request.
+func (r *ObjectReaderAt) rangeAt(offset int64) (*cachedRange, error) {
+	for i, cached := range r.ranges {
+		if cached.offset == offset {
+			copy(r.ranges[1:i+1], r.ranges[:i])
+			r.ranges[0] = cached
+			return cached, nil
+		}
+	}
+
+	length := min(r.rangeSize, r.size-offset)
+	rc, err := r.object.NewRangeReader(r.ctx, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("NewRangeReader: %v", err)
+	}
+	defer rc.Close()
+
+	cached := &cachedRange{offset: offset}
+	// 追い出す範囲のバッファを再利用する
+	if len(r.ranges) == r.cachedRanges {
+		cached.data = r.ranges[len(r.ranges)-1].data[:0]
+		r.ranges = r.ranges[:len(r.ranges)-1]
+	}
+	if int64(cap(cached.data)) < length {
+		cached.data = make([]byte, length)
+	}
+	cached.data = cached.data[:length]
+	if _, err := io.ReadFull(rc, cached.data); err != nil {
+		return nil, fmt.Errorf("reading range %d-%d: %v", offset, offset+length, err)
+	}
+
+	r.ranges = append([]*cachedRange{cached}, r.ranges...)
+	return cached, nil
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingObjectHandle counts the range requests to the object.
+type countingObjectHandle struct {
+	ObjectHandle
+	requests int
+}
+
+func (o *countingObjectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	o.requests++
+	return o.ObjectHandle.NewRangeReader(ctx, offset, length)
+}
+
+func putTestObject(t *testing.T, data []byte) ObjectHandle {
+	client := &FileStorageClient{Root: t.TempDir()}
+	object := client.Bucket("bucket").Object("object")
+	w := object.NewWriter(context.Background())
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
+
+func TestObjectReaderAt(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	object := &countingObjectHandle{ObjectHandle: putTestObject(t, data)}
+
+	r := NewObjectReaderAt(ctx, object, int64(len(data)), 0, 100, 2)
+
+	p := make([]byte, 150)
+	n, err := r.ReadAt(p, 50)
+	assert.NoError(t, err)
+	assert.Equal(t, 150, n)
+	assert.Equal(t, data[50:200], p)
+	assert.Equal(t, 2, object.requests)
+
+	// キャッシュされた範囲は読み直さない
+	n, err = r.ReadAt(p[:10], 120)
+	assert.NoError(t, err)
+	assert.Equal(t, data[120:130], p[:10])
+	assert.Equal(t, 2, object.requests)
+
+	// 末尾を越える読み込みは io.EOF を返す
+	n, err = r.ReadAt(p, 900)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, data[900:], p[:n])
+	assert.Equal(t, 3, object.requests)
+
+	// 追い出された範囲は読み直す
+	_, err = r.ReadAt(p[:10], 50)
+	assert.NoError(t, err)
+	assert.Equal(t, data[50:60], p[:10])
+	assert.Equal(t, 4, object.requests)
+
+	_, err = r.ReadAt(p, 1000)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestObjectReaderAtZip(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	content := bytes.Repeat([]byte("line\n"), 10000)
+	for _, name := range []string{"a.log", "b.log"} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	object := &countingObjectHandle{ObjectHandle: putTestObject(t, buf.Bytes())}
+
+	r := NewObjectReaderAt(ctx, object, int64(buf.Len()), 0, 4096, 2)
+	zr, err := zip.NewReader(r, r.Size())
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if !assert.NoError(t, err) {
+			return
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, content, data)
+	}
+	// 各範囲をおおむね一度ずつ読む
+	assert.Less(t, object.requests, buf.Len()/4096+5)
+}
+
+func TestObjectReaderAtGeneration(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	object := putTestObject(t, data)
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewObjectReaderAt(ctx, object, attrs.Size, attrs.Generation, 100, 2)
+	p := make([]byte, 100)
+	_, err = r.ReadAt(p, 0)
+	assert.NoError(t, err)
+
+	// 読んでいる途中で置き換えられたオブジェクトは読まない
+	w := object.NewWriter(ctx)
+	w.Write(bytes.Repeat([]byte{'x'}, len(data)))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := object.(*FileObjectHandle).path()
+	modTime := time.UnixMicro(attrs.Generation + 1)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.ReadAt(p, 500)
+	assert.ErrorContains(t, err, storage.ErrObjectNotExist.Error())
+}
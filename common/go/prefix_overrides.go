@@ -0,0 +1,57 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PrefixOverrides maps object name prefixes to values that override a
+// default for the objects under them. It is written as
+// "prefix=value,prefix=value" in environment variables.
+type PrefixOverrides map[string]string
+
+func ParsePrefixOverrides(s string) (PrefixOverrides, error) {
+	overrides := PrefixOverrides{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, value, ok := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		value = strings.TrimSpace(value)
+		if !ok || prefix == "" || value == "" {
+			return nil, fmt.Errorf("invalid override %q, want prefix=value", entry)
+		}
+		if _, ok := overrides[prefix]; ok {
+			return nil, fmt.Errorf("duplicated override for prefix %q", prefix)
+		}
+		overrides[prefix] = value
+	}
+	return overrides, nil
+}
+
+// Lookup returns the value of the longest prefix of name, or fallback if no
+// prefix matches.
+func (o PrefixOverrides) Lookup(name string, fallback string) string {
+	value := fallback
+	matched := -1
+	for prefix, v := range o {
+		if strings.HasPrefix(name, prefix) && len(prefix) > matched {
+			value = v
+			matched = len(prefix)
+		}
+	}
+	return value
+}
+
+// UnmarshalText parses the overrides as ParsePrefixOverrides does, so that
+// they can be loaded by the config package.
+func (o *PrefixOverrides) UnmarshalText(text []byte) error {
+	overrides, err := ParsePrefixOverrides(string(text))
+	if err != nil {
+		return err
+	}
+	*o = overrides
+	return nil
+}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePrefixOverrides(t *testing.T) {
+	overrides, err := ParsePrefixOverrides(" utc/ = UTC ,utc/tokyo/=Asia/Tokyo,")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, PrefixOverrides{"utc/": "UTC", "utc/tokyo/": "Asia/Tokyo"}, overrides)
+	assert.Equal(t, "UTC", overrides.Lookup("utc/a.csv", "Asia/Tokyo"))
+	assert.Equal(t, "Asia/Tokyo", overrides.Lookup("utc/tokyo/a.csv", "UTC"))
+	assert.Equal(t, "Asia/Tokyo", overrides.Lookup("other/a.csv", "Asia/Tokyo"))
+
+	empty, err := ParsePrefixOverrides("")
+	assert.NoError(t, err)
+	assert.Equal(t, "default", empty.Lookup("a.csv", "default"))
+}
+
+func TestParsePrefixOverridesInvalid(t *testing.T) {
+	for _, s := range []string{"utc/", "=UTC", "utc/=", "a=1,a=2"} {
+		_, err := ParsePrefixOverrides(s)
+		assert.Error(t, err, s)
+	}
+}
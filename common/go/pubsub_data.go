@@ -3,4 +3,11 @@ package common
 type PubSubMessageData struct {
 	Bucket   string `json:"bucket"`
 	FilePath string `json:"filePath"`
+	// Generation is the generation of the object at FilePath, if known.
+	Generation int64 `json:"generation,omitempty"`
+	// CRC32C is the checksum of the object at FilePath as written, encoded
+	// as by EncodeCRC32C, if known.
+	CRC32C string `json:"crc32c,omitempty"`
+	// TraceID correlates the logs of the stages that handle the same upload.
+	TraceID string `json:"traceId,omitempty"`
 }
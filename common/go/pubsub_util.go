@@ -29,7 +29,7 @@ func SendPubSubMessage(ctx context.Context, projectId, topicId string, data PubS
 	if err != nil {
 		return fmt.Errorf("get publish result: %v", err)
 	}
-	fmt.Printf("Published message with ID: %s\n", id)
+	Logger(ctx).Info("Published message", "messageId", id)
 
 	return nil
 }
@@ -0,0 +1,125 @@
+package schemata
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultStagingVersion is the layout used when nothing else is known about a file.
+const DefaultStagingVersion = "v1"
+
+// StagingLayouts returns the layouts of every known log format version,
+// sorted by version.
+func StagingLayouts() ([]*StagingLayout, error) {
+	entries, err := stagingFS.ReadDir("staging")
+	if err != nil {
+		return nil, fmt.Errorf("ReadDir: %v", err)
+	}
+
+	var layouts []*StagingLayout
+	versions := map[string]bool{}
+	for _, entry := range entries {
+		data, err := stagingFS.ReadFile(path.Join("staging", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("ReadFile: %v", err)
+		}
+		layout, err := ParseStagingLayout(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if versions[layout.Version] {
+			return nil, fmt.Errorf("%s: version %s is duplicated", entry.Name(), layout.Version)
+		}
+		versions[layout.Version] = true
+		layouts = append(layouts, layout)
+	}
+
+	sort.Slice(layouts, func(i, j int) bool {
+		return layouts[i].Version < layouts[j].Version
+	})
+	return layouts, nil
+}
+
+// StagingVersion returns the layout of the given log format version.
+func StagingVersion(version string) (*StagingLayout, error) {
+	layouts, err := StagingLayouts()
+	if err != nil {
+		return nil, err
+	}
+	for _, layout := range layouts {
+		if layout.Version == version {
+			return layout, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown log format version %q", version)
+}
+
+// DetectedLayout is the layout of a log file found by DetectStagingLayout.
+type DetectedLayout struct {
+	*StagingLayout
+	// HasHeader is true when the first line of the file names the columns
+	// and must be skipped when loading.
+	HasHeader bool
+}
+
+// DetectStagingLayout picks the layout of a log file from its first line.
+//
+// A first line that starts with "#" is a header that lists the column names
+// separated by tabs, and selects the layout with exactly those columns.
+// Otherwise the layout is chosen by the number of columns, which must be
+// unique among the known layouts.
+func DetectStagingLayout(firstLine string) (*DetectedLayout, error) {
+	layouts, err := StagingLayouts()
+	if err != nil {
+		return nil, err
+	}
+	return detectStagingLayout(layouts, firstLine)
+}
+
+func detectStagingLayout(layouts []*StagingLayout, firstLine string) (*DetectedLayout, error) {
+	line := strings.TrimRight(firstLine, "\r\n")
+
+	if strings.HasPrefix(line, "#") {
+		names := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "#")), "\t")
+		for _, layout := range layouts {
+			if equalNames(layout.ColumnNames(), names) {
+				return &DetectedLayout{StagingLayout: layout, HasHeader: true}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown log format: no layout has the header columns %s", strings.Join(names, ", "))
+	}
+
+	count := strings.Count(line, "\t") + 1
+	var matched []*StagingLayout
+	for _, layout := range layouts {
+		if len(layout.Columns) == count {
+			matched = append(matched, layout)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return nil, fmt.Errorf("unknown log format: no layout has %d columns", count)
+	case 1:
+		return &DetectedLayout{StagingLayout: matched[0]}, nil
+	default:
+		versions := make([]string, 0, len(matched))
+		for _, layout := range matched {
+			versions = append(versions, layout.Version)
+		}
+		return nil, fmt.Errorf("ambiguous log format: %d columns match versions %s", count, strings.Join(versions, ", "))
+	}
+}
+
+func equalNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != strings.TrimSpace(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package schemata
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Every registered layout must produce a valid load script.
+func TestStagingLayouts(t *testing.T) {
+	layouts, err := StagingLayouts()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NotEmpty(t, layouts)
+
+	for _, layout := range layouts {
+		_, err := LoadScriptFor(layout)
+		assert.NoError(t, err, layout.Version)
+	}
+}
+
+func TestDetectStagingLayout(t *testing.T) {
+	v1, err := StagingVersion("v1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	detected, err := DetectStagingLayout(strings.Repeat("-\t", len(v1.Columns)-1) + "-\n")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "v1", detected.Version)
+		assert.False(t, detected.HasHeader)
+	}
+
+	detected, err = DetectStagingLayout("#" + strings.Join(v1.ColumnNames(), "\t") + "\r\n")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "v1", detected.Version)
+		assert.True(t, detected.HasHeader)
+	}
+
+	_, err = DetectStagingLayout("a\tb\tc")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no layout has 3 columns")
+	}
+
+	_, err = DetectStagingLayout("#a\tb\tc")
+	assert.Error(t, err)
+}
+
+func TestDetectStagingLayoutAmbiguous(t *testing.T) {
+	layouts := []*StagingLayout{
+		{Version: "a", Columns: []Column{{Name: "x"}, {Name: "y"}}},
+		{Version: "b", Columns: []Column{{Name: "y"}, {Name: "x"}}},
+	}
+
+	_, err := detectStagingLayout(layouts, "1\t2")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "versions a, b")
+	}
+
+	detected, err := detectStagingLayout(layouts, "#y\tx")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "b", detected.Version)
+	}
+}
@@ -0,0 +1,150 @@
+// Package schemata holds the BigQuery table schemata shared by the Go code
+// and Terraform, and builds the load script of the logs table from them.
+package schemata
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed logs.yml
+var logsYAML []byte
+
+//go:embed staging/*.yml
+var stagingFS embed.FS
+
+const (
+	ModeNullable = "NULLABLE"
+	ModeRequired = "REQUIRED"
+)
+
+// PartitionColumn is the TIMESTAMP column the logs table is partitioned by.
+const PartitionColumn = "request_time"
+
+var knownTypes = map[string]bool{
+	"STRING":    true,
+	"INT64":     true,
+	"FLOAT64":   true,
+	"BOOL":      true,
+	"DATE":      true,
+	"TIME":      true,
+	"DATETIME":  true,
+	"TIMESTAMP": true,
+}
+
+// Column is one column of a BigQuery table schema as written in the YAML files.
+type Column struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	Mode string `yaml:"mode"`
+}
+
+// Required reports whether the column does not accept NULL.
+func (c Column) Required() bool {
+	return c.Mode == ModeRequired
+}
+
+// Projection describes how a column of the logs table is computed from the
+// staging table.
+type Projection struct {
+	Name string `yaml:"name"`
+	// Expression is a SQL expression over the staging columns.
+	Expression string `yaml:"expression"`
+	// NullIf turns the given value of the staging column of the same name into NULL.
+	NullIf *string `yaml:"null_if"`
+}
+
+// StagingLayout describes the columns of a log file and how they map onto
+// the logs table. Each version of the ISWF log format has its own layout.
+type StagingLayout struct {
+	Version     string       `yaml:"version"`
+	Columns     []Column     `yaml:"columns"`
+	Projections []Projection `yaml:"projections"`
+}
+
+// LogsTable returns the schema of the logs table.
+func LogsTable() ([]Column, error) {
+	return ParseTable(logsYAML)
+}
+
+// Staging returns the layout of the default log format version.
+func Staging() (*StagingLayout, error) {
+	return StagingVersion(DefaultStagingVersion)
+}
+
+func ParseTable(data []byte) ([]Column, error) {
+	var columns []Column
+	if err := yaml.Unmarshal(data, &columns); err != nil {
+		return nil, fmt.Errorf("yaml.Unmarshal: %v", err)
+	}
+	for i := range columns {
+		if columns[i].Mode == "" {
+			columns[i].Mode = ModeNullable
+		}
+	}
+	if err := validateColumns(columns); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+func ParseStagingLayout(data []byte) (*StagingLayout, error) {
+	var layout StagingLayout
+	if err := yaml.Unmarshal(data, &layout); err != nil {
+		return nil, fmt.Errorf("yaml.Unmarshal: %v", err)
+	}
+	if layout.Version == "" {
+		return nil, errors.New("version is empty")
+	}
+	if err := validateColumns(layout.Columns); err != nil {
+		return nil, fmt.Errorf("%s: %w", layout.Version, err)
+	}
+	return &layout, nil
+}
+
+// ColumnNames returns the names of the columns in file order.
+func (l *StagingLayout) ColumnNames() []string {
+	names := make([]string, 0, len(l.Columns))
+	for _, c := range l.Columns {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// Column returns the staging column with the given name.
+func (l *StagingLayout) Column(name string) (Column, bool) {
+	for _, c := range l.Columns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+func validateColumns(columns []Column) error {
+	var errs []error
+	if len(columns) == 0 {
+		errs = append(errs, errors.New("no columns"))
+	}
+	seen := map[string]bool{}
+	for i, c := range columns {
+		if c.Name == "" {
+			errs = append(errs, fmt.Errorf("column %d: name is empty", i+1))
+			continue
+		}
+		if seen[c.Name] {
+			errs = append(errs, fmt.Errorf("column %s: duplicated", c.Name))
+		}
+		seen[c.Name] = true
+		if !knownTypes[c.Type] {
+			errs = append(errs, fmt.Errorf("column %s: unknown type %q", c.Name, c.Type))
+		}
+		if c.Mode != "" && c.Mode != ModeNullable && c.Mode != ModeRequired {
+			errs = append(errs, fmt.Errorf("column %s: unknown mode %q", c.Name, c.Mode))
+		}
+	}
+	return errors.Join(errs...)
+}
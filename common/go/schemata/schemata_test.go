@@ -0,0 +1,160 @@
+package schemata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultLoadScript(t *testing.T) {
+	script, err := DefaultLoadScript()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	create := script.CreateStagingTable("dataset", "uu-id")
+	assert.Contains(t, create, "CREATE TABLE `dataset.uu-id`")
+	assert.Contains(t, create, "request_time TIME,")
+	assert.Contains(t, create, "reserved_9 STRING\n);")
+
+	load := script.LoadStaging("dataset", "uu-id", "source_uris", LoadStagingOptions{})
+	assert.Contains(t, load, "LOAD DATA INTO `dataset.uu-id`")
+	assert.Contains(t, load, "uris = @source_uris")
+	assert.Contains(t, load, `field_delimiter = '\t'`)
+	assert.NotContains(t, load, "skip_leading_rows")
+	assert.NotContains(t, load, "compression")
+
+	load = script.LoadStaging("dataset", "uu-id", "source_uris", LoadStagingOptions{SkipLeadingRows: 1, Compression: "GZIP"})
+	assert.Contains(t, load, "skip_leading_rows = 1")
+	assert.Contains(t, load, "compression = 'GZIP'")
+
+	insert := script.InsertFromStaging("dataset", "table", "uu-id")
+	assert.Contains(t, insert, "INSERT INTO `dataset.table`(request_time, protocol, group_name, account_name, transfer_status, status_code, fqdn, transfer_time_ms, request_length, response_length, file_type, content_type, categorization_reason, determination_category, request_url, client_ip)")
+	assert.Contains(t, insert, "NET.IP_TO_STRING")
+	assert.Contains(t, insert, "PARSE_DATE('%Y/%m/%d', request_date)")
+	assert.Contains(t, insert, "NULLIF(file_type, '-') AS file_type")
+	assert.Contains(t, insert, "FROM `dataset.uu-id`;")
+}
+
+func TestCheckedRows(t *testing.T) {
+	script, err := DefaultLoadScript()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	load := script.LoadLines("dataset", "uu-id", "source_uris", LoadStagingOptions{})
+	assert.Contains(t, load, "CREATE TABLE `dataset.uu-id`\n(\n\t_line_number INT64,\n\t_numbered_reason STRING,\n\t_line STRING\n);")
+	assert.Contains(t, load, "LOAD DATA INTO `dataset.uu-id`")
+	assert.Contains(t, load, "quote = ''")
+	// 余分な列を黙って捨てない
+	assert.NotContains(t, load, "ignore_unknown_values")
+
+	create := script.CreateCheckedRows("dataset", "uu-id")
+	assert.Contains(t, create, "CREATE TEMP TABLE checked_rows AS")
+	assert.Contains(t, create, "FORMAT('%d columns, want 25'")
+	assert.Contains(t, create, "SAFE_CAST(NULLIF(_fields[SAFE_OFFSET(9)], '') AS INT64) AS status_code")
+	assert.Contains(t, create, "'invalid status_code'")
+	assert.NotContains(t, create, "'invalid fqdn'")
+	assert.Contains(t, create, "IF(request_time IS NULL, 'request_time is NULL', NULL)")
+	assert.NotContains(t, create, "'file_type is NULL'")
+	assert.Contains(t, create, "ARRAY_TO_STRING([_numbered_reason, IF(")
+	assert.Contains(t, create, "SELECT _line_number, _line, _numbered_reason, SPLIT(_line, '\\t') AS _fields FROM `dataset.uu-id`")
+
+	// 取り込む行と拒否する行は同じ条件で分ける
+	insert := script.InsertCheckedRows("dataset", "table")
+	assert.Contains(t, insert, "INSERT INTO `dataset.table`(request_time, protocol,")
+	assert.Contains(t, insert, "FROM checked_rows\nWHERE _reason IS NULL;")
+
+	statement := script.DeleteCheckedReplaceRange("dataset", "table")
+	assert.Contains(t, statement, "SELECT request_time FROM checked_rows WHERE _reason IS NULL")
+	assert.Contains(t, statement, "DELETE FROM `dataset.table` WHERE request_time >= TIMESTAMP(replace_start, @time_zone) AND request_time < TIMESTAMP(DATE_ADD(replace_end, INTERVAL 1 DAY), @time_zone);")
+}
+
+func TestAppendNumberedLine(t *testing.T) {
+	line := AppendNumberedLine(nil, 3, "", []byte("a\tb\r\n"))
+	assert.Equal(t, "3\x1f\x1fa\tb\n", string(line))
+
+	line = AppendNumberedLine(line, 4, "unknown log format", []byte("a\x1fb\n"))
+	assert.Equal(t, "3\x1f\x1fa\tb\n4\x1funknown log format; line contains U+001F\x1fa\ufffdb\n", string(line))
+
+	// 理由も区切り文字と改行を含まない
+	line = AppendNumberedLine(nil, 1, "no layout has the header columns a\x1fb\n", []byte("x"))
+	assert.Equal(t, "1\x1fno layout has the header columns a b \x1fx\n", string(line))
+}
+
+func TestDeleteReplaceRange(t *testing.T) {
+	script, err := DefaultLoadScript()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, "DECLARE replace_start, replace_end DATE;\n", script.DeclareReplaceRange())
+
+	// ファイルの最初と最後の時刻ではなく、その日付全体を置き換える
+	statement := script.DeleteReplaceRange("dataset", "table", "uu-id")
+	assert.Contains(t, statement, "SET (replace_start, replace_end) = (\nSELECT AS STRUCT MIN(DATE(request_time, @time_zone)), MAX(DATE(request_time, @time_zone))")
+	assert.Contains(t, statement, "PARSE_DATE('%Y/%m/%d', request_date), request_time), @time_zone) AS request_time\nFROM `dataset.uu-id`")
+	assert.Contains(t, statement, "DELETE FROM `dataset.table` WHERE request_time >= TIMESTAMP(replace_start, @time_zone) AND request_time < TIMESTAMP(DATE_ADD(replace_end, INTERVAL 1 DAY), @time_zone);")
+}
+
+func TestNewLoadScriptMismatch(t *testing.T) {
+	table, err := ParseTable([]byte(`
+- name: request_time
+  type: TIMESTAMP
+  mode: REQUIRED
+- name: status_code
+  type: INT64
+  mode: REQUIRED
+- name: fqdn
+  type: STRING
+  mode: REQUIRED
+- name: file_type
+  type: STRING
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	staging, err := ParseStagingLayout([]byte(`
+version: test
+columns:
+  - name: status_code
+    type: STRING
+  - name: fqdn
+    type: STRING
+projections:
+  - name: fqdn
+    null_if: "-"
+  - name: unknown
+    expression: "1"
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	_, err = NewLoadScript(table, staging)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "column request_time: no staging column or projection")
+		assert.Contains(t, err.Error(), "column status_code: staging type STRING does not match INT64")
+		assert.Contains(t, err.Error(), "column fqdn: null_if on a REQUIRED column")
+		assert.Contains(t, err.Error(), "column file_type: no staging column or projection")
+		assert.Contains(t, err.Error(), "projection unknown: no such column in the table")
+	}
+}
+
+func TestParseTableInvalid(t *testing.T) {
+	_, err := ParseTable([]byte(`
+- name: a
+  type: STRNG
+- name: a
+  type: STRING
+  mode: OPTIONAL
+`))
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `column a: unknown type "STRNG"`)
+		assert.Contains(t, err.Error(), "column a: duplicated")
+		assert.Contains(t, err.Error(), `column a: unknown mode "OPTIONAL"`)
+	}
+}
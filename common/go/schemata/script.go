@@ -0,0 +1,354 @@
+package schemata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// LoadScript builds the statements that load a log file into the logs table
+// through a staging table. NewLoadScript checks that the staging layout
+// covers every column of the logs table, so a mismatch is found before any
+// job is submitted.
+type LoadScript struct {
+	table   []Column
+	staging *StagingLayout
+}
+
+func NewLoadScript(table []Column, staging *StagingLayout) (*LoadScript, error) {
+	projections := map[string]Projection{}
+	var errs []error
+	for _, p := range staging.Projections {
+		if _, ok := projections[p.Name]; ok {
+			errs = append(errs, fmt.Errorf("projection %s: duplicated", p.Name))
+		}
+		projections[p.Name] = p
+	}
+
+	tableColumns := map[string]bool{}
+	for _, c := range table {
+		tableColumns[c.Name] = true
+
+		p, hasProjection := projections[c.Name]
+		if hasProjection && p.Expression != "" {
+			if p.NullIf != nil {
+				errs = append(errs, fmt.Errorf("projection %s: expression and null_if are exclusive", c.Name))
+			}
+			continue
+		}
+
+		sc, ok := staging.Column(c.Name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("column %s: no staging column or projection", c.Name))
+			continue
+		}
+		if sc.Type != c.Type {
+			errs = append(errs, fmt.Errorf("column %s: staging type %s does not match %s", c.Name, sc.Type, c.Type))
+		}
+		if hasProjection && p.NullIf != nil && c.Required() {
+			errs = append(errs, fmt.Errorf("column %s: null_if on a REQUIRED column", c.Name))
+		}
+	}
+
+	for name := range projections {
+		if !tableColumns[name] {
+			errs = append(errs, fmt.Errorf("projection %s: no such column in the table", name))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return &LoadScript{table: table, staging: staging}, nil
+}
+
+// DefaultLoadScript returns the LoadScript of the embedded logs.yml and the
+// default staging layout.
+func DefaultLoadScript() (*LoadScript, error) {
+	staging, err := Staging()
+	if err != nil {
+		return nil, err
+	}
+	return LoadScriptFor(staging)
+}
+
+// LoadScriptFor returns the LoadScript of the embedded logs.yml and the given
+// staging layout.
+func LoadScriptFor(staging *StagingLayout) (*LoadScript, error) {
+	table, err := LogsTable()
+	if err != nil {
+		return nil, fmt.Errorf("logs.yml: %w", err)
+	}
+	script, err := NewLoadScript(table, staging)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", staging.Version, err)
+	}
+	return script, nil
+}
+
+func (s *LoadScript) stagingSchema() string {
+	columns := make([]string, 0, len(s.staging.Columns))
+	for _, c := range s.staging.Columns {
+		columns = append(columns, c.Name+" "+c.Type)
+	}
+	return "\t" + strings.Join(columns, ",\n\t")
+}
+
+func (s *LoadScript) CreateStagingTable(datasetId string, stagingTableId string) string {
+	return fmt.Sprintf("CREATE TABLE `%s.%s`\n(\n%s\n);\n", datasetId, stagingTableId, s.stagingSchema())
+}
+
+// LoadStagingOptions are the options of the LOAD DATA statement.
+type LoadStagingOptions struct {
+	// SkipLeadingRows is the number of header lines to skip.
+	SkipLeadingRows int
+	// Compression is the compression of the files, e.g. GZIP. The files are
+	// uncompressed when it is empty.
+	Compression string
+}
+
+func (o LoadStagingOptions) options() []string {
+	var options []string
+	if o.SkipLeadingRows > 0 {
+		options = append(options, fmt.Sprintf("skip_leading_rows = %d", o.SkipLeadingRows))
+	}
+	if o.Compression != "" {
+		options = append(options, "compression = "+quoteString(o.Compression))
+	}
+	return options
+}
+
+// LoadStaging returns the LOAD DATA statement that reads the files given by
+// the uris parameter into the staging table.
+func (s *LoadScript) LoadStaging(datasetId string, stagingTableId string, urisParam string, opts LoadStagingOptions) string {
+	options := append([]string{
+		"format = 'CSV'",
+		"uris = @" + urisParam,
+		`field_delimiter = '\t'`,
+	}, opts.options()...)
+
+	return fmt.Sprintf("LOAD DATA INTO `%s.%s`\n(\n%s\n)\nFROM FILES (\n\t%s\n);\n",
+		datasetId, stagingTableId, s.stagingSchema(), strings.Join(options, ",\n\t"))
+}
+
+// InsertFromStaging returns the statement that inserts the staging rows into
+// the logs table.
+func (s *LoadScript) InsertFromStaging(datasetId string, tableId string, stagingTableId string) string {
+	projections := s.projections()
+
+	names := make([]string, 0, len(s.table))
+	selects := make([]string, 0, len(s.table))
+	for _, c := range s.table {
+		names = append(names, c.Name)
+		selects = append(selects, selectColumn(c.Name, projections))
+	}
+
+	return fmt.Sprintf("INSERT INTO `%s.%s`(%s)\nSELECT\n\t%s\nFROM `%s.%s`;\n",
+		datasetId, tableId, strings.Join(names, ", "), strings.Join(selects, ",\n\t"), datasetId, stagingTableId)
+}
+
+const (
+	// CheckedRowsTable is the temporary table that CreateCheckedRows creates.
+	CheckedRowsTable = "checked_rows"
+	// CheckedLineNumberColumn is the column of the staging table of LoadLines
+	// and of CheckedRowsTable that holds the 1-based number of the line in
+	// the source file.
+	CheckedLineNumberColumn = "_line_number"
+	// CheckedLineColumn is the column of the staging table of LoadLines and
+	// of CheckedRowsTable that holds a line of the files.
+	CheckedLineColumn = "_line"
+	// CheckedReasonColumn is the column of CheckedRowsTable that holds why
+	// the line cannot be loaded, or NULL if it can.
+	CheckedReasonColumn = "_reason"
+	// numberedReasonColumn is the column of the staging table of LoadLines
+	// that holds why the line was rejected before it was loaded, or NULL.
+	numberedReasonColumn = "_numbered_reason"
+)
+
+// numberedLineDelimiter separates the fields of the lines written by
+// AppendNumberedLine. LOAD DATA takes a single byte delimiter, which a log
+// line may still contain, so the lines that contain it are rejected.
+const numberedLineDelimiter = '\x1f'
+
+// AppendNumberedLine appends to dst the line that LoadLines reads for a line
+// of a source file: its 1-based number, why it is rejected, or "" if it is
+// not, and its content without the line ending. A delimiter in the content is
+// replaced with U+FFFD and rejects the line, as it cannot be loaded as is.
+func AppendNumberedLine(dst []byte, number int, reason string, line []byte) []byte {
+	line = bytes.TrimRight(line, "\r\n")
+	if bytes.IndexByte(line, numberedLineDelimiter) >= 0 {
+		line = bytes.ReplaceAll(line, []byte{numberedLineDelimiter}, []byte(string(utf8.RuneError)))
+		reason = joinReasons(reason, "line contains U+001F")
+	}
+	// 理由は検出のエラーに行の内容を含むことがあるため、区切り文字と改行を除く
+	reason = strings.Map(func(r rune) rune {
+		if r == numberedLineDelimiter || r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, reason)
+
+	dst = strconv.AppendInt(dst, int64(number), 10)
+	dst = append(dst, numberedLineDelimiter)
+	dst = append(dst, reason...)
+	dst = append(dst, numberedLineDelimiter)
+	dst = append(dst, line...)
+	return append(dst, '\n')
+}
+
+func joinReasons(reason string, more string) string {
+	if reason == "" {
+		return more
+	}
+	return reason + "; " + more
+}
+
+// LoadLines returns the statements that create the staging table with the
+// columns CheckedLineNumberColumn, the reason of AppendNumberedLine and
+// CheckedLineColumn, and load the files given by the uris parameter into it.
+// The files must be written line by line by AppendNumberedLine. Unlike
+// LoadStaging, LOAD DATA drops no line; CreateCheckedRows decides which
+// lines are loaded.
+func (s *LoadScript) LoadLines(datasetId string, stagingTableId string, urisParam string, opts LoadStagingOptions) string {
+	// 区切り文字は AppendNumberedLine が内容から除き、引用符なしで行全体を 1 列として読み込む
+	options := append([]string{
+		"format = 'CSV'",
+		"uris = @" + urisParam,
+		`field_delimiter = '\x1f'`,
+		"quote = ''",
+	}, opts.options()...)
+	columns := fmt.Sprintf("\t%s INT64,\n\t%s STRING,\n\t%s STRING", CheckedLineNumberColumn, numberedReasonColumn, CheckedLineColumn)
+
+	return fmt.Sprintf("CREATE TABLE `%s.%s`\n(\n%s\n);\nLOAD DATA INTO `%s.%s`\n(\n%s\n)\nFROM FILES (\n\t%s\n);\n",
+		datasetId, stagingTableId, columns, datasetId, stagingTableId, columns, strings.Join(options, ",\n\t"))
+}
+
+// CreateCheckedRows returns the statement that creates the temporary table
+// CheckedRowsTable from the lines loaded by LoadLines. It has the columns of
+// the logs table computed as InsertFromStaging does, CheckedLineNumberColumn,
+// CheckedLineColumn and CheckedReasonColumn. A line cannot be loaded when it
+// was rejected by AppendNumberedLine, has the wrong number of columns, a
+// column that is not of the staging type, or would put NULL into a REQUIRED
+// column.
+func (s *LoadScript) CreateCheckedRows(datasetId string, stagingTableId string) string {
+	count := len(s.staging.Columns)
+	typed := make([]string, 0, count)
+	parseErrors := []string{
+		numberedReasonColumn,
+		fmt.Sprintf("IF(IFNULL(ARRAY_LENGTH(_fields), 0) != %d, FORMAT('%%d columns, want %d', IFNULL(ARRAY_LENGTH(_fields), 0)), NULL)", count, count),
+	}
+	for i, c := range s.staging.Columns {
+		// LOAD DATA と同様に空の列は NULL とする
+		field := fmt.Sprintf("NULLIF(_fields[SAFE_OFFSET(%d)], '')", i)
+		if c.Type == "STRING" {
+			typed = append(typed, field+" AS "+c.Name)
+			continue
+		}
+		typed = append(typed, fmt.Sprintf("SAFE_CAST(%s AS %s) AS %s", field, c.Type, c.Name))
+		parseErrors = append(parseErrors, fmt.Sprintf("IF(%s IS NOT NULL AND SAFE_CAST(%s AS %s) IS NULL, %s, NULL)", field, field, c.Type, quoteString("invalid "+c.Name)))
+	}
+
+	projections := s.projections()
+	selects := make([]string, 0, len(s.table))
+	reasons := []string{"NULLIF(_parse_errors, '')"}
+	for _, c := range s.table {
+		selects = append(selects, selectColumn(c.Name, projections))
+		if c.Required() {
+			reasons = append(reasons, fmt.Sprintf("IF(%s IS NULL, %s, NULL)", c.Name, quoteString(c.Name+" is NULL")))
+		}
+	}
+
+	lineColumns := CheckedLineNumberColumn + ", " + CheckedLineColumn
+	return fmt.Sprintf(`CREATE TEMP TABLE %s AS
+SELECT * EXCEPT (_parse_errors), NULLIF(ARRAY_TO_STRING([%s], '; '), '') AS %s
+FROM (
+SELECT
+	%s,
+	ARRAY_TO_STRING([%s], '; ') AS _parse_errors,
+	%s
+FROM (
+SELECT
+	%s, %s, _fields,
+	%s
+FROM (SELECT %s, %s, SPLIT(%s, '\t') AS _fields FROM `+"`%s.%s`"+`)
+)
+);
+`,
+		CheckedRowsTable, strings.Join(reasons, ", "), CheckedReasonColumn,
+		lineColumns, strings.Join(parseErrors, ", "), strings.Join(selects, ",\n\t"),
+		lineColumns, numberedReasonColumn, strings.Join(typed, ",\n\t"),
+		lineColumns, numberedReasonColumn, CheckedLineColumn, datasetId, stagingTableId)
+}
+
+// InsertCheckedRows returns the statement that inserts the rows of
+// CheckedRowsTable that can be loaded into the logs table.
+func (s *LoadScript) InsertCheckedRows(datasetId string, tableId string) string {
+	names := make([]string, 0, len(s.table))
+	for _, c := range s.table {
+		names = append(names, c.Name)
+	}
+	return fmt.Sprintf("INSERT INTO `%s.%s`(%s)\nSELECT %s\nFROM %s\nWHERE %s IS NULL;\n",
+		datasetId, tableId, strings.Join(names, ", "), strings.Join(names, ", "), CheckedRowsTable, CheckedReasonColumn)
+}
+
+// DeclareReplaceRange declares the script variables used by
+// DeleteReplaceRange. It must be placed at the beginning of the script.
+func (s *LoadScript) DeclareReplaceRange() string {
+	return "DECLARE replace_start, replace_end DATE;\n"
+}
+
+// DeleteReplaceRange returns the statements that delete the rows of the logs
+// table whose PartitionColumn falls on the dates, in the @time_zone
+// parameter, covered by the staging rows, so that inserting the staging rows
+// afterwards replaces those whole days. Nothing is deleted when the staging
+// table is empty.
+func (s *LoadScript) DeleteReplaceRange(datasetId string, tableId string, stagingTableId string) string {
+	return deleteReplaceRange(datasetId, tableId, fmt.Sprintf("SELECT\n\t%s\nFROM `%s.%s`", selectColumn(PartitionColumn, s.projections()), datasetId, stagingTableId))
+}
+
+// DeleteCheckedReplaceRange is DeleteReplaceRange for the rows of
+// CheckedRowsTable that can be loaded.
+func (s *LoadScript) DeleteCheckedReplaceRange(datasetId string, tableId string) string {
+	return deleteReplaceRange(datasetId, tableId, fmt.Sprintf("SELECT %s FROM %s WHERE %s IS NULL", PartitionColumn, CheckedRowsTable, CheckedReasonColumn))
+}
+
+func deleteReplaceRange(datasetId string, tableId string, rows string) string {
+	// 日付の範囲を時刻の範囲に直して比べると、パーティションフィルタとして扱われる
+	return fmt.Sprintf("SET (replace_start, replace_end) = (\nSELECT AS STRUCT MIN(DATE(%s, @time_zone)), MAX(DATE(%s, @time_zone))\nFROM (\n%s\n)\n);\n"+
+		"DELETE FROM `%s.%s` WHERE %s >= TIMESTAMP(replace_start, @time_zone) AND %s < TIMESTAMP(DATE_ADD(replace_end, INTERVAL 1 DAY), @time_zone);\n",
+		PartitionColumn, PartitionColumn, rows, datasetId, tableId, PartitionColumn, PartitionColumn)
+}
+
+func (s *LoadScript) projections() map[string]Projection {
+	projections := map[string]Projection{}
+	for _, p := range s.staging.Projections {
+		projections[p.Name] = p
+	}
+	return projections
+}
+
+// selectColumn returns the select list item that computes the column of the
+// logs table from the staging columns.
+func selectColumn(name string, projections map[string]Projection) string {
+	p, ok := projections[name]
+	switch {
+	case ok && p.Expression != "":
+		return p.Expression + " AS " + name
+	case ok && p.NullIf != nil:
+		return fmt.Sprintf("NULLIF(%s, %s) AS %s", name, quoteString(*p.NullIf), name)
+	default:
+		return name
+	}
+}
+
+func (s *LoadScript) DropStagingTable(datasetId string, stagingTableId string) string {
+	return fmt.Sprintf("DROP TABLE IF EXISTS `%s.%s`;\n", datasetId, stagingTableId)
+}
+
+func quoteString(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
@@ -0,0 +1,164 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// CloudEvent types that DecodeSourceObject understands.
+const (
+	StorageObjectFinalizedEvent = "google.cloud.storage.object.v1.finalized"
+	PubSubMessagePublishedEvent = "google.cloud.pubsub.topic.v1.messagePublished"
+)
+
+// notificationFinalize is the eventType attribute of a Cloud Storage
+// notification for a new object.
+// (See https://cloud.google.com/storage/docs/pubsub-notifications#attributes)
+const notificationFinalize = "OBJECT_FINALIZE"
+
+// ErrNotFinalized is returned by DecodeSourceObject for the Cloud Storage
+// notifications of other changes than a new object, such as deletes. The
+// stages acknowledge them without doing anything.
+var ErrNotFinalized = errors.New("not an object finalize notification")
+
+// MessagePublishedData is the data of a Pub/Sub messagePublished CloudEvent.
+type MessagePublishedData struct {
+	Message PubSubMessage
+}
+
+type PubSubMessage struct {
+	ID              string
+	Data            []byte `json:"data"`
+	Attributes      map[string]string
+	PublishTime     time.Time
+	DeliveryAttempt *int
+	OrderingKey     string
+}
+
+// SourceObject is the object a stage is triggered for, whichever event
+// delivered it.
+type SourceObject struct {
+	Bucket string
+	Name   string
+	// Generation is the generation of the object, 0 if unknown.
+	Generation int64
+	// Size is the size of the object, 0 if unknown.
+	Size int64
+	// CRC32C is the checksum of the object encoded as by EncodeCRC32C, ""
+	// if unknown.
+	CRC32C string
+	// CRC32CFromStage is true when CRC32C was computed by the upstream stage
+	// while it wrote the object. Only then is it worth verifying the object
+	// against: Cloud Storage reports the checksum of what it stored.
+	CRC32CFromStage bool
+	// TraceID is the trace ID of the upstream stage, "" if none.
+	TraceID string
+	// Attributes are the attributes of the Pub/Sub message, nil for a Cloud
+	// Storage event.
+	Attributes map[string]string
+}
+
+// URI returns the gs:// URI of the object.
+func (o *SourceObject) URI() string {
+	return "gs://" + o.Bucket + "/" + o.Name
+}
+
+// DecodeSourceObject returns the object of a Cloud Storage finalized event,
+// or of a Pub/Sub message that carries either a PubSubMessageData from an
+// upstream stage or a Cloud Storage JSON API notification.
+func DecodeSourceObject(e event.Event) (*SourceObject, error) {
+	switch e.Type() {
+	case StorageObjectFinalizedEvent:
+		var data storagedata.StorageObjectData
+		if err := protojson.Unmarshal(e.Data(), &data); err != nil {
+			return nil, fmt.Errorf("protojson.Unmarshal: %w", err)
+		}
+		return &SourceObject{
+			Bucket:     data.GetBucket(),
+			Name:       data.GetName(),
+			Generation: data.GetGeneration(),
+			Size:       data.GetSize(),
+			CRC32C:     data.GetCrc32C(),
+		}, nil
+
+	case PubSubMessagePublishedEvent:
+		var msg MessagePublishedData
+		if err := e.DataAs(&msg); err != nil {
+			return nil, fmt.Errorf("event.DataAs: %w", err)
+		}
+		return decodeMessage(msg.Message)
+
+	default:
+		return nil, fmt.Errorf("unsupported event type %q", e.Type())
+	}
+}
+
+func decodeMessage(msg PubSubMessage) (*SourceObject, error) {
+	// Cloud Storage の通知は属性で見分ける
+	if _, ok := msg.Attributes["objectId"]; ok {
+		return decodeNotification(msg)
+	}
+
+	var data PubSubMessageData
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %v", err)
+	}
+	if data.Bucket == "" || data.FilePath == "" {
+		return nil, fmt.Errorf("no object in message %s", msg.ID)
+	}
+	return &SourceObject{
+		Bucket:          data.Bucket,
+		Name:            data.FilePath,
+		Generation:      data.Generation,
+		CRC32C:          data.CRC32C,
+		CRC32CFromStage: data.CRC32C != "",
+		TraceID:         data.TraceID,
+		Attributes:      msg.Attributes,
+	}, nil
+}
+
+// decodeNotification reads the object of a Cloud Storage notification from
+// its attributes, and the size and the checksum from the JSON API payload if
+// there is one.
+func decodeNotification(msg PubSubMessage) (*SourceObject, error) {
+	if eventType := msg.Attributes["eventType"]; eventType != notificationFinalize {
+		return nil, fmt.Errorf("%w: %s", ErrNotFinalized, eventType)
+	}
+
+	object := &SourceObject{
+		Bucket:     msg.Attributes["bucketId"],
+		Name:       msg.Attributes["objectId"],
+		Attributes: msg.Attributes,
+	}
+	if object.Bucket == "" || object.Name == "" {
+		return nil, fmt.Errorf("no object in notification %s", msg.ID)
+	}
+	if value := msg.Attributes["objectGeneration"]; value != "" {
+		generation, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("objectGeneration: invalid value %q", value)
+		}
+		object.Generation = generation
+	}
+
+	// ペイロードは JSON_API_V1 形式の場合だけ読む (NONE の場合は空)
+	if msg.Attributes["payloadFormat"] == "JSON_API_V1" && len(msg.Data) > 0 {
+		var resource struct {
+			Size   int64  `json:"size,string"`
+			CRC32C string `json:"crc32c"`
+		}
+		if err := json.Unmarshal(msg.Data, &resource); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %v", err)
+		}
+		object.Size = resource.Size
+		object.CRC32C = resource.CRC32C
+	}
+	return object, nil
+}
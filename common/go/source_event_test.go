@@ -0,0 +1,93 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func newEvent(t *testing.T, eventType string, data any) event.Event {
+	e := event.New()
+	e.SetID("event-1")
+	e.SetSource("//test")
+	e.SetType(eventType)
+	if err := e.SetData(event.ApplicationJSON, data); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func newMessageEvent(t *testing.T, data string, attributes map[string]string) event.Event {
+	return newEvent(t, PubSubMessagePublishedEvent, map[string]any{
+		"message": map[string]any{
+			"messageId":  "1",
+			"data":       base64.StdEncoding.EncodeToString([]byte(data)),
+			"attributes": attributes,
+		},
+	})
+}
+
+func TestDecodeSourceObjectStorageEvent(t *testing.T) {
+	e := newEvent(t, StorageObjectFinalizedEvent, json.RawMessage(`{"bucket":"zip","name":"a/b.zip","generation":"5","size":"1024"}`))
+
+	object, err := DecodeSourceObject(e)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, &SourceObject{Bucket: "zip", Name: "a/b.zip", Generation: 5, Size: 1024}, object)
+		assert.Equal(t, "gs://zip/a/b.zip", object.URI())
+	}
+}
+
+func TestDecodeSourceObjectStageMessage(t *testing.T) {
+	e := newMessageEvent(t, `{"bucket":"tgz","filePath":"a/b.tgz","generation":7,"crc32c":"AAAAAQ==","traceId":"trace"}`, map[string]string{"load_mode": "replace"})
+
+	object, err := DecodeSourceObject(e)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, &SourceObject{
+			Bucket:          "tgz",
+			Name:            "a/b.tgz",
+			Generation:      7,
+			CRC32C:          "AAAAAQ==",
+			CRC32CFromStage: true,
+			TraceID:         "trace",
+			Attributes:      map[string]string{"load_mode": "replace"},
+		}, object)
+	}
+
+	_, err = DecodeSourceObject(newMessageEvent(t, `{"bucket":"tgz"}`, nil))
+	assert.ErrorContains(t, err, "no object")
+}
+
+func TestDecodeSourceObjectNotification(t *testing.T) {
+	attributes := map[string]string{
+		"eventType":        "OBJECT_FINALIZE",
+		"payloadFormat":    "JSON_API_V1",
+		"bucketId":         "zip",
+		"objectId":         "a/b.zip",
+		"objectGeneration": "9",
+	}
+	e := newMessageEvent(t, `{"kind":"storage#object","bucket":"zip","name":"a/b.zip","generation":"9","size":"2048"}`, attributes)
+
+	object, err := DecodeSourceObject(e)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, &SourceObject{Bucket: "zip", Name: "a/b.zip", Generation: 9, Size: 2048, Attributes: attributes}, object)
+	}
+
+	_, err = DecodeSourceObject(newMessageEvent(t, "", map[string]string{
+		"eventType": "OBJECT_DELETE",
+		"bucketId":  "zip",
+		"objectId":  "a/b.zip",
+	}))
+	assert.ErrorIs(t, err, ErrNotFinalized)
+}
+
+func TestDecodeSourceObjectUnsupportedEvent(t *testing.T) {
+	_, err := DecodeSourceObject(newEvent(t, "google.cloud.audit.log.v1.written", map[string]any{}))
+
+	assert.ErrorContains(t, err, "unsupported event type")
+}
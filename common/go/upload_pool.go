@@ -0,0 +1,201 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultUploadConcurrency is the number of objects UploadPool writes at
+	// a time.
+	DefaultUploadConcurrency = 8
+	// DefaultUploadBufferSize is the size up to which UploadPool buffers the
+	// content of an object.
+	DefaultUploadBufferSize = 8 << 20
+)
+
+// UploadPool writes the entries of an archive in parallel while the archive
+// is read sequentially. Upload buffers up to bufferSize bytes of an entry
+// and hands it to a worker; a larger entry is spooled to a temporary file
+// for its worker instead. Upload blocks while all the workers are busy, so
+// that at most about concurrency * bufferSize bytes are held in buffers.
+// The spooled files are removed once uploaded, and are bounded by the
+// ExtractLimits.MaxTotalSize of the archive; note that the temporary
+// directory of Cloud Functions is in memory. The first failure cancels the
+// other uploads.
+//
+// The CRC32C of every entry is computed before its upload starts and sent
+// with it, so that Cloud Storage rejects a corrupted upload.
+type UploadPool struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	group      *errgroup.Group
+	bufferSize int64
+
+	mu      sync.Mutex
+	results []UploadResult
+}
+
+// UploadResult describes an object written by UploadPool.
+type UploadResult struct {
+	Name string
+	// Generation is the generation of the object, if the writer reports it.
+	Generation int64
+	// CRC32C is the checksum of the written content.
+	CRC32C uint32
+}
+
+// NewUploadPool returns an UploadPool. DefaultUploadConcurrency and
+// DefaultUploadBufferSize are used when concurrency and bufferSize are 0.
+func NewUploadPool(ctx context.Context, concurrency int, bufferSize int64) *UploadPool {
+	if concurrency <= 0 {
+		concurrency = DefaultUploadConcurrency
+	}
+	if bufferSize <= 0 {
+		bufferSize = DefaultUploadBufferSize
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrency)
+	return &UploadPool{ctx: ctx, cancel: cancel, group: group, bufferSize: bufferSize}
+}
+
+// Upload writes the content read from r to the object of name. r has been
+// read to the end when Upload returns without an error. The error of reading
+// r is returned, as is the error of a failed upload once it is known; Wait
+// returns the errors of the uploads.
+func (p *UploadPool) Upload(object ObjectHandle, name string, r io.Reader) error {
+	if p.ctx.Err() != nil {
+		return context.Cause(p.ctx)
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, p.bufferSize+1)
+	if err != nil && err != io.EOF {
+		p.cancel()
+		return err
+	}
+
+	p.mu.Lock()
+	index := len(p.results)
+	p.results = append(p.results, UploadResult{Name: name})
+	p.mu.Unlock()
+
+	if n <= p.bufferSize {
+		p.group.Go(func() error {
+			return p.write(object, index, name, &buf, ChecksumCRC32C(buf.Bytes()), true)
+		})
+		return nil
+	}
+
+	// バッファに収まらないエントリは一時ファイルに書き出し、CRC32C を求めてからワーカーに渡す
+	f, crc, err := spool(io.MultiReader(&buf, r))
+	if err != nil {
+		p.cancel()
+		return err
+	}
+	p.group.Go(func() error {
+		defer os.Remove(f.Name())
+		defer f.Close()
+		return p.write(object, index, name, f, crc, true)
+	})
+	return nil
+}
+
+// spool copies r to a temporary file, and returns the file rewound to the
+// start and the CRC32C of the content.
+func spool(r io.Reader) (*os.File, uint32, error) {
+	f, err := os.CreateTemp("", "upload-")
+	if err != nil {
+		return nil, 0, fmt.Errorf("CreateTemp: %v", err)
+	}
+	hash := crc32.New(crc32cTable)
+	_, err = io.Copy(io.MultiWriter(f, hash), r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, hash.Sum32(), nil
+}
+
+// write writes r with writeObject, sending crc if send is true.
+func (p *UploadPool) write(object ObjectHandle, index int, name string, r io.Reader, crc uint32, send bool) error {
+	// 他のアップロードが失敗した後には書き始めない
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	result, err := writeObject(p.ctx, object, name, r, crc, send)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.results[index] = result
+	p.mu.Unlock()
+	return nil
+}
+
+// Wait waits for the uploads, and returns the written objects in the order
+// of Upload or the first error.
+func (p *UploadPool) Wait() ([]UploadResult, error) {
+	err := p.group.Wait()
+	p.cancel()
+	if err != nil {
+		return nil, err
+	}
+	return p.results, nil
+}
+
+// Abort cancels the uploads and waits for them to stop.
+func (p *UploadPool) Abort() {
+	p.cancel()
+	p.group.Wait()
+}
+
+// PublishUploads sends a message for each of the uploaded objects of
+// bucketName. The stages call it once all the entries of an archive are
+// written, so that nothing of an archive rejected halfway is loaded.
+func PublishUploads(ctx context.Context, bucketName string, uploaded []UploadResult, messageSender func(PubSubMessageData) error) error {
+	var errorGroup errgroup.Group
+	for _, result := range uploaded {
+		msgData := PubSubMessageData{
+			Bucket:     bucketName,
+			FilePath:   result.Name,
+			Generation: result.Generation,
+			CRC32C:     EncodeCRC32C(result.CRC32C),
+			TraceID:    TraceID(ctx),
+		}
+		errorGroup.Go(func() error {
+			return messageSender(msgData)
+		})
+	}
+
+	if err := errorGroup.Wait(); err != nil {
+		Logger(ctx).Error("Failed to send Pub/Sub message", "error", err)
+		return fmt.Errorf("sendPubSubMessage: %v", err)
+	}
+	return nil
+}
+
+// Names returns the names of the objects that may have been written, to
+// delete them after a failure.
+func (p *UploadPool) Names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, len(p.results))
+	for i, result := range p.results {
+		names[i] = result.Name
+	}
+	return names
+}
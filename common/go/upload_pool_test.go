@@ -0,0 +1,203 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowObjectHandle records how many writers are open at a time.
+type slowObjectHandle struct {
+	ObjectHandle
+	open    *atomic.Int32
+	maxOpen *atomic.Int32
+	fail    bool
+}
+
+func (o *slowObjectHandle) NewWriter(ctx context.Context) io.WriteCloser {
+	n := o.open.Add(1)
+	for {
+		m := o.maxOpen.Load()
+		if n <= m || o.maxOpen.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	return &slowWriter{WriteCloser: o.ObjectHandle.NewWriter(ctx), object: o, ctx: ctx}
+}
+
+type slowWriter struct {
+	io.WriteCloser
+	object *slowObjectHandle
+	ctx    context.Context
+	once   sync.Once
+}
+
+func (w *slowWriter) Attrs() *storage.ObjectAttrs {
+	return w.WriteCloser.(ObjectAttrsWriter).Attrs()
+}
+
+func (w *slowWriter) Close() error {
+	defer w.once.Do(func() { w.object.open.Add(-1) })
+	select {
+	case <-time.After(10 * time.Millisecond):
+	case <-w.ctx.Done():
+		w.WriteCloser.Close()
+		return w.ctx.Err()
+	}
+	if w.object.fail {
+		w.WriteCloser.Close()
+		return errors.New("upload failed")
+	}
+	return w.WriteCloser.Close()
+}
+
+func TestUploadPool(t *testing.T) {
+	ctx := context.Background()
+	client := &FileStorageClient{Root: t.TempDir()}
+	var open, maxOpen atomic.Int32
+
+	pool := NewUploadPool(ctx, 2, 8)
+	names := []string{"a.log", "b.log", "c.log", "large.log", "d.log"}
+	for _, name := range names {
+		content := "line\n"
+		if name == "large.log" {
+			content = strings.Repeat("large\n", 100)
+		}
+		object := &slowObjectHandle{ObjectHandle: client.Bucket("bucket").Object(name), open: &open, maxOpen: &maxOpen}
+		assert.NoError(t, pool.Upload(object, name, strings.NewReader(content)))
+	}
+
+	results, err := pool.Wait()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var got []string
+	for _, result := range results {
+		got = append(got, result.Name)
+		assert.NotZero(t, result.Generation)
+	}
+	assert.Equal(t, names, got)
+	assert.LessOrEqual(t, maxOpen.Load(), int32(2))
+
+	r, err := client.Bucket("bucket").Object("large.log").NewReader(ctx)
+	if assert.NoError(t, err) {
+		data, _ := io.ReadAll(r)
+		r.Close()
+		assert.Equal(t, strings.Repeat("large\n", 100), string(data))
+	}
+}
+
+// crcObjectHandle records the CRC32C sent with the content.
+type crcObjectHandle struct {
+	ObjectHandle
+	sent []uint32
+}
+
+func (o *crcObjectHandle) NewWriter(ctx context.Context) io.WriteCloser {
+	return &crcWriter{CRC32CWriter: o.ObjectHandle.NewWriter(ctx).(CRC32CWriter), object: o}
+}
+
+type crcWriter struct {
+	CRC32CWriter
+	object *crcObjectHandle
+}
+
+func (w *crcWriter) SetCRC32C(crc uint32) {
+	w.object.sent = append(w.object.sent, crc)
+	w.CRC32CWriter.SetCRC32C(crc)
+}
+
+func TestUploadPoolSpoolsLargeEntry(t *testing.T) {
+	ctx := context.Background()
+	client := &FileStorageClient{Root: t.TempDir()}
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	// バッファに収まらないエントリにも CRC32C を送る
+	content := strings.Repeat("large\n", 100)
+	object := &crcObjectHandle{ObjectHandle: client.Bucket("bucket").Object("large.log")}
+	pool := NewUploadPool(ctx, 1, 8)
+	assert.NoError(t, pool.Upload(object, "large.log", strings.NewReader(content)))
+	results, err := pool.Wait()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []uint32{ChecksumCRC32C([]byte(content))}, object.sent)
+	assert.Equal(t, ChecksumCRC32C([]byte(content)), results[0].CRC32C)
+
+	// 一時ファイルは残さない
+	entries, err := os.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestUploadPoolFailure(t *testing.T) {
+	ctx := context.Background()
+	client := &FileStorageClient{Root: t.TempDir()}
+	var open, maxOpen atomic.Int32
+
+	pool := NewUploadPool(ctx, 1, 0)
+	failing := &slowObjectHandle{ObjectHandle: client.Bucket("bucket").Object("a.log"), open: &open, maxOpen: &maxOpen, fail: true}
+	assert.NoError(t, pool.Upload(failing, "a.log", strings.NewReader("line\n")))
+
+	// 失敗が分かった後のアップロードは始めない
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		object := client.Bucket("bucket").Object("b.log")
+		err = pool.Upload(object, "b.log", bytes.NewReader([]byte("line\n")))
+	}
+	assert.ErrorContains(t, err, "upload failed")
+
+	_, err = pool.Wait()
+	assert.ErrorContains(t, err, "closing a.log: upload failed")
+}
+
+func TestUploadPoolReadError(t *testing.T) {
+	client := &FileStorageClient{Root: t.TempDir()}
+	pool := NewUploadPool(context.Background(), 1, 4)
+
+	r := io.MultiReader(strings.NewReader("large\n"), errReader{})
+	err := pool.Upload(client.Bucket("bucket").Object("a.log"), "a.log", r)
+	assert.ErrorContains(t, err, "read failed")
+	pool.Abort()
+	assert.Equal(t, []string{"a.log"}, pool.Names())
+
+	_, err = client.Bucket("bucket").Object("a.log").Attrs(context.Background())
+	assert.Error(t, err)
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestPublishUploads(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var messages []PubSubMessageData
+	sender := func(msg PubSubMessageData) error {
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, msg)
+		return nil
+	}
+
+	uploaded := []UploadResult{{Name: "a.zip/b.log", Generation: 1, CRC32C: 2}}
+	if assert.NoError(t, PublishUploads(ctx, "dest", uploaded, sender)) {
+		assert.Equal(t, []PubSubMessageData{{Bucket: "dest", FilePath: "a.zip/b.log", Generation: 1, CRC32C: EncodeCRC32C(2)}}, messages)
+	}
+
+	err := PublishUploads(ctx, "dest", uploaded, func(PubSubMessageData) error { return errors.New("unavailable") })
+	assert.ErrorContains(t, err, "unavailable")
+}
@@ -0,0 +1,107 @@
+package common
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/url"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+const (
+	// zipFlagUTF8 is the general purpose flag bit 11, set when the name is
+	// UTF-8.
+	zipFlagUTF8 = 0x800
+	// zipExtraUnicodePath is the Info-ZIP Unicode Path extra field, which
+	// carries the UTF-8 name next to a name in a legacy charset.
+	zipExtraUnicodePath = 0x7075
+)
+
+// ZipNameOptions describes how DecodeZipEntryName decodes entry names.
+type ZipNameOptions struct {
+	// Charset is the charset of the names that are not marked as UTF-8,
+	// CharsetAuto to detect it per name. CharsetUTF8 is used when it is
+	// empty.
+	Charset string
+	// PercentDecode unescapes the %XX sequences in the names, for the tools
+	// that percent-encode them. "+" is left as is.
+	PercentDecode bool
+}
+
+// DecodeZipEntryName returns the UTF-8 name of a zip entry. The name in the
+// Unicode Path extra field is used when it matches the header name, then the
+// header name as is when the UTF-8 flag is set, and otherwise the header name
+// decoded from opts.Charset.
+func DecodeZipEntryName(h *zip.FileHeader, opts ZipNameOptions) (string, error) {
+	name, ok := unicodePathName(h)
+	if !ok {
+		name = h.Name
+		if h.Flags&zipFlagUTF8 == 0 {
+			var err error
+			name, err = decodeLegacyName(h.Name, opts.Charset)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if opts.PercentDecode {
+		unescaped, err := url.PathUnescape(name)
+		if err != nil {
+			return "", fmt.Errorf("PathUnescape: %v", err)
+		}
+		name = unescaped
+	}
+	return name, nil
+}
+
+// unicodePathName returns the name in the Unicode Path extra field of h. It
+// is ignored when its CRC-32 does not match the header name, since the name
+// was then changed by a tool that does not know the field.
+func unicodePathName(h *zip.FileHeader) (string, bool) {
+	for extra := h.Extra; len(extra) >= 4; {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return "", false
+		}
+		data := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		// version (1), CRC-32 of the header name (4), UTF-8 name
+		if id != zipExtraUnicodePath || len(data) < 5 || data[0] != 1 {
+			continue
+		}
+		if binary.LittleEndian.Uint32(data[1:]) != crc32.ChecksumIEEE([]byte(h.Name)) {
+			continue
+		}
+		if name := data[5:]; utf8.Valid(name) {
+			return string(name), true
+		}
+	}
+	return "", false
+}
+
+func decodeLegacyName(name string, charset string) (string, error) {
+	if charset == "" {
+		return name, nil
+	}
+	charset, err := NormalizeCharset(charset)
+	if err != nil {
+		return "", err
+	}
+	if charset == CharsetAuto {
+		charset = DetectCharset([]byte(name))
+	}
+	if charset != CharsetCP932 {
+		return name, nil
+	}
+	decoded, err := japanese.ShiftJIS.NewDecoder().String(name)
+	if err != nil {
+		return "", fmt.Errorf("decoding %q: %v", name, err)
+	}
+	return decoded, nil
+}
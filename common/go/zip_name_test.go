@@ -0,0 +1,77 @@
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unicodePathExtra returns the Unicode Path extra field of name for the
+// header name raw.
+func unicodePathExtra(raw string, name string) []byte {
+	extra := binary.LittleEndian.AppendUint16(nil, zipExtraUnicodePath)
+	extra = binary.LittleEndian.AppendUint16(extra, uint16(5+len(name)))
+	extra = append(extra, 1)
+	extra = binary.LittleEndian.AppendUint32(extra, crc32.ChecksumIEEE([]byte(raw)))
+	return append(extra, name...)
+}
+
+// readZipHeaders writes the headers into a zip and reads them back, as the
+// flags are set by zip.Writer.
+func readZipHeaders(t *testing.T, headers ...*zip.FileHeader) []*zip.File {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, h := range headers {
+		if _, err := zw.CreateHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr.File
+}
+
+func TestDecodeZipEntryName(t *testing.T) {
+	// CP932 の "ログ/a.log"
+	cp932Name := "\x83\x8d\x83\x4f/a.log"
+
+	files := readZipHeaders(t,
+		&zip.FileHeader{Name: "ログ/a+b%20c.log"},
+		&zip.FileHeader{Name: cp932Name, NonUTF8: true},
+		&zip.FileHeader{Name: cp932Name, NonUTF8: true, Extra: unicodePathExtra(cp932Name, "日本語/a.log")},
+		&zip.FileHeader{Name: cp932Name, NonUTF8: true, Extra: unicodePathExtra("renamed.log", "日本語/a.log")},
+	)
+
+	tests := []struct {
+		file *zip.File
+		opts ZipNameOptions
+		want string
+	}{
+		{files[0], ZipNameOptions{Charset: CharsetCP932}, "ログ/a+b%20c.log"},
+		{files[0], ZipNameOptions{PercentDecode: true}, "ログ/a+b c.log"},
+		{files[1], ZipNameOptions{Charset: CharsetAuto}, "ログ/a.log"},
+		{files[1], ZipNameOptions{Charset: CharsetCP932}, "ログ/a.log"},
+		{files[1], ZipNameOptions{}, cp932Name},
+		{files[2], ZipNameOptions{Charset: CharsetAuto}, "日本語/a.log"},
+		// 名前の CRC-32 が合わない拡張フィールドは無視する
+		{files[3], ZipNameOptions{Charset: CharsetAuto}, "ログ/a.log"},
+	}
+	for _, tt := range tests {
+		got, err := DecodeZipEntryName(&tt.file.FileHeader, tt.opts)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tt.want, got)
+		}
+	}
+
+	_, err := DecodeZipEntryName(&zip.FileHeader{Name: "a%zz.log", Flags: zipFlagUTF8}, ZipNameOptions{PercentDecode: true})
+	assert.ErrorContains(t, err, "PathUnescape")
+}
@@ -0,0 +1,552 @@
+package dispatcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/common/go/config"
+
+	"cloud.google.com/go/storage"
+	_ "github.com/GoogleCloudPlatform/functions-framework-go/funcframework"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+func init() {
+	common.InitLogging(os.Getenv("PROJECT_ID"))
+	// Register a CloudEvent function with the Functions Framework
+	functions.CloudEvent("HandleDispatchEvent", HandleDispatchEvent)
+}
+
+// DefaultMaxDepth is how deep archives may be nested when MAX_DEPTH is not
+// set. The source object is at depth 1.
+const DefaultMaxDepth = 4
+
+// DefaultMaxNestedZipSize is the size up to which a zip nested in another
+// archive is buffered when MAX_NESTED_ZIP_SIZE is not set.
+const DefaultMaxNestedZipSize = 256 << 20
+
+// Kinds of content that the dispatcher tells apart.
+const (
+	kindLeaf = "leaf"
+	kindZip  = "zip"
+	kindTar  = "tar"
+)
+
+// sniffLength is enough to see the ustar magic of a tar header.
+const sniffLength = 512
+
+// compressionExtensions are the extensions removed from the names of the
+// compressed leaf files, which are written decompressed.
+var compressionExtensions = map[string][]string{
+	common.CompressionGzip:  {".gz"},
+	common.CompressionBzip2: {".bz2"},
+	common.CompressionXz:    {".xz"},
+	common.CompressionZstd:  {".zst", ".zstd"},
+}
+
+type EnvConfig struct {
+	ProjectID      string `env:"PROJECT_ID,required"`
+	ContentTopicID string `env:"CONTENT_TOPIC_ID,required"`
+	DestBucketName string `env:"DEST_BUCKET_NAME,required"`
+	// MaxDepth is how deep archives may be nested.
+	MaxDepth int `env:"MAX_DEPTH" validate:"min=1"`
+	// MaxNestedZipSize is the size up to which a zip nested in another
+	// archive is buffered to read its central directory.
+	MaxNestedZipSize int64 `env:"MAX_NESTED_ZIP_SIZE,size" validate:"min=1"`
+	// EntryInclude and EntryExclude are the patterns of the leaf files to
+	// write and to skip, and EntryMinSize and EntryMaxSize bound their
+	// sizes; see common.EntryFilter.
+	EntryInclude []string `env:"ENTRY_INCLUDE"`
+	EntryExclude []string `env:"ENTRY_EXCLUDE"`
+	EntryMinSize int64    `env:"ENTRY_MIN_SIZE,size" validate:"min=0"`
+	EntryMaxSize int64    `env:"ENTRY_MAX_SIZE,size" validate:"min=0"`
+	// MaxEntries, MaxTotalSize and MaxCompressionRatio reject the sources
+	// that would expand too much, counting the entries of all the nested
+	// archives and the bytes of the leaf files. 0 means no limit.
+	MaxEntries          int     `env:"MAX_ENTRIES" validate:"min=0"`
+	MaxTotalSize        int64   `env:"MAX_TOTAL_SIZE,size" validate:"min=0"`
+	MaxCompressionRatio float64 `env:"MAX_COMPRESSION_RATIO" validate:"min=0"`
+	// Charset is the charset of the leaf files, common.CharsetAuto to detect
+	// it. The files are transcoded to UTF-8 when it is set, and written as is
+	// by default.
+	Charset string `env:"CHARSET"`
+	// CharsetOverrides replaces Charset for the source objects under a prefix.
+	CharsetOverrides common.PrefixOverrides `env:"CHARSET_OVERRIDES"`
+	// EntryNamePolicy is how the entries with unsafe names are written, see
+	// common.SanitizeEntryName.
+	EntryNamePolicy string `env:"ENTRY_NAME_POLICY" validate:"oneof=reject flatten rewrite"`
+	// NameCharset is the charset of the zip entry names without the UTF-8
+	// flag, common.CharsetAuto to detect it.
+	NameCharset string `env:"NAME_CHARSET"`
+	// NamePercentDecode unescapes the %XX sequences in the zip entry names.
+	NamePercentDecode bool `env:"NAME_PERCENT_DECODE"`
+	// UploadConcurrency is the number of leaf files written at a time, and
+	// UploadBufferSize is the size up to which a leaf file is buffered for it.
+	UploadConcurrency int   `env:"UPLOAD_CONCURRENCY" validate:"min=1"`
+	UploadBufferSize  int64 `env:"UPLOAD_BUFFER_SIZE,size" validate:"min=1"`
+}
+
+func NewEnvConfig() (*EnvConfig, error) {
+	envConfig := EnvConfig{
+		MaxDepth:            DefaultMaxDepth,
+		MaxNestedZipSize:    DefaultMaxNestedZipSize,
+		MaxEntries:          common.DefaultMaxEntries,
+		MaxTotalSize:        common.DefaultMaxTotalSize,
+		MaxCompressionRatio: common.DefaultMaxCompressionRatio,
+		EntryNamePolicy:     common.EntryNamePolicyReject,
+		NameCharset:         common.CharsetAuto,
+		UploadConcurrency:   common.DefaultUploadConcurrency,
+		UploadBufferSize:    common.DefaultUploadBufferSize,
+	}
+	if err := config.Load(&envConfig); err != nil {
+		return nil, err
+	}
+	return &envConfig, nil
+}
+
+// Validate checks the charsets and the entry filter, as config.Load calls it.
+func (c *EnvConfig) Validate() error {
+	var errs []error
+	if err := c.DispatchOptions("").Filter.Validate(); err != nil {
+		errs = append(errs, &config.FieldError{Key: "ENTRY_INCLUDE/ENTRY_EXCLUDE", Err: err})
+	}
+	if c.Charset != "" {
+		if _, err := common.NormalizeCharset(c.Charset); err != nil {
+			errs = append(errs, &config.FieldError{Key: "CHARSET", Err: err})
+		}
+	}
+	if _, err := common.NormalizeCharset(c.NameCharset); err != nil {
+		errs = append(errs, &config.FieldError{Key: "NAME_CHARSET", Err: err})
+	}
+	for prefix, charset := range c.CharsetOverrides {
+		if _, err := common.NormalizeCharset(charset); err != nil {
+			errs = append(errs, &config.FieldError{Key: "CHARSET_OVERRIDES", Err: fmt.Errorf("%s: %v", prefix, err)})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DispatchOptions returns the options to dispatch the source object at srcPath.
+func (c *EnvConfig) DispatchOptions(srcPath string) DispatchOptions {
+	return DispatchOptions{
+		MaxDepth:         c.MaxDepth,
+		MaxNestedZipSize: c.MaxNestedZipSize,
+		Charset:          c.CharsetOverrides.Lookup(srcPath, c.Charset),
+		EntryNamePolicy:  c.EntryNamePolicy,
+		ZipName: common.ZipNameOptions{
+			Charset:       c.NameCharset,
+			PercentDecode: c.NamePercentDecode,
+		},
+		Filter: common.EntryFilter{
+			Include: c.EntryInclude,
+			Exclude: c.EntryExclude,
+			MinSize: c.EntryMinSize,
+			MaxSize: c.EntryMaxSize,
+		},
+		Limits: common.ExtractLimits{
+			MaxEntries:          c.MaxEntries,
+			MaxTotalSize:        c.MaxTotalSize,
+			MaxCompressionRatio: c.MaxCompressionRatio,
+		},
+		UploadConcurrency: c.UploadConcurrency,
+		UploadBufferSize:  c.UploadBufferSize,
+	}
+}
+
+// DispatchOptions describes how Dispatch walks the archives.
+type DispatchOptions struct {
+	// MaxDepth is how deep archives may be nested. Dispatch rejects an
+	// archive deeper than that.
+	MaxDepth int
+	// MaxNestedZipSize is the size up to which a zip nested in another
+	// archive is buffered. Dispatch rejects a larger one. The zip at
+	// srcPath is read from the bucket at random instead.
+	// DefaultMaxNestedZipSize is used when it is 0.
+	MaxNestedZipSize int64
+	// Charset is the charset of the leaf files, which are transcoded to
+	// UTF-8. The files are written as is when it is empty.
+	Charset string
+	// EntryNamePolicy is how the entries with unsafe names are written.
+	// They are rejected when it is empty.
+	EntryNamePolicy string
+	// ZipName is how the zip entry names are decoded.
+	ZipName common.ZipNameOptions
+	// Filter selects the leaf files to write by their paths under srcPath.
+	// The others are skipped. The size of a compressed leaf file is unknown
+	// and not checked.
+	Filter common.EntryFilter
+	// Limits caps what is extracted from the source object, nested archives
+	// included. The compression ratio is measured against the bytes read
+	// from the source object.
+	Limits common.ExtractLimits
+	// UploadConcurrency and UploadBufferSize configure the common.UploadPool
+	// that writes the leaf files. The defaults are used when they are 0.
+	UploadConcurrency int
+	UploadBufferSize  int64
+}
+
+func HandleDispatchEvent(ctx context.Context, e event.Event) error {
+	object, err := common.DecodeSourceObject(e)
+	if errors.Is(err, common.ErrNotFinalized) {
+		common.Logger(ctx).Info("Ignore event", common.LogKeyEventID, e.ID(), "reason", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("DecodeSourceObject: %v", err)
+	}
+
+	ctx = common.StartEvent(ctx, e.ID(), object.URI(), object.TraceID)
+	logger := common.Logger(ctx)
+
+	envConfig, err := NewEnvConfig()
+	if err != nil {
+		logger.Error("Failed to load EnvConfig", "error", err)
+		return fmt.Errorf("EnvConfig: %v", err)
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		logger.Error("Failed to create client", "error", err)
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	realClient := &common.RealStorageClient{Client: client}
+	return Dispatch(ctx, realClient, object.Bucket, object.Name, envConfig.DestBucketName, common.PubSubMessageSenderFactory(ctx, envConfig.ProjectID, envConfig.ContentTopicID), envConfig.DispatchOptions(object.Name))
+}
+
+// Dispatch extracts the archive at srcPath, and the archives nested in it,
+// by their magic bytes: zip, tar, and tar or single files compressed with
+// gzip, bzip2, xz or zstd. Only the leaf files are written to the
+// destination bucket, under srcPath followed by the path of the entries,
+// and a message is sent for each of them once all are written. A source
+// object that is not an archive is a leaf itself. An archive that exceeds
+// one of the limits, such as DispatchOptions.MaxDepth, or that has a zip
+// entry whose CRC-32 does not match is rejected with common.RejectArchive,
+// and Dispatch returns nil.
+func Dispatch(ctx context.Context, client common.StorageClient, srcBucketName string, srcPath string, destBucketName string, messageSender func(common.PubSubMessageData) error, opts DispatchOptions) error {
+	srcObject := client.Bucket(srcBucketName).Object(srcPath)
+	r, err := srcObject.NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("NewReader: %v", err)
+	}
+	defer r.Close()
+	compressed := &common.CountingReader{R: r}
+
+	// 入れ子のアーカイブは順に読み、ファイルは並行して書き出す
+	d := &dispatcher{
+		ctx:        ctx,
+		srcPath:    srcPath,
+		srcObject:  srcObject,
+		destBucket: client.Bucket(destBucketName),
+		opts:       opts,
+		pool:       common.NewUploadPool(ctx, opts.UploadConcurrency, opts.UploadBufferSize),
+		skipped:    common.SkippedEntries{},
+	}
+	defer d.pool.Abort()
+	// 最上位の zip は範囲を指定して読むため、その大きさを読んだバイト数とする
+	d.budget = common.NewExtractBudget(opts.Limits, func() int64 { return max(compressed.N, d.sourceZipSize) })
+	if err := d.dispatch(compressed, srcPath, -1, 1); err != nil {
+		// 上限を超えたエラーは tar や zip の読み手が書き換えるため、予算から得る
+		if limitErr := d.budget.Exceeded(); limitErr != nil {
+			err = limitErr
+		} else if d.corrupt != nil {
+			err = d.corrupt
+		}
+		// zip.Reader はエントリの CRC-32 を読み終えたときに確かめる。壊れたアーカイブは再試行しない
+		if errors.Is(err, common.ErrLimitExceeded) || errors.Is(err, zip.ErrChecksum) {
+			d.pool.Abort()
+			return common.RejectArchive(ctx, client, srcBucketName, srcPath, destBucketName, d.pool.Names(), err)
+		}
+		return err
+	}
+
+	written, err := d.pool.Wait()
+	if err != nil {
+		common.Logger(ctx).Error("Failed to write to destination bucket", "error", err)
+		return fmt.Errorf("Upload: %v", err)
+	}
+
+	if err := common.PublishUploads(ctx, destBucketName, written, messageSender); err != nil {
+		return err
+	}
+
+	common.Logger(ctx).Info("Dispatched archive", "extracted", len(written), "skipped", d.skipped.Total(), "skippedByReason", d.skipped)
+	return nil
+}
+
+type dispatcher struct {
+	ctx        context.Context
+	srcPath    string
+	srcObject  common.ObjectHandle
+	destBucket common.BucketHandle
+	opts       DispatchOptions
+	budget     *common.ExtractBudget
+	// sourceZipSize is the size of the source object when it is a zip.
+	sourceZipSize int64
+	// pool writes the leaf files, and skipped counts the entries that were
+	// not written.
+	pool    *common.UploadPool
+	skipped common.SkippedEntries
+	// corrupt is the error of the first zip entry whose CRC-32 does not
+	// match. It is kept here as the readers of nested archives may rewrite
+	// the error.
+	corrupt error
+}
+
+// dispatch extracts the content of r if it is an archive at depth, or
+// writes it as the leaf file name otherwise. size is the size of the
+// content, or negative if it is unknown.
+func (d *dispatcher) dispatch(r io.Reader, name string, size int64, depth int) error {
+	br := bufio.NewReaderSize(r, sniffLength)
+	header, err := br.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Peek %s: %v", name, err)
+	}
+
+	// 圧縮は tar と組み合わせて一つのアーカイブとして数える
+	var content io.Reader = br
+	compression := common.DetectCompression(header)
+	if compression != common.CompressionNone {
+		decompressed, err := common.NewDecompressor(br, compression)
+		if err != nil {
+			return fmt.Errorf("NewDecompressor %s: %v", name, err)
+		}
+		defer decompressed.Close()
+
+		br = bufio.NewReaderSize(decompressed, sniffLength)
+		header, err = br.Peek(sniffLength)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Peek %s: %v", name, err)
+		}
+		content = br
+	}
+
+	kind := sniffArchive(header)
+	if kind != kindLeaf && depth > d.opts.MaxDepth {
+		return fmt.Errorf("%w: %s is nested deeper than %d archives", common.ErrLimitExceeded, name, d.opts.MaxDepth)
+	}
+
+	switch kind {
+	case kindZip:
+		if depth == 1 && compression == common.CompressionNone {
+			return d.dispatchSourceZip(name)
+		}
+		return d.dispatchNestedZip(content, name, depth)
+	case kindTar:
+		return d.dispatchTar(content, name, depth)
+	default:
+		if compression != common.CompressionNone {
+			name = trimCompressionExtension(name, compression)
+			size = -1
+		}
+		return d.writeLeaf(content, name, size)
+	}
+}
+
+// dispatchSourceZip extracts the source object, which is a zip, reading it
+// from the bucket at random.
+func (d *dispatcher) dispatchSourceZip(name string) error {
+	attrs, err := d.srcObject.Attrs(d.ctx)
+	if err != nil {
+		return fmt.Errorf("Attrs: %v", err)
+	}
+	// アーカイブ全体をメモリに載せず、必要な範囲だけを読み込む
+	d.sourceZipSize = attrs.Size
+	readerAt := common.NewObjectReaderAt(d.ctx, d.srcObject, attrs.Size, attrs.Generation, 0, 0)
+	zr, err := zip.NewReader(readerAt, attrs.Size)
+	if err != nil {
+		return fmt.Errorf("zip.NewReader %s: %v", name, err)
+	}
+	return d.dispatchZip(zr, name, 1)
+}
+
+// dispatchNestedZip extracts a zip read from another archive.
+func (d *dispatcher) dispatchNestedZip(r io.Reader, name string, depth int) error {
+	maxSize := d.opts.MaxNestedZipSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxNestedZipSize
+	}
+	// zip は末尾の中央ディレクトリを読むためにメモリに載せる。大きさは制限する
+	buf, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("reading %s to buffer: %v", name, err)
+	}
+	if int64(len(buf)) > maxSize {
+		return fmt.Errorf("%w: %s is larger than %d bytes", common.ErrLimitExceeded, name, maxSize)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return fmt.Errorf("zip.NewReader %s: %v", name, err)
+	}
+	return d.dispatchZip(zr, name, depth)
+}
+
+func (d *dispatcher) dispatchZip(zr *zip.Reader, name string, depth int) error {
+	// エントリの数は中央ディレクトリで分かるため、展開する前に確かめる
+	if err := d.budget.CheckEntries(len(zr.File)); err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		// 飛ばすエントリも数える
+		if err := d.budget.AddEntry(); err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			d.skipped.Add("directory")
+			continue
+		}
+		decodedName, err := common.DecodeZipEntryName(&f.FileHeader, d.opts.ZipName)
+		if err != nil {
+			return fmt.Errorf("DecodeZipEntryName %s: %v", path.Join(name, f.Name), err)
+		}
+		entryName, ok := d.entryName(decodedName)
+		if !ok {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("Open %s: %v", decodedName, err)
+		}
+		entryPath := path.Join(name, entryName)
+		err = d.dispatch(&zipEntryReader{Reader: rc, d: d, name: entryPath, compressedSize: int64(f.CompressedSize64)}, entryPath, int64(f.UncompressedSize64), depth+1)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipEntryReader records the checksum error of the zip entry name in the
+// dispatcher, and checks the compression ratio of the entry. The bytes are
+// counted in the budget only when the leaf files are written.
+type zipEntryReader struct {
+	io.Reader
+	d              *dispatcher
+	name           string
+	compressedSize int64
+	extracted      int64
+}
+
+func (r *zipEntryReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.extracted += int64(n)
+	if limitErr := r.d.budget.CheckEntryRatio(r.extracted, r.compressedSize); limitErr != nil {
+		return n, limitErr
+	}
+	if errors.Is(err, zip.ErrChecksum) && r.d.corrupt == nil {
+		r.d.corrupt = fmt.Errorf("%s: %w", r.name, err)
+	}
+	return n, err
+}
+
+func (d *dispatcher) dispatchTar(r io.Reader, name string, depth int) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tar.Next %s: %v", name, err)
+		}
+		// 飛ばすエントリも数える
+		if err := d.budget.AddEntry(); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			d.skipped.Add("not a regular file")
+			continue
+		}
+		entryName, ok := d.entryName(header.Name)
+		if !ok {
+			continue
+		}
+		if err := d.dispatch(tr, path.Join(name, entryName), header.Size, depth+1); err != nil {
+			return err
+		}
+	}
+}
+
+// entryName returns the sanitized name of an entry, or false if the entry
+// is rejected.
+func (d *dispatcher) entryName(name string) (string, bool) {
+	entryName, err := common.SanitizeEntryName(name, d.opts.EntryNamePolicy)
+	if err != nil {
+		// 展開先の外に書き出す名前のエントリは飛ばして報告する
+		common.Logger(d.ctx).Error("Rejected entry", "entry", name, "error", err)
+		d.skipped.Add("unsafe name")
+		return "", false
+	}
+	return entryName, true
+}
+
+func (d *dispatcher) writeLeaf(r io.Reader, name string, size int64) error {
+	// パターンはソースの中のパスと照らし合わせる
+	if reason := d.opts.Filter.Skip(strings.TrimPrefix(name, d.srcPath+"/"), size); reason != "" {
+		common.Logger(d.ctx).Info("Skip entry", "entry", name, "reason", reason)
+		d.skipped.Add(reason)
+		return nil
+	}
+
+	// 入れ子のアーカイブを二重に数えないよう、書き出すファイルのバイト数だけを数える
+	var content io.Reader = d.budget.Reader(r)
+	var transcoder *common.Transcoder
+	if d.opts.Charset != "" {
+		var err error
+		transcoder, err = common.NewTranscoder(content, d.opts.Charset)
+		if err != nil {
+			return fmt.Errorf("NewTranscoder: %v", err)
+		}
+		content = transcoder
+	}
+
+	if err := d.pool.Upload(d.destBucket.Object(name), name, content); err != nil {
+		return fmt.Errorf("Upload: %v", err)
+	}
+
+	if transcoder != nil {
+		if report := transcoder.Report(); report.InvalidSequences > 0 {
+			common.Logger(d.ctx).Warn("Replaced undecodable byte sequences",
+				"object", name,
+				"invalidSequences", report.InvalidSequences,
+				"charset", report.Charset,
+				"lines", report.InvalidLines,
+			)
+		}
+	}
+	return nil
+}
+
+// sniffArchive returns the kind of archive whose magic bytes are in header.
+func sniffArchive(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return kindZip
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		return kindTar
+	default:
+		return kindLeaf
+	}
+}
+
+func trimCompressionExtension(name string, compression string) string {
+	for _, ext := range compressionExtensions[compression] {
+		if trimmed, ok := strings.CutSuffix(name, ext); ok && trimmed != "" {
+			return trimmed
+		}
+	}
+	return name
+}
@@ -0,0 +1,345 @@
+package dispatcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+type entry struct {
+	name    string
+	content []byte
+}
+
+func makeZip(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTar(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), Typeflag: tar.TypeReg})
+		tw.Write(e.content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func xzBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func putObject(t *testing.T, client common.StorageClient, bucket, name string, data []byte) {
+	w := client.Bucket(bucket).Object(name).NewWriter(context.Background())
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readObject(t *testing.T, client common.StorageClient, bucket, name string) string {
+	r, err := client.Bucket(bucket).Object(name).NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// recordSender collects the messages sent by Dispatch.
+type recordSender struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (s *recordSender) send(msg common.PubSubMessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = append(s.paths, msg.Bucket+"/"+msg.FilePath)
+	return nil
+}
+
+func TestDispatchNestedArchives(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	// zip > tgz > (log, zip > tar.xz > log, log.gz)
+	innerTarXz := xzBytes(t, makeTar(t, entry{"d.log", []byte("d\n")}))
+	innerZip := makeZip(t, entry{"c.tar.xz", innerTarXz})
+	tgz := gzipBytes(t, makeTar(t,
+		entry{"b.log", []byte("b\n")},
+		entry{"c.zip", innerZip},
+		entry{"e.log.gz", gzipBytes(t, []byte("e\n"))},
+	))
+	putObject(t, client, "upload", "a.zip", makeZip(t, entry{"a.tgz", tgz}, entry{"dir/", nil}))
+
+	sender := &recordSender{}
+	err := Dispatch(ctx, client, "upload", "a.zip", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth})
+
+	if assert.NoError(t, err) {
+		sort.Strings(sender.paths)
+		assert.Equal(t, []string{
+			"csv/a.zip/a.tgz/b.log",
+			"csv/a.zip/a.tgz/c.zip/c.tar.xz/d.log",
+			"csv/a.zip/a.tgz/e.log",
+		}, sender.paths)
+		assert.Equal(t, "d\n", readObject(t, client, "csv", "a.zip/a.tgz/c.zip/c.tar.xz/d.log"))
+		assert.Equal(t, "e\n", readObject(t, client, "csv", "a.zip/a.tgz/e.log"))
+	}
+}
+
+func TestDispatchMaxDepth(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	putObject(t, client, "upload", "a.zip", makeZip(t,
+		entry{"a.log", []byte("a\n")},
+		entry{"b.zip", makeZip(t, entry{"c.log", []byte("c\n")})},
+	))
+
+	// 深すぎるアーカイブは棄却し、書き出したファイルも送らずに消す
+	sender := &recordSender{}
+	err := Dispatch(ctx, client, "upload", "a.zip", "csv", sender.send, DispatchOptions{MaxDepth: 1})
+	if assert.NoError(t, err) {
+		assert.Empty(t, sender.paths)
+		_, err = client.Bucket("csv").Object("a.zip/a.log").Attrs(ctx)
+		assert.Error(t, err)
+		assert.Contains(t, readObject(t, client, "csv", "a.zip"+common.RejectedMarkerSuffix), "a.zip/b.zip is nested deeper than 1 archives")
+	}
+
+	err = Dispatch(ctx, client, "upload", "a.zip", "csv", sender.send, DispatchOptions{MaxDepth: 2})
+	if assert.NoError(t, err) {
+		sort.Strings(sender.paths)
+		assert.Equal(t, []string{"csv/a.zip/a.log", "csv/a.zip/b.zip/c.log"}, sender.paths)
+	}
+}
+
+func TestDispatchMaxNestedZipSize(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	innerZip := makeZip(t, entry{"c.log", bytes.Repeat([]byte("c\n"), 1000)})
+	putObject(t, client, "upload", "a.tar", makeTar(t, entry{"b.zip", innerZip}))
+
+	sender := &recordSender{}
+	err := Dispatch(ctx, client, "upload", "a.tar", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth, MaxNestedZipSize: int64(len(innerZip)) - 1})
+	if assert.NoError(t, err) {
+		assert.Empty(t, sender.paths)
+		assert.Contains(t, readObject(t, client, "csv", "a.tar"+common.RejectedMarkerSuffix), "a.tar/b.zip is larger than")
+	}
+
+	err = Dispatch(ctx, client, "upload", "a.tar", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth, MaxNestedZipSize: int64(len(innerZip))})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"csv/a.tar/b.zip/c.log"}, sender.paths)
+	}
+}
+
+func TestDispatchLimits(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	// 入れ子のアーカイブのエントリも数える
+	putObject(t, client, "upload", "a.zip", makeZip(t,
+		entry{"a.log", []byte("a\n")},
+		entry{"b.tar", makeTar(t, entry{"b.log", []byte("b\n")}, entry{"c.log", []byte("c\n")})},
+	))
+
+	for _, limits := range []common.ExtractLimits{
+		{MaxEntries: 3},
+		{MaxTotalSize: 5},
+	} {
+		sender := &recordSender{}
+		err := Dispatch(ctx, client, "upload", "a.zip", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth, Limits: limits})
+
+		if assert.NoError(t, err) {
+			assert.Empty(t, sender.paths)
+			assert.Contains(t, readObject(t, client, "csv", "a.zip"+common.RejectedMarkerSuffix), "exceeds")
+			_, err = client.Bucket("csv").Object("a.zip/a.log").Attrs(ctx)
+			assert.Error(t, err)
+		}
+	}
+
+	sender := &recordSender{}
+	err := Dispatch(ctx, client, "upload", "a.zip", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth, Limits: common.ExtractLimits{MaxEntries: 4, MaxTotalSize: 6}})
+	if assert.NoError(t, err) {
+		assert.Len(t, sender.paths, 3)
+	}
+}
+
+func TestDispatchCorruptZip(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "b.log", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("good line\n"))
+	zw.Close()
+	// 入れ子の zip の内容を書き換え、CRC-32 を合わなくする
+	innerZip := bytes.Replace(buf.Bytes(), []byte("good line\n"), []byte("evil line\n"), 1)
+	putObject(t, client, "upload", "a.tar", makeTar(t, entry{"a.log", []byte("a\n")}, entry{"b.zip", innerZip}))
+
+	sender := &recordSender{}
+	err = Dispatch(ctx, client, "upload", "a.tar", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth})
+	if assert.NoError(t, err) {
+		assert.Empty(t, sender.paths)
+		assert.Contains(t, readObject(t, client, "csv", "a.tar"+common.RejectedMarkerSuffix), "a.tar/b.zip/b.log: zip: checksum error")
+		_, err = client.Bucket("csv").Object("a.tar/a.log").Attrs(ctx)
+		assert.Error(t, err)
+	}
+}
+
+func TestDispatchFilter(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	// 入れ子のアーカイブ自体ではなく、書き出すファイルを選ぶ
+	putObject(t, client, "upload", "a.zip", makeZip(t, entry{"a.tgz", gzipBytes(t, makeTar(t,
+		entry{"b.log", []byte("b\n")},
+		entry{"big.log", []byte("big big\n")},
+		entry{"c.log.gz", gzipBytes(t, []byte("c c c c\n"))},
+		entry{"README", []byte("readme\n")},
+	))}))
+
+	sender := &recordSender{}
+	filter := common.EntryFilter{Include: []string{"*.log"}, MaxSize: 4}
+	err := Dispatch(ctx, client, "upload", "a.zip", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth, Filter: filter})
+
+	if assert.NoError(t, err) {
+		sort.Strings(sender.paths)
+		// 圧縮されたファイルの大きさは分からないため確かめない
+		assert.Equal(t, []string{"csv/a.zip/a.tgz/b.log", "csv/a.zip/a.tgz/c.log"}, sender.paths)
+	}
+
+	sender = &recordSender{}
+	filter = common.EntryFilter{Exclude: []string{"a.tgz/b*"}}
+	err = Dispatch(ctx, client, "upload", "a.zip", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth, Filter: filter})
+
+	if assert.NoError(t, err) {
+		sort.Strings(sender.paths)
+		assert.Equal(t, []string{"csv/a.zip/a.tgz/README", "csv/a.zip/a.tgz/c.log"}, sender.paths)
+	}
+}
+
+func TestDispatchRejectsUnsafeNames(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	putObject(t, client, "upload", "a.tar", makeTar(t,
+		entry{"../x.log", []byte("x\n")},
+		entry{".", []byte("dot\n")},
+		entry{"b.log", []byte("b\n")},
+	))
+
+	sender := &recordSender{}
+	err := Dispatch(ctx, client, "upload", "a.tar", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth})
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"csv/a.tar/b.log"}, sender.paths)
+	}
+}
+
+func TestDispatchLeafSource(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	// CP932 の "ログ"
+	putObject(t, client, "upload", "a.log", []byte("\x83\x8d\x83\x4f\n"))
+
+	sender := &recordSender{}
+	err := Dispatch(ctx, client, "upload", "a.log", "csv", sender.send, DispatchOptions{MaxDepth: DefaultMaxDepth, Charset: common.CharsetAuto})
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"csv/a.log"}, sender.paths)
+		assert.Equal(t, "ログ\n", readObject(t, client, "csv", "a.log"))
+	}
+}
+
+func TestNewEnvConfig(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("CONTENT_TOPIC_ID", "topic")
+	t.Setenv("DEST_BUCKET_NAME", "bucket")
+	t.Setenv("MAX_DEPTH", "")
+	t.Setenv("CHARSET", "")
+	t.Setenv("NAME_CHARSET", "")
+	t.Setenv("UPLOAD_CONCURRENCY", "")
+	t.Setenv("UPLOAD_BUFFER_SIZE", "")
+
+	envConfig, err := NewEnvConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, DispatchOptions{
+			MaxDepth:         DefaultMaxDepth,
+			MaxNestedZipSize: DefaultMaxNestedZipSize,
+			EntryNamePolicy:  common.EntryNamePolicyReject,
+			ZipName:          common.ZipNameOptions{Charset: common.CharsetAuto},
+			Limits: common.ExtractLimits{
+				MaxEntries:          common.DefaultMaxEntries,
+				MaxTotalSize:        common.DefaultMaxTotalSize,
+				MaxCompressionRatio: common.DefaultMaxCompressionRatio,
+			},
+			UploadConcurrency: common.DefaultUploadConcurrency,
+			UploadBufferSize:  common.DefaultUploadBufferSize,
+		}, envConfig.DispatchOptions("a.zip"))
+	}
+
+	t.Setenv("MAX_DEPTH", "0")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "MAX_DEPTH")
+
+	t.Setenv("MAX_DEPTH", "")
+	t.Setenv("NAME_CHARSET", "euc-jp")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "NAME_CHARSET")
+}
@@ -0,0 +1,121 @@
+package load2logs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/common/go/config"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultStagingTableMaxAge is how long a staging table may exist before the
+// janitor deletes it. It is much longer than any load script runs.
+const DefaultStagingTableMaxAge = 24 * time.Hour
+
+// stagingTableName matches the names ConstructQuery gives to staging tables.
+var stagingTableName = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+type JanitorConfig struct {
+	ProjectID string `env:"PROJECT_ID,required"`
+	DatasetID string `env:"DATASET_ID,required"`
+	// MaxAge is the age of the staging tables to delete.
+	MaxAge time.Duration `env:"STAGING_TABLE_MAX_AGE" validate:"min=1ns"`
+}
+
+func NewJanitorConfig() (*JanitorConfig, error) {
+	janitorConfig := JanitorConfig{MaxAge: DefaultStagingTableMaxAge}
+	if err := config.Load(&janitorConfig); err != nil {
+		return nil, err
+	}
+	return &janitorConfig, nil
+}
+
+// HandleCleanupEvent deletes the staging tables left by failed loads. It is
+// meant to be triggered periodically, e.g. by Cloud Scheduler through Pub/Sub.
+// The content of the event is not used.
+func HandleCleanupEvent(ctx context.Context, e event.Event) error {
+	ctx = common.StartEvent(ctx, e.ID(), "", "")
+	logger := common.Logger(ctx)
+
+	janitorConfig, err := NewJanitorConfig()
+	if err != nil {
+		logger.Error("Failed to load JanitorConfig", "error", err)
+		return fmt.Errorf("JanitorConfig: %v", err)
+	}
+
+	client, err := bigquery.NewClient(ctx, janitorConfig.ProjectID)
+	if err != nil {
+		logger.Error("Failed to create client", "error", err)
+		return fmt.Errorf("bigquery.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	realClient := &common.RealBigQueryClient{Client: client}
+
+	deleted, err := CleanupStagingTables(ctx, realClient, janitorConfig.DatasetID, janitorConfig.MaxAge, time.Now())
+	logger.Info("Deleted staging tables", "deleted", len(deleted), "dataset", janitorConfig.DatasetID)
+	return err
+}
+
+// CleanupStagingTables deletes the staging tables in the dataset that were
+// created before now - maxAge, and returns the IDs of the deleted tables.
+// Only tables named like a staging table are considered. It goes on after a
+// table fails to be deleted and returns all the errors at the end.
+func CleanupStagingTables(ctx context.Context, client common.BigQueryClient, datasetId string, maxAge time.Duration, now time.Time) ([]string, error) {
+	logger := common.Logger(ctx)
+	threshold := now.Add(-maxAge)
+
+	var deleted []string
+	var errs []error
+	it := client.Dataset(datasetId).Tables(ctx)
+	for {
+		table, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("Tables: %v", err)
+		}
+
+		tableId := table.TableID()
+		if !stagingTableName.MatchString(tableId) {
+			continue
+		}
+
+		meta, err := table.Metadata(ctx)
+		if isNotFound(err) {
+			// 実行中のスクリプトが削除した
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Metadata %s: %v", tableId, err))
+			continue
+		}
+		if !meta.CreationTime.Before(threshold) {
+			continue
+		}
+
+		if err := table.Delete(ctx); err != nil && !isNotFound(err) {
+			errs = append(errs, fmt.Errorf("Delete %s: %v", tableId, err))
+			continue
+		}
+		logger.Info("Deleted staging table", "dataset", datasetId, "table", tableId, "created", meta.CreationTime)
+		deleted = append(deleted, tableId)
+	}
+
+	return deleted, errors.Join(errs...)
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,123 @@
+package load2logs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+type MockBigQueryDatasetHandle struct {
+	mock.Mock
+}
+
+func (m *MockBigQueryDatasetHandle) Tables(ctx context.Context) common.BigQueryTableIterator {
+	args := m.Called(ctx)
+	return args.Get(0).(common.BigQueryTableIterator)
+}
+
+func (m *MockBigQueryDatasetHandle) Table(id string) common.BigQueryTableHandle {
+	args := m.Called(id)
+	return args.Get(0).(common.BigQueryTableHandle)
+}
+
+type MockBigQueryTableIterator struct {
+	Tables []common.BigQueryTableHandle
+}
+
+func (m *MockBigQueryTableIterator) Next() (common.BigQueryTableHandle, error) {
+	if len(m.Tables) == 0 {
+		return nil, iterator.Done
+	}
+	table := m.Tables[0]
+	m.Tables = m.Tables[1:]
+	return table, nil
+}
+
+type MockBigQueryTableHandle struct {
+	mock.Mock
+	ID string
+}
+
+func (m *MockBigQueryTableHandle) TableID() string {
+	return m.ID
+}
+
+func (m *MockBigQueryTableHandle) Metadata(ctx context.Context) (*bigquery.TableMetadata, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(*bigquery.TableMetadata), args.Error(1)
+}
+
+func (m *MockBigQueryTableHandle) Delete(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func TestCleanupStagingTables(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 8, 12, 0, 0, 0, time.UTC)
+
+	old := &MockBigQueryTableHandle{ID: "0b5e6a4e-3b0c-4f7e-9d2c-7f0f7e1c2a3b"}
+	old.On("Metadata", mock.Anything).Return(&bigquery.TableMetadata{CreationTime: now.Add(-25 * time.Hour)}, nil)
+	old.On("Delete", mock.Anything).Return(nil)
+
+	recent := &MockBigQueryTableHandle{ID: "5c1d7f0a-8e2b-4c3d-a1f0-9b8e7d6c5a4f"}
+	recent.On("Metadata", mock.Anything).Return(&bigquery.TableMetadata{CreationTime: now.Add(-time.Hour)}, nil)
+
+	dropped := &MockBigQueryTableHandle{ID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"}
+	dropped.On("Metadata", mock.Anything).Return((*bigquery.TableMetadata)(nil), &googleapi.Error{Code: http.StatusNotFound})
+
+	failing := &MockBigQueryTableHandle{ID: "1f2e3d4c-5b6a-4978-8a6b-5c4d3e2f1a0b"}
+	failing.On("Metadata", mock.Anything).Return(&bigquery.TableMetadata{CreationTime: now.Add(-48 * time.Hour)}, nil)
+	failing.On("Delete", mock.Anything).Return(errors.New("permission denied"))
+
+	// 名前が一致しないテーブルは作成日時を問わず残す
+	logs := &MockBigQueryTableHandle{ID: "logs"}
+
+	mockClient := new(MockBigqueryClient)
+	mockDataset := new(MockBigQueryDatasetHandle)
+	mockClient.On("Dataset", "dataset").Return(mockDataset)
+	mockDataset.On("Tables", mock.Anything).Return(&MockBigQueryTableIterator{
+		Tables: []common.BigQueryTableHandle{logs, old, recent, dropped, failing},
+	})
+
+	deleted, err := CleanupStagingTables(ctx, mockClient, "dataset", DefaultStagingTableMaxAge, now)
+
+	assert.Equal(t, []string{old.ID}, deleted)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Delete "+failing.ID+": permission denied")
+	}
+	old.AssertExpectations(t)
+	recent.AssertNotCalled(t, "Delete", mock.Anything)
+	dropped.AssertNotCalled(t, "Delete", mock.Anything)
+	logs.AssertNotCalled(t, "Metadata", mock.Anything)
+}
+
+func TestNewJanitorConfig(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("DATASET_ID", "dataset")
+
+	config, err := NewJanitorConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, DefaultStagingTableMaxAge, config.MaxAge)
+	}
+
+	t.Setenv("STAGING_TABLE_MAX_AGE", "6h")
+	config, err = NewJanitorConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 6*time.Hour, config.MaxAge)
+	}
+
+	t.Setenv("STAGING_TABLE_MAX_AGE", "-1h")
+	_, err = NewJanitorConfig()
+	assert.Error(t, err)
+}
@@ -0,0 +1,127 @@
+package load2logs
+
+import (
+	"context"
+	"fmt"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Ledger records which source objects have already been loaded, keyed on
+// the source URI and the object generation.
+type Ledger struct {
+	client    common.BigQueryClient
+	datasetId string
+	tableId   string
+}
+
+func NewLedger(client common.BigQueryClient, datasetId string, tableId string) *Ledger {
+	return &Ledger{
+		client:    client,
+		datasetId: datasetId,
+		tableId:   tableId,
+	}
+}
+
+// IsLoaded reports whether the given generation of srcFileId has already
+// been loaded successfully. It only saves running the load script, which
+// checks the ledger again in its transaction; see LedgerCheckStatement.
+func (l *Ledger) IsLoaded(ctx context.Context, srcFileId string, generation int64) (bool, error) {
+	q := l.client.Query(fmt.Sprintf("SELECT COUNT(*) FROM `%s.%s` WHERE source_uri = @source_uri AND generation = @generation", l.datasetId, l.tableId))
+	q.SetParameters(ledgerParameters(srcFileId, generation))
+
+	job, err := q.Run(ctx)
+	if err != nil {
+		return false, fmt.Errorf("Run: %v", err)
+	}
+
+	count, err := readCount(ctx, job)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// readCount reads the single INT64 value that the query of job returns.
+func readCount(ctx context.Context, job common.BigQueryJobHandle) (int64, error) {
+	row, err := readRow(ctx, job, 1)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := row[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected count: %v", row[0])
+	}
+	return count, nil
+}
+
+// readRow reads the single row of columns values that the query of job
+// returns.
+func readRow(ctx context.Context, job common.BigQueryJobHandle, columns int) ([]bigquery.Value, error) {
+	it, err := job.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Read: %v", err)
+	}
+
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil {
+		return nil, fmt.Errorf("Next: %v", err)
+	}
+	if len(row) != columns {
+		return nil, fmt.Errorf("unexpected row: %v", row)
+	}
+	return row, nil
+}
+
+// SourceGeneration returns the current generation of srcFileId, for the
+// events that do not carry one. Generation 0 must not be recorded in the
+// ledger, or every later object without a generation would be skipped.
+func SourceGeneration(ctx context.Context, storageClient common.StorageClient, srcFileId string) (int64, error) {
+	bucket, name, err := SplitSourceURI(srcFileId)
+	if err != nil {
+		return 0, err
+	}
+	attrs, err := storageClient.Bucket(bucket).Object(name).Attrs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Attrs: %v", err)
+	}
+	return attrs.Generation, nil
+}
+
+// LedgerCheckStatement returns the statement that sets the script variable
+// already_loaded when the source object is in the ledger. It is run in the
+// transaction of the load, before the INSERT into the logs table, so that a
+// source recorded since IsLoaded was checked is not loaded twice.
+func LedgerCheckStatement(datasetId string, tableId string) string {
+	return fmt.Sprintf("SET already_loaded = EXISTS(SELECT 1 FROM `%s.%s` WHERE source_uri = @source_uri AND generation = @generation);\n", datasetId, tableId)
+}
+
+// LedgerRecordStatement returns the statement that marks the source object
+// as loaded. It is run in the same transaction as the INSERT into the logs
+// table, so a failed load is never recorded. It is a MERGE rather than an
+// INSERT: BigQuery cancels one of two concurrent transactions that mutate
+// the ledger, so that two redeliveries that both found the source missing
+// do not both commit.
+func LedgerRecordStatement(datasetId string, tableId string) string {
+	return fmt.Sprintf(`MERGE `+"`%s.%s`"+` AS ledger
+USING (SELECT @source_uri AS source_uri, @generation AS generation) AS source
+ON ledger.source_uri = source.source_uri AND ledger.generation = source.generation
+WHEN MATCHED THEN UPDATE SET loaded_at = CURRENT_TIMESTAMP()
+WHEN NOT MATCHED THEN INSERT (source_uri, generation, loaded_at) VALUES (source.source_uri, source.generation, CURRENT_TIMESTAMP());
+`, datasetId, tableId)
+}
+
+func ledgerParameters(srcFileId string, generation int64) []bigquery.QueryParameter {
+	return []bigquery.QueryParameter{
+		{
+			Name:  "source_uri",
+			Value: srcFileId,
+		},
+		{
+			Name:  "generation",
+			Value: generation,
+		},
+	}
+}
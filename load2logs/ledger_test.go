@@ -0,0 +1,64 @@
+package load2logs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestLedgerIsLoaded(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.csv"
+	generation := int64(1704700000000000)
+
+	for _, tc := range []struct {
+		name  string
+		count int64
+		want  bool
+	}{
+		{name: "not loaded", count: 0, want: false},
+		{name: "loaded", count: 1, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockClient := new(MockBigqueryClient)
+			mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+			mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+			mockBigQueryRowIterator := &MockBigQueryRowIterator{
+				Rows: [][]bigquery.Value{{tc.count}},
+			}
+
+			mockClient.On("Query", "SELECT COUNT(*) FROM `dataset.ledger` WHERE source_uri = @source_uri AND generation = @generation").Return(mockBigQueryQueryHandle)
+			mockBigQueryQueryHandle.On("SetParameters", ledgerParameters(srcFileId, generation)).Return(nil)
+			mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+			mockBigQueryJobHandle.On("Read", mock.Anything).Return(mockBigQueryRowIterator, nil)
+			mockBigQueryRowIterator.On("Next", mock.Anything).Return(nil)
+
+			loaded, err := NewLedger(mockClient, "dataset", "ledger").IsLoaded(ctx, srcFileId, generation)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, loaded)
+			mockClient.AssertExpectations(t)
+			mockBigQueryQueryHandle.AssertExpectations(t)
+		})
+	}
+}
+
+func TestLedgerIsLoadedRunError(t *testing.T) {
+	ctx := context.Background()
+
+	mockClient := new(MockBigqueryClient)
+	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+
+	mockClient.On("Query", mock.Anything).Return(mockBigQueryQueryHandle)
+	mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(new(MockBigQueryJobHandle), errors.New("not found"))
+
+	_, err := NewLedger(mockClient, "dataset", "ledger").IsLoaded(ctx, "gs://src-bucket/test.csv", 1)
+
+	assert.Error(t, err)
+}
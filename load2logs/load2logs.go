@@ -2,224 +2,616 @@ package load2logs
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"strings"
 	"time"
+	_ "time/tzdata"
 
 	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/common/go/config"
+	"github.com/takotakot/iswf_log_to_bq/common/go/schemata"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
 	_ "github.com/GoogleCloudPlatform/functions-framework-go/funcframework"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
 	"github.com/google/uuid"
-	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
-	"google.golang.org/protobuf/encoding/protojson"
 )
 
 func init() {
+	common.InitLogging(os.Getenv("PROJECT_ID"))
 	// Register a CloudEvent function with the Functions Framework
 	functions.CloudEvent("HandleLoadEvent", HandleLoadEvent)
 	functions.CloudEvent("HandleLogLoadEvent", HandleLogLoadEvent)
+	functions.CloudEvent("HandleCleanupEvent", HandleCleanupEvent)
 }
 
-type MessagePublishedData struct {
-	Message PubSubMessage
-}
+const (
+	defaultLedgerTableID = "load_ledger"
+	// DefaultTimeZone is the time zone of request times when none is configured.
+	DefaultTimeZone = "Asia/Tokyo"
+)
+
+const (
+	// LoadModeAppend inserts the rows of the source object.
+	LoadModeAppend = "append"
+	// LoadModeReplace deletes the rows of the logs table on the request_time
+	// dates of the source object, then inserts the rows, in a transaction. It reloads re-exported logs without duplicating rows.
+	LoadModeReplace = "replace"
+
+	// loadModeAttribute is the Pub/Sub message attribute that overrides
+	// the load mode of a message.
+	loadModeAttribute = "load_mode"
+)
 
-type PubSubMessage struct {
-	ID              string
-	Data            []byte `json:"data"`
-	Attributes      map[string]string
-	PublishTime     time.Time
-	DeliveryAttempt *int
-	OrderingKey     string
+func ValidateLoadMode(mode string) error {
+	if mode != LoadModeAppend && mode != LoadModeReplace {
+		return fmt.Errorf("unknown load mode %q, want %s or %s", mode, LoadModeAppend, LoadModeReplace)
+	}
+	return nil
 }
 
 type EnvConfig struct {
-	ProjectID string
-	DatasetID string
-	TableID   string
+	ProjectID     string `env:"PROJECT_ID,required"`
+	DatasetID     string `env:"DATASET_ID,required"`
+	TableID       string `env:"TABLE_ID,required"`
+	LedgerTableID string `env:"LEDGER_TABLE_ID"`
+	// TimeZone is the IANA time zone that appliances write request times in.
+	TimeZone string `env:"TIME_ZONE"`
+	// TimeZoneOverrides replaces TimeZone for the source objects under a prefix.
+	TimeZoneOverrides common.PrefixOverrides `env:"TIME_ZONE_OVERRIDES"`
+	// ClientIPMode is common.ClientIPModeRaw or common.ClientIPModeHMAC.
+	ClientIPMode string `env:"CLIENT_IP_MODE"`
+	// ClientIPHMACKey is the key to pseudonymize client IPs in HMAC mode.
+	ClientIPHMACKey []byte `env:"CLIENT_IP_HMAC_KEY"`
+	// MaxBadRecords is the number of lines per file that may be rejected.
+	// Any bad line fails the load when it is 0.
+	MaxBadRecords int `env:"MAX_BAD_RECORDS" validate:"min=0"`
+	// RejectedTableID is the table that keeps the rejected lines.
+	RejectedTableID string `env:"REJECTED_TABLE_ID"`
+	// LoadMode is LoadModeAppend or LoadModeReplace.
+	LoadMode string `env:"LOAD_MODE"`
+	// MaxBytesBilled is the ceiling of the bytes billed by a load. 0 means
+	// the project default.
+	MaxBytesBilled int64 `env:"MAX_BYTES_BILLED" validate:"min=0"`
+	// StagingBucket is the bucket the source files are decompressed to when
+	// LOAD DATA cannot read their compression. It is required in HMAC client
+	// IP mode, where the client IPs are pseudonymized in a staged copy, and
+	// when MaxBadRecords is positive, where the lines are numbered in it.
+	StagingBucket string `env:"STAGING_BUCKET"`
 }
 
 func NewEnvConfig() (*EnvConfig, error) {
-	config := EnvConfig{}
-
-	requiredEnv := map[string]*string{
-		"PROJECT_ID": &config.ProjectID,
-		"DATASET_ID": &config.DatasetID,
-		"TABLE_ID":   &config.TableID,
+	envConfig := EnvConfig{
+		LedgerTableID:   defaultLedgerTableID,
+		TimeZone:        DefaultTimeZone,
+		ClientIPMode:    common.ClientIPModeRaw,
+		RejectedTableID: defaultRejectedTableID,
+		LoadMode:        LoadModeAppend,
+	}
+	if err := config.Load(&envConfig); err != nil {
+		return nil, err
 	}
+	return &envConfig, nil
+}
 
-	for envVar, valuePtr := range requiredEnv {
-		value := os.Getenv(envVar)
-		if value == "" {
-			return nil, fmt.Errorf("%s environment variable is not set", envVar)
+// Validate checks the values that BigQuery would reject only after the job
+// is submitted, as config.Load calls it.
+func (c *EnvConfig) Validate() error {
+	var errs []error
+	if err := validateTimeZone(c.TimeZone); err != nil {
+		errs = append(errs, &config.FieldError{Key: "TIME_ZONE", Err: err})
+	}
+	for prefix, tz := range c.TimeZoneOverrides {
+		if err := validateTimeZone(tz); err != nil {
+			errs = append(errs, &config.FieldError{Key: "TIME_ZONE_OVERRIDES", Err: fmt.Errorf("%s: %v", prefix, err)})
 		}
-		*valuePtr = value
 	}
 
-	return &config, nil
+	if err := common.ValidateClientIPMode(c.ClientIPMode); err != nil {
+		errs = append(errs, &config.FieldError{Key: "CLIENT_IP_MODE", Err: err})
+	}
+	if c.ClientIPMode == common.ClientIPModeHMAC && len(c.ClientIPHMACKey) == 0 {
+		errs = append(errs, &config.FieldError{Key: "CLIENT_IP_HMAC_KEY", Err: errors.New("not set")})
+	}
+	// HMAC はステージングしたコピーで計算する
+	if c.ClientIPMode == common.ClientIPModeHMAC && c.StagingBucket == "" {
+		errs = append(errs, &config.FieldError{Key: "STAGING_BUCKET", Err: fmt.Errorf("not set, but needed in %s client IP mode", common.ClientIPModeHMAC)})
+	}
+	// 拒否した行の行番号はステージングしたコピーで付ける
+	if c.MaxBadRecords > 0 && c.StagingBucket == "" {
+		errs = append(errs, &config.FieldError{Key: "STAGING_BUCKET", Err: errors.New("not set, but needed when MAX_BAD_RECORDS is positive")})
+	}
+
+	if err := ValidateLoadMode(c.LoadMode); err != nil {
+		errs = append(errs, &config.FieldError{Key: "LOAD_MODE", Err: err})
+	}
+	return errors.Join(errs...)
+}
+
+// validateTimeZone checks that tz is an IANA time zone name that BigQuery
+// accepts. time.LoadLocation also accepts "" and "Local", which are not.
+func validateTimeZone(tz string) error {
+	if tz == "" || tz == "Local" {
+		return fmt.Errorf("time zone %q is not an IANA time zone name", tz)
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LoadOptions returns the options to load the source object at srcPath.
+func (c *EnvConfig) LoadOptions(srcPath string) LoadOptions {
+	return LoadOptions{
+		DatasetID:       c.DatasetID,
+		TableID:         c.TableID,
+		LedgerTableID:   c.LedgerTableID,
+		TimeZone:        c.TimeZoneOverrides.Lookup(srcPath, c.TimeZone),
+		ClientIPMode:    c.ClientIPMode,
+		ClientIPKey:     c.ClientIPHMACKey,
+		MaxBadRecords:   c.MaxBadRecords,
+		RejectedTableID: c.RejectedTableID,
+		Mode:            c.LoadMode,
+		MaxBytesBilled:  c.MaxBytesBilled,
+		StagingBucket:   c.StagingBucket,
+	}
+}
+
+// LoadOptions describes where Load2Bq writes its rows.
+type LoadOptions struct {
+	DatasetID string
+	TableID   string
+	// LedgerTableID is the table that records loaded source objects.
+	// The ledger is not consulted when it is empty.
+	LedgerTableID string
+	// TimeZone is the time zone of the request times in the source object.
+	// DefaultTimeZone is used when it is empty.
+	TimeZone string
+	// ClientIPMode selects how client_ip is stored. common.ClientIPModeRaw
+	// is used when it is empty.
+	ClientIPMode string
+	// ClientIPKey is the HMAC key used in common.ClientIPModeHMAC. It is only
+	// used to rewrite the staged copy of the source file, and never sent to
+	// BigQuery.
+	ClientIPKey []byte
+	// MaxBadRecords enables the tolerant mode when it is positive: up to
+	// MaxBadRecords lines that cannot be loaded are written to
+	// RejectedTableID with their line numbers and the other lines are loaded.
+	// All the bad lines of a source with more are written to RejectedTableID
+	// and none is loaded. The lines are numbered in a copy of the source
+	// staged to StagingBucket.
+	MaxBadRecords   int
+	RejectedTableID string
+	// Mode is LoadModeAppend or LoadModeReplace. LoadModeAppend is used when
+	// it is empty.
+	Mode string
+	// DryRun validates the script and estimates the bytes it processes
+	// without loading anything.
+	DryRun bool
+	// MaxBytesBilled makes the load fail if it would bill more bytes.
+	// The project default applies when it is 0.
+	MaxBytesBilled int64
+	// StagingBucket is the bucket the source file is decompressed to when it
+	// is compressed with bzip2, xz or zstd, pseudonymized to in
+	// common.ClientIPModeHMAC, or numbered to in the tolerant mode. The staged
+	// copy is deleted after the job, and not written in a dry run.
+	StagingBucket string
+}
+
+// Tolerant reports whether bad lines are rejected instead of failing the load.
+func (o LoadOptions) Tolerant() bool {
+	return o.MaxBadRecords > 0
 }
 
+// Replace reports whether the rows on the dates of the source object are replaced.
+func (o LoadOptions) Replace() bool {
+	return o.Mode == LoadModeReplace
+}
+
+// SkipsLoaded reports whether a source object recorded in the ledger is
+// skipped. It is loaded again in the replace mode.
+func (o LoadOptions) SkipsLoaded() bool {
+	return o.LedgerTableID != "" && !o.Replace()
+}
+
+type LoadResult struct {
+	// Skipped is true when the source object had already been loaded.
+	Skipped bool
+	// Rejected is the number of lines written to the rejected table.
+	Rejected int
+	// SourceRejected is true when the source had more than MaxBadRecords
+	// bad lines, so that none of its lines were loaded.
+	SourceRejected bool
+	// DryRun is true when nothing was loaded because of LoadOptions.DryRun.
+	DryRun bool
+	// TotalBytesProcessed is the number of bytes processed by the script,
+	// or the estimate of it in a dry run.
+	TotalBytesProcessed int64
+}
+
+// HandleLoadEvent loads the source object of a Cloud Storage event or a
+// Pub/Sub message, see common.DecodeSourceObject.
 func HandleLoadEvent(ctx context.Context, e event.Event) error {
-	envConfig, err := NewEnvConfig()
+	object, err := common.DecodeSourceObject(e)
+	if errors.Is(err, common.ErrNotFinalized) {
+		common.Logger(ctx).Info("Ignore event", common.LogKeyEventID, e.ID(), "reason", err)
+		return nil
+	}
 	if err != nil {
-		log.Printf("Failed to load EnvConfig: %v", err)
-		return fmt.Errorf("EnvConfig: %v", err)
+		return fmt.Errorf("DecodeSourceObject: %v", err)
 	}
 
-	var msg MessagePublishedData
-	if err := e.DataAs(&msg); err != nil {
-		return fmt.Errorf("event.DataAs: %w", err)
-	}
+	ctx = common.StartEvent(ctx, e.ID(), object.URI(), object.TraceID)
+	logger := common.Logger(ctx)
 
-	var fileInfo common.PubSubMessageData
-	if err := json.Unmarshal(msg.Message.Data, &fileInfo); err != nil {
-		return fmt.Errorf("json.Unmarshal: %v", err)
+	envConfig, err := NewEnvConfig()
+	if err != nil {
+		logger.Error("Failed to load EnvConfig", "error", err)
+		return fmt.Errorf("EnvConfig: %v", err)
 	}
 
-	srcFileId := "gs://" + fileInfo.Bucket + "/" + fileInfo.FilePath
+	opts := envConfig.LoadOptions(object.Name)
+	if mode, ok := object.Attributes[loadModeAttribute]; ok {
+		if err := ValidateLoadMode(mode); err != nil {
+			return fmt.Errorf("%s attribute: %v", loadModeAttribute, err)
+		}
+		opts.Mode = mode
+	}
 
 	client, err := bigquery.NewClient(ctx, envConfig.ProjectID)
 	if err != nil {
-		log.Printf("Failed to create client: %v", err)
+		logger.Error("Failed to create client", "error", err)
 		return fmt.Errorf("bigquery.NewClient: %v", err)
 	}
 	defer client.Close()
 
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		logger.Error("Failed to create client", "error", err)
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer storageClient.Close()
+
 	realClient := &common.RealBigQueryClient{Client: client}
+	realStorageClient := &common.RealStorageClient{Client: storageClient}
+
+	// 展開したときのチェックサムがあれば、同じ内容を取り込むことを確かめる。
+	// Cloud Storage のイベントのチェックサムは保存された内容のものなので確かめない
+	if object.CRC32CFromStage {
+		err := common.VerifyObject(ctx, realStorageClient.Bucket(object.Bucket).Object(object.Name), object.Generation, object.CRC32C)
+		if errors.Is(err, common.ErrStaleObject) {
+			logger.Info("Ignore event", "reason", err)
+			return nil
+		}
+		if err != nil {
+			logger.Error("Failed to verify source object", "error", err)
+			return fmt.Errorf("VerifyObject: %v", err)
+		}
+	}
 
-	return Load2Bq(ctx, realClient, srcFileId, envConfig.DatasetID, envConfig.TableID)
+	_, err = Load2Bq(ctx, realClient, realStorageClient, object.URI(), object.Generation, opts)
+	return err
 }
 
+// HandleLogLoadEvent is HandleLoadEvent, kept for the functions deployed
+// with this entry point for Cloud Storage events.
+//
+// Deprecated: Use HandleLoadEvent.
 func HandleLogLoadEvent(ctx context.Context, e event.Event) error {
-	envConfig, err := NewEnvConfig()
+	return HandleLoadEvent(ctx, e)
+}
+
+// ConstructQuery returns the script that loads the source files into the
+// logs table. The statements are generated from the schemata in common for
+// the detected layout, and an error is returned if the layout does not match
+// the logs table.
+func ConstructQuery(opts LoadOptions, layout *SourceFile, uuid string) (string, error) {
+	script, err := schemata.LoadScriptFor(layout.StagingLayout)
 	if err != nil {
-		log.Printf("Failed to load EnvConfig: %v", err)
-		return fmt.Errorf("EnvConfig: %v", err)
+		return "", fmt.Errorf("schemata: %v", err)
 	}
 
-	var eventData storagedata.StorageObjectData
-	if err := protojson.Unmarshal(e.Data(), &eventData); err != nil {
-		return fmt.Errorf("protojson.Unmarshal: %w", err)
+	// 寛容モードの見出し行は LineNumberer がステージングで除く
+	var loadOptions schemata.LoadStagingOptions
+	if layout.HasHeader && !opts.Tolerant() {
+		loadOptions.SkipLeadingRows = 1
+	}
+	switch layout.Compression {
+	case common.CompressionNone:
+	case common.CompressionGzip:
+		loadOptions.Compression = "GZIP"
+	default:
+		return "", fmt.Errorf("LOAD DATA cannot read %s compression", layout.Compression)
 	}
 
-	srcFileId := "gs://" + eventData.GetBucket() + "/" + eventData.GetName()
+	ledgerStatement := ""
+	if opts.LedgerTableID != "" {
+		ledgerStatement = LedgerRecordStatement(opts.DatasetID, opts.LedgerTableID)
+	}
 
-	client, err := bigquery.NewClient(ctx, envConfig.ProjectID)
-	if err != nil {
-		log.Printf("Failed to create client: %v", err)
-		return fmt.Errorf("bigquery.NewClient: %v", err)
+	declareStatement := ""
+	if opts.SkipsLoaded() {
+		declareStatement = "DECLARE already_loaded BOOL;\n"
+	}
+	if opts.Replace() {
+		declareStatement += script.DeclareReplaceRange()
 	}
-	defer client.Close()
 
-	realClient := &common.RealBigQueryClient{Client: client}
+	// 寛容モードでは全行を読み込み、取り込む行と拒否する行を同じ条件で分ける
+	var loadStatement, checkStatement, replaceStatement, insertStatement, rejectedStatement, resultStatement string
+	if opts.Tolerant() {
+		declareStatement += "DECLARE bad_records INT64;\n"
+		loadStatement = script.LoadLines(opts.DatasetID, uuid, "source_uris", loadOptions)
+		checkStatement = script.CreateCheckedRows(opts.DatasetID, uuid) + RejectOverBudgetStatement(opts.MaxBadRecords) + "\n"
+		if opts.Replace() {
+			replaceStatement = script.DeleteCheckedReplaceRange(opts.DatasetID, opts.TableID)
+		}
+		insertStatement = script.InsertCheckedRows(opts.DatasetID, opts.TableID)
+		rejectedStatement = RejectedRecordStatement(opts.DatasetID, opts.RejectedTableID)
+	} else {
+		loadStatement = script.CreateStagingTable(opts.DatasetID, uuid) + "\n" + script.LoadStaging(opts.DatasetID, uuid, "source_uris", loadOptions)
+		if opts.Replace() {
+			replaceStatement = script.DeleteReplaceRange(opts.DatasetID, opts.TableID, uuid)
+		}
+		insertStatement = script.InsertFromStaging(opts.DatasetID, opts.TableID, uuid)
+	}
 
-	return Load2Bq(ctx, realClient, srcFileId, envConfig.DatasetID, envConfig.TableID)
-}
-
-func ConstructQuery(datasetId string, tableId, uuid string) string {
-	schema := `request_date STRING,
-	request_time TIME,
-	protocol STRING,
-	client_ip STRING,
-	group_name STRING,
-	account_name STRING,
-	reserved_1 STRING,
-	transfer_status STRING,
-	reserved_2 STRING,
-	status_code INT64,
-	fqdn STRING,
-	transfer_time_ms INT64,
-	request_length INT64,
-	response_length INT64,
-	file_type STRING,
-	content_type STRING,
-	categorization_reason STRING,
-	determination_category STRING,
-	reserved_4 STRING,
-	reserved_5 STRING,
-	reserved_6 STRING,
-	request_url STRING,
-	reserved_7 STRING,
-	reserved_8 STRING,
-	reserved_9 STRING`
+	// 台帳はトランザクションの中で確かめ直し、並行して読み込まれたソースを二重に取り込まない
+	transactionStatement := replaceStatement + insertStatement + rejectedStatement + ledgerStatement
+	if opts.SkipsLoaded() {
+		transactionStatement = LedgerCheckStatement(opts.DatasetID, opts.LedgerTableID) + "IF NOT already_loaded THEN\n" + transactionStatement + "END IF;\n"
+	}
+	if columns := scriptResultColumns(opts); len(columns) > 0 {
+		resultStatement = "SELECT " + strings.Join(columns, ", ") + ";\n"
+	}
 
 	query := fmt.Sprintf(`BEGIN
-	CREATE TABLE `+"`%s.%s`"+`
-	(
-	%s
-	);
-
-	LOAD DATA INTO `+"`%s.%s`"+`
-	(
-	%s
+%s%s
+%sBEGIN TRANSACTION;
+
+%s
+COMMIT TRANSACTION;
+
+%s%sEND
+`,
+		declareStatement,
+		loadStatement,
+		checkStatement,
+		transactionStatement,
+		script.DropStagingTable(opts.DatasetID, uuid),
+		resultStatement,
 	)
-	FROM FILES (
-		format = 'CSV',
-		uris = @source_uris,
-		field_delimiter = '\t'
-	);
-
-	INSERT INTO `+"`%s.%s`"+`(request_time, protocol, group_name, account_name, transfer_status, status_code, fqdn, transfer_time_ms, request_length, response_length, file_type, content_type, categorization_reason, determination_category, request_url)
-SELECT
-	TIMESTAMP(DATETIME(PARSE_DATE('%%Y/%%m/%%d', request_date), request_time), 'Asia/Tokyo') AS request_time,
-	protocol,
-	group_name,
-	account_name,
-	transfer_status,
-	status_code,
-	fqdn,
-	transfer_time_ms,
-	request_length,
-	response_length,
-	CASE file_type
-		WHEN '-' THEN NULL
-		ELSE file_type
-		END AS file_type,
-	CASE content_type
-		WHEN '-' THEN NULL
-		ELSE content_type
-		END AS content_type,
-	categorization_reason,
-	determination_category,
-	request_url
-FROM `+"`%s.%s`;"+`
-DROP TABLE IF EXISTS `+"`%s.%s`;"+`
-END
-`, datasetId, uuid, schema, datasetId, uuid, schema, datasetId, tableId, datasetId, uuid, datasetId, uuid)
-
-	return query
-}
-
-func Load2Bq(ctx context.Context, client common.BigQueryClient, srcFileId string, datasetId string, tableId string) error {
-	query := ConstructQuery(datasetId, tableId, uuid.New().String())
+
+	return query, nil
+}
+
+// scriptResultColumns returns the script variables that the script of
+// ConstructQuery returns in its last row.
+func scriptResultColumns(opts LoadOptions) []string {
+	var columns []string
+	if opts.SkipsLoaded() {
+		columns = append(columns, "already_loaded")
+	}
+	if opts.Tolerant() {
+		columns = append(columns, "bad_records")
+	}
+	return columns
+}
+
+func Load2Bq(ctx context.Context, client common.BigQueryClient, storageClient common.StorageClient, srcFileId string, generation int64, opts LoadOptions) (*LoadResult, error) {
+	logger := common.Logger(ctx)
+	// 世代が不明なイベントでは、台帳に 0 を記録しないよう実際の世代を調べる
+	if opts.LedgerTableID != "" && generation == 0 {
+		var err error
+		generation, err = SourceGeneration(ctx, storageClient, srcFileId)
+		if err != nil {
+			logger.Error("Failed to get generation", "error", err)
+			return nil, fmt.Errorf("SourceGeneration: %v", err)
+		}
+	}
+	// 置き換えの場合は読み込み済みでも再度読み込む。スクリプトでも確かめるため、ここでは省くだけ
+	if opts.SkipsLoaded() {
+		loaded, err := NewLedger(client, opts.DatasetID, opts.LedgerTableID).IsLoaded(ctx, srcFileId, generation)
+		if err != nil {
+			logger.Error("Failed to check ledger", "error", err)
+			return nil, fmt.Errorf("IsLoaded: %v", err)
+		}
+		if loaded {
+			logger.Info("Skip already loaded source", "generation", generation)
+			return &LoadResult{Skipped: true}, nil
+		}
+	}
+
+	var layout *SourceFile
+	var err error
+	if opts.Tolerant() {
+		layout, err = DetectTolerantSource(ctx, storageClient, srcFileId, opts.MaxBadRecords)
+	} else {
+		layout, err = DetectSource(ctx, storageClient, srcFileId)
+	}
+	if err != nil {
+		logger.Error("Failed to detect layout", "error", err)
+		return nil, fmt.Errorf("DetectSource: %v", err)
+	}
+	if layout.Undetected {
+		logger.Warn("No known layout", "lines", len(layout.LeadingRejects))
+	} else {
+		logger.Info("Detected layout", "version", layout.Version, "header", layout.HasHeader, "compression", layout.Compression, "rejectedLines", len(layout.LeadingRejects))
+	}
+
+	// LOAD DATA が読めない圧縮形式は展開し、HMAC モードでは client_ip を仮名化して
+	// ステージングバケットから読み込む。鍵を BigQuery に渡さないため。
+	// 寛容モードでは拒否した行の行番号を残すため、行番号を付けてステージングする
+	loadURI := srcFileId
+	pseudonymize := opts.ClientIPMode == common.ClientIPModeHMAC
+	if !nativeCompression(layout.Compression) || pseudonymize || opts.Tolerant() {
+		if opts.StagingBucket == "" {
+			if pseudonymize {
+				return nil, fmt.Errorf("%s needs a staging bucket to pseudonymize client IPs", srcFileId)
+			}
+			if opts.Tolerant() {
+				return nil, fmt.Errorf("%s needs a staging bucket to number the lines in the tolerant mode", srcFileId)
+			}
+			return nil, fmt.Errorf("%s is compressed with %s and needs a staging bucket", srcFileId, layout.Compression)
+		}
+		var rewrite func([]byte) []byte
+		if pseudonymize {
+			detected := layout.DetectedLayout
+			// 寛容モードでは見出し行を LineNumberer が除く
+			if opts.Tolerant() {
+				detected = &schemata.DetectedLayout{StagingLayout: detected.StagingLayout}
+			}
+			rewrite, err = ClientIPPseudonymizer(detected, opts.ClientIPKey)
+			if err != nil {
+				return nil, fmt.Errorf("ClientIPPseudonymizer: %v", err)
+			}
+		}
+		if opts.Tolerant() {
+			rewrite = LineNumberer(layout, rewrite, pseudonymize)
+		}
+		// ドライランでは書き込まず、ステージング後と同じスクリプトを見積もる
+		if opts.DryRun {
+			logger.Info("Skip staging in dry run")
+		} else {
+			loadURI, err = StageSource(ctx, storageClient, srcFileId, opts.StagingBucket, rewrite)
+			if err != nil {
+				logger.Error("Failed to stage source", "error", err)
+				return nil, fmt.Errorf("StageSource: %v", err)
+			}
+			logger.Info("Staged source", "stagedObject", loadURI, "pseudonymized", pseudonymize)
+			// 仮名化したコピーを含むため、ジョブが終わったら成否にかかわらず消す
+			defer func() {
+				if err := DeleteStaged(context.WithoutCancel(ctx), storageClient, loadURI); err != nil {
+					logger.Error("Failed to delete staged source", "stagedObject", loadURI, "error", err)
+				}
+			}()
+		}
+		layout = &SourceFile{DetectedLayout: layout.DetectedLayout, Compression: common.CompressionNone}
+	}
+	if opts.Replace() {
+		logger.Info("Replace the rows on the dates of the source")
+	}
+
+	query, err := ConstructQuery(opts, layout, uuid.New().String())
+	if err != nil {
+		logger.Error("Failed to construct query", "error", err)
+		return nil, fmt.Errorf("ConstructQuery: %v", err)
+	}
+
+	params := loadParameters(loadURI, srcFileId, generation, opts)
+
 	q := client.Query(query)
-	q.SetParameters([]bigquery.QueryParameter{
-		{
-			Name:  "source_uris",
-			Value: []string{srcFileId},
-		},
-	})
+	q.SetParameters(params)
+	if opts.DryRun {
+		q.SetDryRun(true)
+	}
+	if opts.MaxBytesBilled > 0 {
+		q.SetMaxBytesBilled(opts.MaxBytesBilled)
+	}
 
 	job, err := q.Run(ctx)
 	if err != nil {
-		log.Printf("Failed to Run query:%v", err)
-		return fmt.Errorf("Run: %v", err)
+		logger.Error("Failed to Run query", "error", err)
+		return nil, fmt.Errorf("Run: %v", err)
+	}
+
+	// ドライランのジョブは完了を待てないため、Run の結果から見積もりを得る
+	if opts.DryRun {
+		status := job.LastStatus()
+		if status.Err() != nil {
+			logger.Error("Dry run error", "error", status.Err())
+			return nil, fmt.Errorf("Dry run error: %v", status.Err())
+		}
+		result := &LoadResult{DryRun: true, TotalBytesProcessed: totalBytesProcessed(status)}
+		logger.Info("Dry run", "totalBytesProcessed", result.TotalBytesProcessed)
+		return result, nil
 	}
 
 	status, err := job.Wait(ctx)
 	if err != nil {
-		log.Printf("Job failed:%v", err)
-		return fmt.Errorf("Job err: %v", err)
+		logger.Error("Job failed", "error", err)
+		return nil, fmt.Errorf("Job err: %v", err)
 	}
 	if status.Err() != nil {
-		log.Printf("Job status error:%v", status.Err())
-		return fmt.Errorf("Job status error: %v", status.Err())
+		logger.Error("Job status error", "error", status.Err())
+		return nil, fmt.Errorf("Job status error: %v", status.Err())
 	}
 
-	return nil
+	result := &LoadResult{TotalBytesProcessed: totalBytesProcessed(status)}
+	// スクリプトの最後の SELECT が、読み込み済みだったかと拒否した行数を返す
+	var row []bigquery.Value
+	if columns := scriptResultColumns(opts); len(columns) > 0 {
+		row, err = readRow(ctx, job, len(columns))
+		if err != nil {
+			logger.Error("Failed to read script result", "error", err)
+			return nil, fmt.Errorf("script result: %v", err)
+		}
+	}
+	if opts.SkipsLoaded() {
+		alreadyLoaded, ok := row[0].(bool)
+		if !ok {
+			return nil, fmt.Errorf("unexpected already_loaded: %v", row[0])
+		}
+		if alreadyLoaded {
+			logger.Info("Skip source loaded by another event", "generation", generation)
+			return &LoadResult{Skipped: true, TotalBytesProcessed: result.TotalBytesProcessed}, nil
+		}
+		row = row[1:]
+	}
+	if opts.Tolerant() {
+		badRecords, ok := row[0].(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected bad_records: %v", row[0])
+		}
+		result.Rejected = int(badRecords)
+		result.SourceRejected = result.Rejected > opts.MaxBadRecords
+		if result.SourceRejected {
+			logger.Warn("Rejected source", "rejected", result.Rejected, "maxBadRecords", opts.MaxBadRecords)
+		} else if result.Rejected > 0 {
+			logger.Warn("Reject lines", "rejected", result.Rejected)
+		}
+	}
+	logger.Info("Loaded source", "totalBytesProcessed", result.TotalBytesProcessed)
+	return result, nil
+}
+
+func totalBytesProcessed(status common.BigQueryJobStatusHandle) int64 {
+	stats := status.Statistics()
+	if stats == nil {
+		return 0
+	}
+	return stats.TotalBytesProcessed
+}
+
+// loadParameters returns the parameters of the script that loads loadURI and
+// records srcFileId as loaded. loadURI differs from srcFileId when the source
+// file is staged.
+func loadParameters(loadURI string, srcFileId string, generation int64, opts LoadOptions) []bigquery.QueryParameter {
+	timeZone := opts.TimeZone
+	if timeZone == "" {
+		timeZone = DefaultTimeZone
+	}
+
+	clientIPMode := opts.ClientIPMode
+	if clientIPMode == "" {
+		clientIPMode = common.ClientIPModeRaw
+	}
+	return append([]bigquery.QueryParameter{
+		{
+			Name:  "source_uris",
+			Value: []string{loadURI},
+		},
+		{
+			Name:  "time_zone",
+			Value: timeZone,
+		},
+		{
+			Name:  "client_ip_mode",
+			Value: clientIPMode,
+		},
+	}, ledgerParameters(srcFileId, generation)...)
 }
@@ -2,14 +2,19 @@ package load2logs
 
 import (
 	"context"
+	"io"
 	"log"
+	"strings"
 	"testing"
 
 	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/common/go/schemata"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/api/iterator"
 )
 
 type MockBigqueryClient struct {
@@ -21,6 +26,11 @@ func (m *MockBigqueryClient) Query(q string) common.BigQueryQueryHandle {
 	return args.Get(0).(common.BigQueryQueryHandle)
 }
 
+func (m *MockBigqueryClient) Dataset(id string) common.BigQueryDatasetHandle {
+	args := m.Called(id)
+	return args.Get(0).(common.BigQueryDatasetHandle)
+}
+
 type MockBigQueryQueryHandle struct {
 	mock.Mock
 	Parameters []bigquery.QueryParameter
@@ -40,8 +50,17 @@ func (m *MockBigQueryQueryHandle) SetParameters(p []bigquery.QueryParameter) {
 	m.Parameters = p
 }
 
+func (m *MockBigQueryQueryHandle) SetDryRun(dryRun bool) {
+	m.Called(dryRun)
+}
+
+func (m *MockBigQueryQueryHandle) SetMaxBytesBilled(n int64) {
+	m.Called(n)
+}
+
 type MockBigQueryJobStatusHandle struct {
 	mock.Mock
+	Stats *bigquery.JobStatistics
 }
 
 func (m *MockBigQueryJobHandle) Wait(ctx context.Context) (common.BigQueryJobStatusHandle, error) {
@@ -49,22 +68,178 @@ func (m *MockBigQueryJobHandle) Wait(ctx context.Context) (common.BigQueryJobSta
 	return args.Get(0).(common.BigQueryJobStatusHandle), args.Error(1)
 }
 
+func (m *MockBigQueryJobHandle) Read(ctx context.Context) (common.BigQueryRowIterator, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(common.BigQueryRowIterator), args.Error(1)
+}
+
+func (m *MockBigQueryJobHandle) LastStatus() common.BigQueryJobStatusHandle {
+	args := m.Called()
+	return args.Get(0).(common.BigQueryJobStatusHandle)
+}
+
 func (m *MockBigQueryJobStatusHandle) Err() error {
 	args := m.Called()
 	return args.Error(0)
 }
 
+func (m *MockBigQueryJobStatusHandle) Statistics() *bigquery.JobStatistics {
+	return m.Stats
+}
+
+type MockBigQueryRowIterator struct {
+	mock.Mock
+	Rows [][]bigquery.Value
+}
+
+func (m *MockBigQueryRowIterator) Next(dst interface{}) error {
+	args := m.Called(dst)
+	if len(m.Rows) == 0 {
+		return iterator.Done
+	}
+	*dst.(*[]bigquery.Value) = m.Rows[0]
+	m.Rows = m.Rows[1:]
+	return args.Error(0)
+}
+
+type MockStorageClient struct {
+	mock.Mock
+}
+
+func (m *MockStorageClient) Bucket(name string) common.BucketHandle {
+	args := m.Called(name)
+	return args.Get(0).(common.BucketHandle)
+}
+
+type MockBucketHandle struct {
+	mock.Mock
+}
+
+func (m *MockBucketHandle) Object(name string) common.ObjectHandle {
+	args := m.Called(name)
+	return args.Get(0).(common.ObjectHandle)
+}
+
+func (m *MockBucketHandle) Objects(ctx context.Context, prefix string) common.ObjectIterator {
+	args := m.Called(ctx, prefix)
+	return args.Get(0).(common.ObjectIterator)
+}
+
+type MockObjectHandle struct {
+	mock.Mock
+}
+
+func (m *MockObjectHandle) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	args := m.Called(ctx)
+	// 文字列が指定された場合は呼び出しごとに新しい Reader を返す
+	if data, ok := args.Get(0).(string); ok {
+		return io.NopCloser(strings.NewReader(data)), args.Error(1)
+	}
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockObjectHandle) NewWriter(ctx context.Context) io.WriteCloser {
+	args := m.Called(ctx)
+	return args.Get(0).(io.WriteCloser)
+}
+
+func (m *MockObjectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	args := m.Called(ctx, offset, length)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockObjectHandle) Attrs(ctx context.Context) (*storage.ObjectAttrs, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(*storage.ObjectAttrs), args.Error(1)
+}
+
+func (m *MockObjectHandle) Delete(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+// newMockSourceObject returns a storage client that serves data as srcBucketName/srcPath.
+func newMockSourceObject(srcBucketName string, srcPath string, data string) *MockStorageClient {
+	mockStorageClient := new(MockStorageClient)
+	mockBucketHandle := new(MockBucketHandle)
+	mockObjectHandle := new(MockObjectHandle)
+
+	mockStorageClient.On("Bucket", srcBucketName).Return(mockBucketHandle)
+	mockBucketHandle.On("Object", srcPath).Return(mockObjectHandle)
+	mockObjectHandle.On("NewReader", mock.Anything).Return(data, nil)
+
+	return mockStorageClient
+}
+
+// testLogLine returns a line of the default layout.
+func testLogLine() string {
+	return "2024/01/08\t09:15:30\tHTTPS\t192.0.2.10\tsales\ttaro\t-\tProxied\t-\t200\twww.example.com\t35\t512\t2048\t-\ttext/html\tcategory\tbusiness\t-\t-\t-\thttps://www.example.com/\t-\t-\t-\n"
+}
+
 func TestConstructQuery(t *testing.T) {
 	datasetId := "dataset"
 	tableId := "table"
+	ledgerTableId := "ledger"
 	id := "uu-id"
+	opts := LoadOptions{
+		DatasetID:     datasetId,
+		TableID:       tableId,
+		LedgerTableID: ledgerTableId,
+	}
+	detected, err := schemata.DetectStagingLayout(testLogLine())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	layout := &SourceFile{DetectedLayout: detected}
 
-	query := ConstructQuery(datasetId, tableId, id)
+	query, err := ConstructQuery(opts, layout, id)
 	log.Printf("query: %v", query)
 
+	assert.NoError(t, err)
 	assert.Contains(t, query, "%Y/%m/%d")
 	assert.Contains(t, query, id)
 	assert.Contains(t, query, datasetId+"."+tableId+"`")
+	assert.Contains(t, query, "MERGE `"+datasetId+"."+ledgerTableId+"`")
+	assert.Contains(t, query, "COMMIT TRANSACTION")
+	// 台帳はトランザクションの中で、取り込む前に確かめる
+	checkIndex := strings.Index(query, "SET already_loaded = EXISTS(SELECT 1 FROM `"+datasetId+"."+ledgerTableId+"`")
+	assert.Greater(t, checkIndex, strings.Index(query, "BEGIN TRANSACTION;"))
+	assert.Less(t, checkIndex, strings.Index(query, "IF NOT already_loaded THEN\nINSERT INTO `"+datasetId+"."+tableId+"`"))
+	assert.True(t, strings.HasSuffix(query, "SELECT already_loaded;\nEND\n"))
+	assert.NotContains(t, query, "skip_leading_rows")
+
+	opts.LedgerTableID = ""
+	layout.HasHeader = true
+	query, err = ConstructQuery(opts, layout, id)
+	assert.NoError(t, err)
+	assert.NotContains(t, query, ledgerTableId)
+	assert.NotContains(t, query, "already_loaded")
+	assert.Contains(t, query, "skip_leading_rows = 1")
+	assert.NotContains(t, query, "rejected")
+
+	opts.MaxBadRecords = 10
+	opts.RejectedTableID = "rejected"
+	query, err = ConstructQuery(opts, layout, id)
+	assert.NoError(t, err)
+	assert.Contains(t, query, "BEGIN\nDECLARE bad_records INT64;\n")
+	assert.Contains(t, query, "CREATE TEMP TABLE checked_rows")
+	assert.Contains(t, query, "IF bad_records > 10 THEN")
+	assert.Contains(t, query, "FROM checked_rows\nWHERE _reason IS NULL;")
+	assert.Contains(t, query, "INSERT INTO `"+datasetId+".rejected`")
+	// 見出し行はステージングで除いてある
+	assert.NotContains(t, query, "skip_leading_rows")
+	assert.NotContains(t, query, "max_bad_records")
+	assert.NotContains(t, query, "compression")
+	assert.True(t, strings.HasSuffix(query, "SELECT bad_records;\nEND\n"))
+
+	layout.Compression = common.CompressionGzip
+	query, err = ConstructQuery(opts, layout, id)
+	assert.NoError(t, err)
+	assert.Contains(t, query, "compression = 'GZIP'")
+
+	layout.Compression = common.CompressionXz
+	_, err = ConstructQuery(opts, layout, id)
+	assert.ErrorContains(t, err, "cannot read xz")
 }
 
 func TestLoad2Bq(t *testing.T) {
@@ -73,33 +248,516 @@ func TestLoad2Bq(t *testing.T) {
 	srcBucketName := "src-bucket"
 	srcPath := "test.zip/test.tgz/test.csv"
 	srcFileId := "gs://" + srcBucketName + "/" + srcPath
-	datasetId := "dataset"
-	tableId := "table"
+	opts := LoadOptions{
+		DatasetID:     "dataset",
+		TableID:       "table",
+		LedgerTableID: "ledger",
+	}
 
 	// mocks
 	mockClient := new(MockBigqueryClient)
 	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
 	mockBigQueryJobHandle := new(MockBigQueryJobHandle)
 	mockBigQueryJobStatusHandle := new(MockBigQueryJobStatusHandle)
+	mockBigQueryRowIterator := &MockBigQueryRowIterator{
+		// 台帳の事前確認と、スクリプトの結果
+		Rows: [][]bigquery.Value{{int64(0)}, {false}},
+	}
 
 	mockClient.On("Query", mock.Anything).Return(mockBigQueryQueryHandle)
 	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
 	mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+	mockBigQueryJobHandle.On("Read", mock.Anything).Return(mockBigQueryRowIterator, nil)
 	mockBigQueryJobHandle.On("Wait", mock.Anything).Return(mockBigQueryJobStatusHandle, nil)
 	mockBigQueryJobStatusHandle.On("Err", mock.Anything).Return(nil)
+	mockBigQueryRowIterator.On("Next", mock.Anything).Return(nil)
+	mockStorageClient := newMockSourceObject(srcBucketName, srcPath, testLogLine())
 
 	// テストの実行
-	err := Load2Bq(ctx, mockClient, srcFileId, datasetId, tableId)
+	result, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
 
 	// 結果の検証
 	if !assert.NoError(t, err) {
 		t.Errorf("Load2Bq failed: %v", err)
 		t.FailNow()
 	}
+	assert.False(t, result.Skipped)
 
 	// モックが期待通りに呼ばれたことを検証
 	mockClient.AssertExpectations(t)
 	mockBigQueryQueryHandle.AssertExpectations(t)
 	mockBigQueryJobHandle.AssertExpectations(t)
 	mockBigQueryJobStatusHandle.AssertExpectations(t)
+	mockBigQueryRowIterator.AssertExpectations(t)
+}
+
+func TestLoad2BqDryRun(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.csv"
+	opts := LoadOptions{
+		DatasetID:      "dataset",
+		TableID:        "table",
+		DryRun:         true,
+		MaxBytesBilled: 1 << 30,
+	}
+
+	mockClient := new(MockBigqueryClient)
+	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+	mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+	mockBigQueryJobStatusHandle := &MockBigQueryJobStatusHandle{
+		Stats: &bigquery.JobStatistics{TotalBytesProcessed: 1024},
+	}
+	mockStorageClient := newMockSourceObject("src-bucket", "test.csv", testLogLine())
+
+	mockClient.On("Query", mock.Anything).Return(mockBigQueryQueryHandle)
+	mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+	mockBigQueryQueryHandle.On("SetDryRun", true).Return(nil)
+	mockBigQueryQueryHandle.On("SetMaxBytesBilled", int64(1<<30)).Return(nil)
+	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+	mockBigQueryJobHandle.On("LastStatus").Return(mockBigQueryJobStatusHandle)
+	mockBigQueryJobStatusHandle.On("Err").Return(nil)
+
+	result, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+
+	if assert.NoError(t, err) {
+		assert.True(t, result.DryRun)
+		assert.Equal(t, int64(1024), result.TotalBytesProcessed)
+	}
+	mockBigQueryQueryHandle.AssertExpectations(t)
+	// ドライランのジョブは待たない
+	mockBigQueryJobHandle.AssertNotCalled(t, "Wait", mock.Anything)
+}
+
+func TestLoad2BqStagesDecompressed(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.log.xz"
+	opts := LoadOptions{
+		DatasetID: "dataset",
+		TableID:   "table",
+	}
+
+	mockClient := new(MockBigqueryClient)
+	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+	mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+	mockBigQueryJobStatusHandle := new(MockBigQueryJobStatusHandle)
+	mockStorageClient := newMockSourceObject("src-bucket", "test.log.xz", xzString(t, testLogLine()))
+
+	// ステージングバケットがなければ読み込めない
+	_, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+	assert.ErrorContains(t, err, "needs a staging bucket")
+
+	mockStagingBucketHandle := new(MockBucketHandle)
+	mockStagedObjectHandle := new(MockObjectHandle)
+	mockStorageClient.On("Bucket", "staging").Return(mockStagingBucketHandle)
+	mockStagingBucketHandle.On("Object", "src-bucket/test.log.xz").Return(mockStagedObjectHandle)
+	mockStagedObjectHandle.On("NewWriter", mock.Anything).Return(new(bufferWriteCloser))
+	mockStagedObjectHandle.On("Delete", mock.Anything).Return(nil)
+	mockClient.On("Query", mock.MatchedBy(func(q string) bool {
+		return !strings.Contains(q, "compression")
+	})).Return(mockBigQueryQueryHandle)
+	mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+	mockBigQueryJobHandle.On("Wait", mock.Anything).Return(mockBigQueryJobStatusHandle, nil)
+	mockBigQueryJobStatusHandle.On("Err").Return(nil)
+
+	opts.StagingBucket = "staging"
+	_, err = Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gs://staging/src-bucket/test.log.xz"}, parameterValue(mockBigQueryQueryHandle.Parameters, "source_uris"))
+	// 台帳には元のファイルを記録する
+	assert.Equal(t, srcFileId, parameterValue(mockBigQueryQueryHandle.Parameters, "source_uri"))
+	// ジョブの後にステージングしたコピーを消す
+	mockStagedObjectHandle.AssertCalled(t, "Delete", mock.Anything)
+}
+
+func TestLoad2BqDryRunDoesNotStage(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.log.xz"
+	opts := LoadOptions{
+		DatasetID:     "dataset",
+		TableID:       "table",
+		DryRun:        true,
+		StagingBucket: "staging",
+	}
+
+	mockClient := new(MockBigqueryClient)
+	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+	mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+	mockBigQueryJobStatusHandle := new(MockBigQueryJobStatusHandle)
+	mockStorageClient := newMockSourceObject("src-bucket", "test.log.xz", xzString(t, testLogLine()))
+
+	mockClient.On("Query", mock.MatchedBy(func(q string) bool {
+		return !strings.Contains(q, "compression")
+	})).Return(mockBigQueryQueryHandle)
+	mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+	mockBigQueryQueryHandle.On("SetDryRun", true).Return(nil)
+	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+	mockBigQueryJobHandle.On("LastStatus").Return(mockBigQueryJobStatusHandle)
+	mockBigQueryJobStatusHandle.On("Err").Return(nil)
+
+	result, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+
+	if assert.NoError(t, err) {
+		assert.True(t, result.DryRun)
+	}
+	assert.Equal(t, []string{srcFileId}, parameterValue(mockBigQueryQueryHandle.Parameters, "source_uris"))
+	mockStorageClient.AssertNotCalled(t, "Bucket", "staging")
+}
+
+func TestLoad2BqSkipsLoadedSource(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.zip/test.tgz/test.csv"
+	opts := LoadOptions{
+		DatasetID:     "dataset",
+		TableID:       "table",
+		LedgerTableID: "ledger",
+	}
+
+	// mocks
+	mockClient := new(MockBigqueryClient)
+	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+	mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+	mockBigQueryRowIterator := &MockBigQueryRowIterator{
+		Rows: [][]bigquery.Value{{int64(1)}},
+	}
+
+	mockClient.On("Query", mock.MatchedBy(func(q string) bool {
+		return strings.HasPrefix(q, "SELECT COUNT(*)")
+	})).Return(mockBigQueryQueryHandle).Once()
+	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+	mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+	mockBigQueryJobHandle.On("Read", mock.Anything).Return(mockBigQueryRowIterator, nil)
+	mockBigQueryRowIterator.On("Next", mock.Anything).Return(nil)
+	mockStorageClient := new(MockStorageClient)
+
+	result, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+
+	assert.NoError(t, err)
+	assert.True(t, result.Skipped)
+
+	// 読み込み済みのためロード用のクエリは実行されない
+	mockClient.AssertExpectations(t)
+	mockBigQueryJobHandle.AssertNotCalled(t, "Wait", mock.Anything)
+	mockStorageClient.AssertNotCalled(t, "Bucket", mock.Anything)
+}
+
+func TestLoad2BqSkipsSourceLoadedConcurrently(t *testing.T) {
+	ctx := context.Background()
+
+	srcBucketName := "src-bucket"
+	srcPath := "test.csv"
+	srcFileId := "gs://" + srcBucketName + "/" + srcPath
+	opts := LoadOptions{
+		DatasetID:     "dataset",
+		TableID:       "table",
+		LedgerTableID: "ledger",
+	}
+
+	mockClient := new(MockBigqueryClient)
+	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+	mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+	mockBigQueryJobStatusHandle := new(MockBigQueryJobStatusHandle)
+	// 事前確認の後に別のイベントが読み込み、スクリプトの中で見つかる
+	mockBigQueryRowIterator := &MockBigQueryRowIterator{
+		Rows: [][]bigquery.Value{{int64(0)}, {true}},
+	}
+
+	mockClient.On("Query", mock.Anything).Return(mockBigQueryQueryHandle)
+	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+	mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+	mockBigQueryJobHandle.On("Read", mock.Anything).Return(mockBigQueryRowIterator, nil)
+	mockBigQueryJobHandle.On("Wait", mock.Anything).Return(mockBigQueryJobStatusHandle, nil)
+	mockBigQueryJobStatusHandle.On("Err", mock.Anything).Return(nil)
+	mockBigQueryRowIterator.On("Next", mock.Anything).Return(nil)
+	mockStorageClient := newMockSourceObject(srcBucketName, srcPath, testLogLine())
+
+	result, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+
+	if assert.NoError(t, err) {
+		assert.True(t, result.Skipped)
+	}
+	mockBigQueryJobHandle.AssertNumberOfCalls(t, "Read", 2)
+}
+
+func TestLoad2BqResolvesUnknownGeneration(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.csv"
+	opts := LoadOptions{
+		DatasetID:     "dataset",
+		TableID:       "table",
+		LedgerTableID: "ledger",
+	}
+
+	mockClient := new(MockBigqueryClient)
+	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+	mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+	mockBigQueryRowIterator := &MockBigQueryRowIterator{
+		Rows: [][]bigquery.Value{{int64(1)}},
+	}
+	mockStorageClient := new(MockStorageClient)
+	mockBucketHandle := new(MockBucketHandle)
+	mockObjectHandle := new(MockObjectHandle)
+
+	mockStorageClient.On("Bucket", "src-bucket").Return(mockBucketHandle)
+	mockBucketHandle.On("Object", "test.csv").Return(mockObjectHandle)
+	mockObjectHandle.On("Attrs", mock.Anything).Return(&storage.ObjectAttrs{Generation: 42}, nil)
+	mockClient.On("Query", mock.Anything).Return(mockBigQueryQueryHandle).Once()
+	// 台帳は 0 ではなく実際の世代で調べる
+	mockBigQueryQueryHandle.On("SetParameters", ledgerParameters(srcFileId, 42)).Return(nil)
+	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+	mockBigQueryJobHandle.On("Read", mock.Anything).Return(mockBigQueryRowIterator, nil)
+	mockBigQueryRowIterator.On("Next", mock.Anything).Return(nil)
+
+	result, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 0, opts)
+
+	assert.NoError(t, err)
+	assert.True(t, result.Skipped)
+	mockBigQueryQueryHandle.AssertExpectations(t)
+	mockObjectHandle.AssertExpectations(t)
+}
+
+func TestConstructQueryReplace(t *testing.T) {
+	opts := LoadOptions{
+		DatasetID: "dataset",
+		TableID:   "table",
+		Mode:      LoadModeReplace,
+	}
+	layout, err := schemata.DetectStagingLayout(testLogLine())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	query, err := ConstructQuery(opts, &SourceFile{DetectedLayout: layout}, "uu-id")
+
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(query, "BEGIN\nDECLARE replace_start, replace_end DATE;\nCREATE TABLE"))
+	deleteIndex := strings.Index(query, "DELETE FROM `dataset.table` WHERE request_time >= TIMESTAMP(replace_start, @time_zone) AND request_time < TIMESTAMP(DATE_ADD(replace_end, INTERVAL 1 DAY), @time_zone);")
+	// 削除と挿入は同じトランザクションで行う
+	assert.Greater(t, deleteIndex, strings.Index(query, "BEGIN TRANSACTION;"))
+	assert.Less(t, deleteIndex, strings.Index(query, "INSERT INTO `dataset.table`"))
+}
+
+func TestLoad2BqReplaceIgnoresLedger(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.csv"
+	opts := LoadOptions{
+		DatasetID:     "dataset",
+		TableID:       "table",
+		LedgerTableID: "ledger",
+		Mode:          LoadModeReplace,
+	}
+
+	mockClient := new(MockBigqueryClient)
+	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+	mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+	mockBigQueryJobStatusHandle := new(MockBigQueryJobStatusHandle)
+	mockStorageClient := newMockSourceObject("src-bucket", "test.csv", testLogLine())
+
+	mockClient.On("Query", mock.MatchedBy(func(q string) bool {
+		return strings.Contains(q, "DELETE FROM `dataset.table`") && strings.Contains(q, "MERGE `dataset.ledger`") && !strings.Contains(q, "already_loaded")
+	})).Return(mockBigQueryQueryHandle).Once()
+	mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+	mockBigQueryJobHandle.On("Wait", mock.Anything).Return(mockBigQueryJobStatusHandle, nil)
+	mockBigQueryJobStatusHandle.On("Err").Return(nil)
+
+	result, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+
+	if assert.NoError(t, err) {
+		assert.False(t, result.Skipped)
+	}
+	// 台帳は確認しない
+	mockClient.AssertExpectations(t)
+	mockBigQueryJobHandle.AssertNotCalled(t, "Read", mock.Anything)
+}
+
+func TestLoad2BqUnknownLayout(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.csv"
+	opts := LoadOptions{
+		DatasetID: "dataset",
+		TableID:   "table",
+	}
+
+	mockClient := new(MockBigqueryClient)
+	mockStorageClient := newMockSourceObject("src-bucket", "test.csv", "a\tb\tc\n")
+
+	_, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown log format")
+	}
+	mockClient.AssertNotCalled(t, "Query", mock.Anything)
+}
+
+func TestNewEnvConfigTimeZone(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("DATASET_ID", "dataset")
+	t.Setenv("TABLE_ID", "table")
+	t.Setenv("TIME_ZONE", "")
+	t.Setenv("TIME_ZONE_OVERRIDES", "utc/=UTC")
+
+	config, err := NewEnvConfig()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, DefaultTimeZone, config.LoadOptions("tokyo/test.csv").TimeZone)
+	assert.Equal(t, "UTC", config.LoadOptions("utc/test.csv").TimeZone)
+
+	t.Setenv("TIME_ZONE", "Asia/Tokio")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "TIME_ZONE")
+
+	t.Setenv("TIME_ZONE", "UTC")
+	t.Setenv("TIME_ZONE_OVERRIDES", "utc/=Mars/Olympus")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "TIME_ZONE_OVERRIDES: utc/")
+
+	// BigQuery は Local を受け付けない
+	t.Setenv("TIME_ZONE", "Local")
+	t.Setenv("TIME_ZONE_OVERRIDES", "")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "TIME_ZONE")
+
+	t.Setenv("TIME_ZONE", "UTC")
+	t.Setenv("TIME_ZONE_OVERRIDES", "utc/=Local")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "TIME_ZONE_OVERRIDES: utc/")
+}
+
+func parameterValue(params []bigquery.QueryParameter, name string) interface{} {
+	for _, p := range params {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return nil
+}
+
+func TestLoadParametersTimeZone(t *testing.T) {
+	assert.Equal(t, DefaultTimeZone, parameterValue(loadParameters("gs://src-bucket/test.csv", "gs://src-bucket/test.csv", 1, LoadOptions{}), "time_zone"))
+	assert.Equal(t, "UTC", parameterValue(loadParameters("gs://src-bucket/test.csv", "gs://src-bucket/test.csv", 1, LoadOptions{TimeZone: "UTC"}), "time_zone"))
+}
+
+func TestLoadParametersClientIP(t *testing.T) {
+	params := loadParameters("gs://src-bucket/test.csv", "gs://src-bucket/test.csv", 1, LoadOptions{})
+	assert.Equal(t, common.ClientIPModeRaw, parameterValue(params, "client_ip_mode"))
+
+	params = loadParameters("gs://src-bucket/test.csv", "gs://src-bucket/test.csv", 1, LoadOptions{ClientIPMode: common.ClientIPModeHMAC, ClientIPKey: []byte("secret")})
+	assert.Equal(t, common.ClientIPModeHMAC, parameterValue(params, "client_ip_mode"))
+	// 鍵の情報はジョブのメタデータに残るパラメータに含めない
+	for _, param := range params {
+		assert.NotContains(t, param.Name, "hmac")
+	}
+}
+
+func TestNewEnvConfigClientIP(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("DATASET_ID", "dataset")
+	t.Setenv("TABLE_ID", "table")
+	t.Setenv("CLIENT_IP_MODE", "")
+	t.Setenv("CLIENT_IP_HMAC_KEY", "")
+	t.Setenv("STAGING_BUCKET", "")
+
+	config, err := NewEnvConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, common.ClientIPModeRaw, config.ClientIPMode)
+	}
+
+	t.Setenv("CLIENT_IP_MODE", "hash")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "CLIENT_IP_MODE")
+
+	t.Setenv("CLIENT_IP_MODE", common.ClientIPModeHMAC)
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "CLIENT_IP_HMAC_KEY")
+
+	t.Setenv("CLIENT_IP_HMAC_KEY", "secret")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "STAGING_BUCKET")
+
+	t.Setenv("STAGING_BUCKET", "staging")
+	config, err = NewEnvConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("secret"), config.LoadOptions("test.csv").ClientIPKey)
+	}
+}
+
+func TestNewEnvConfigLoadMode(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("DATASET_ID", "dataset")
+	t.Setenv("TABLE_ID", "table")
+	t.Setenv("LOAD_MODE", "")
+
+	config, err := NewEnvConfig()
+	if assert.NoError(t, err) {
+		assert.False(t, config.LoadOptions("test.csv").Replace())
+	}
+
+	t.Setenv("LOAD_MODE", LoadModeReplace)
+	config, err = NewEnvConfig()
+	if assert.NoError(t, err) {
+		assert.True(t, config.LoadOptions("test.csv").Replace())
+	}
+
+	t.Setenv("LOAD_MODE", "merge")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "LOAD_MODE")
+}
+
+func TestNewEnvConfigMaxBytesBilled(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("DATASET_ID", "dataset")
+	t.Setenv("TABLE_ID", "table")
+
+	t.Setenv("MAX_BYTES_BILLED", "10485760")
+	config, err := NewEnvConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(10485760), config.LoadOptions("test.csv").MaxBytesBilled)
+	}
+
+	t.Setenv("MAX_BYTES_BILLED", "10MB")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "MAX_BYTES_BILLED")
+}
+
+func TestNewEnvConfigMaxBadRecords(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("DATASET_ID", "dataset")
+	t.Setenv("TABLE_ID", "table")
+	t.Setenv("STAGING_BUCKET", "")
+
+	// 寛容モードはステージングしたコピーで行番号を付ける
+	t.Setenv("MAX_BAD_RECORDS", "10")
+	_, err := NewEnvConfig()
+	assert.ErrorContains(t, err, "STAGING_BUCKET")
+
+	t.Setenv("STAGING_BUCKET", "staging")
+	config, err := NewEnvConfig()
+	if assert.NoError(t, err) {
+		assert.True(t, config.LoadOptions("test.csv").Tolerant())
+	}
+}
+
+func TestNewEnvConfigListsEveryError(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("DATASET_ID", "")
+	t.Setenv("TABLE_ID", "")
+	t.Setenv("MAX_BAD_RECORDS", "-1")
+	t.Setenv("LOAD_MODE", "merge")
+
+	_, err := NewEnvConfig()
+
+	assert.ErrorContains(t, err, "DATASET_ID: not set")
+	assert.ErrorContains(t, err, "TABLE_ID: not set")
+	assert.ErrorContains(t, err, "MAX_BAD_RECORDS: must be at least 0")
+	assert.ErrorContains(t, err, "LOAD_MODE")
 }
@@ -0,0 +1,39 @@
+package load2logs
+
+import (
+	"fmt"
+
+	"github.com/takotakot/iswf_log_to_bq/common/go/schemata"
+)
+
+const (
+	defaultRejectedTableID = "logs_rejected"
+	// maxRejectedLineLength bounds the number of characters of a line kept in
+	// the rejected table.
+	maxRejectedLineLength = 4 * 1024
+)
+
+// RejectOverBudgetStatement returns the statements that count the lines of
+// schemata.CheckedRowsTable that cannot be loaded into the script variable
+// bad_records and, when there are more than maxBadRecords, reject the whole
+// source: no line is loaded and the reason of every bad line says why. The
+// source is recorded as loaded either way, since failing the load would only
+// have it retried.
+func RejectOverBudgetStatement(maxBadRecords int) string {
+	return fmt.Sprintf(`SET bad_records = (SELECT COUNTIF(%[2]s IS NOT NULL) FROM %[1]s);
+IF bad_records > %[3]d THEN
+UPDATE %[1]s SET %[2]s = FORMAT('%%s (source rejected: %%d bad records exceed %[3]d)', %[2]s, bad_records) WHERE %[2]s IS NOT NULL;
+DELETE FROM %[1]s WHERE %[2]s IS NULL;
+END IF;
+`, schemata.CheckedRowsTable, schemata.CheckedReasonColumn, maxBadRecords)
+}
+
+// RejectedRecordStatement returns the statement that writes the lines of
+// schemata.CheckedRowsTable that cannot be loaded to the rejected table, with
+// the line numbers given by LineNumberer. The lines are split by the same
+// predicate as schemata.InsertCheckedRows, so every line is either loaded or
+// rejected.
+func RejectedRecordStatement(datasetId string, tableId string) string {
+	return fmt.Sprintf("INSERT INTO `%s.%s` (source_uri, generation, line_number, line, reason, rejected_at)\nSELECT @source_uri, @generation, %s, LEFT(%s, %d), %s, CURRENT_TIMESTAMP() FROM %s WHERE %s IS NOT NULL;\n",
+		datasetId, tableId, schemata.CheckedLineNumberColumn, schemata.CheckedLineColumn, maxRejectedLineLength, schemata.CheckedReasonColumn, schemata.CheckedRowsTable, schemata.CheckedReasonColumn)
+}
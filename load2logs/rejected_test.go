@@ -0,0 +1,136 @@
+package load2logs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRejectedStatements(t *testing.T) {
+	statement := RejectOverBudgetStatement(10)
+	assert.Contains(t, statement, "SET bad_records = (SELECT COUNTIF(_reason IS NOT NULL) FROM checked_rows);")
+	assert.Contains(t, statement, "IF bad_records > 10 THEN")
+	assert.Contains(t, statement, "FORMAT('%s (source rejected: %d bad records exceed 10)', _reason, bad_records)")
+	assert.Contains(t, statement, "DELETE FROM checked_rows WHERE _reason IS NULL;")
+
+	statement = RejectedRecordStatement("dataset", "rejected")
+	assert.Contains(t, statement, "INSERT INTO `dataset.rejected`")
+	assert.Contains(t, statement, "SELECT @source_uri, @generation, _line_number, LEFT(_line, 4096)")
+	assert.Contains(t, statement, "FROM checked_rows WHERE _reason IS NOT NULL;")
+}
+
+func TestLoad2BqTolerant(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.csv"
+	opts := LoadOptions{
+		DatasetID:       "dataset",
+		TableID:         "table",
+		MaxBadRecords:   5,
+		RejectedTableID: "rejected",
+		StagingBucket:   "staging",
+	}
+
+	for _, tc := range []struct {
+		name           string
+		badRecords     int64
+		sourceRejected bool
+	}{
+		{name: "within budget", badRecords: 1},
+		{name: "over budget", badRecords: 6, sourceRejected: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockClient := new(MockBigqueryClient)
+			mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+			mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+			mockBigQueryJobStatusHandle := new(MockBigQueryJobStatusHandle)
+			mockBigQueryRowIterator := &MockBigQueryRowIterator{
+				Rows: [][]bigquery.Value{{tc.badRecords}},
+			}
+			mockStorageClient := newMockSourceObject("src-bucket", "test.csv", testLogLine()+"a\tb\n")
+			mockStagingBucketHandle := new(MockBucketHandle)
+			mockStagedObjectHandle := new(MockObjectHandle)
+			staged := new(bufferWriteCloser)
+			mockStorageClient.On("Bucket", "staging").Return(mockStagingBucketHandle)
+			mockStagingBucketHandle.On("Object", "src-bucket/test.csv").Return(mockStagedObjectHandle)
+			mockStagedObjectHandle.On("NewWriter", mock.Anything).Return(staged)
+			mockStagedObjectHandle.On("Delete", mock.Anything).Return(nil)
+
+			mockClient.On("Query", mock.MatchedBy(func(q string) bool {
+				return strings.Contains(q, "CREATE TEMP TABLE checked_rows") && strings.HasSuffix(q, "SELECT bad_records;\nEND\n")
+			})).Return(mockBigQueryQueryHandle)
+			mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+			mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+			mockBigQueryJobHandle.On("Wait", mock.Anything).Return(mockBigQueryJobStatusHandle, nil)
+			mockBigQueryJobHandle.On("Read", mock.Anything).Return(mockBigQueryRowIterator, nil)
+			mockBigQueryJobStatusHandle.On("Err").Return(nil)
+			mockBigQueryRowIterator.On("Next", mock.Anything).Return(nil)
+
+			result, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+
+			// 予算を超えたファイルもイベントを失敗させない
+			if assert.NoError(t, err) {
+				assert.Equal(t, int(tc.badRecords), result.Rejected)
+				assert.Equal(t, tc.sourceRejected, result.SourceRejected)
+			}
+			// 拒否した行の行番号のため、行番号を付けてステージングしたコピーを読み込む
+			assert.Equal(t, []string{"gs://staging/src-bucket/test.csv"}, parameterValue(mockBigQueryQueryHandle.Parameters, "source_uris"))
+			assert.Equal(t, "1\x1f\x1f"+testLogLine()+"2\x1f\x1fa\tb\n", staged.String())
+			mockClient.AssertExpectations(t)
+		})
+	}
+}
+
+func TestLoad2BqTolerantRejectsUnknownFirstLine(t *testing.T) {
+	ctx := context.Background()
+
+	srcFileId := "gs://src-bucket/test.csv"
+	opts := LoadOptions{
+		DatasetID:       "dataset",
+		TableID:         "table",
+		MaxBadRecords:   5,
+		RejectedTableID: "rejected",
+	}
+
+	mockClient := new(MockBigqueryClient)
+	mockBigQueryQueryHandle := new(MockBigQueryQueryHandle)
+	mockBigQueryJobHandle := new(MockBigQueryJobHandle)
+	mockBigQueryJobStatusHandle := new(MockBigQueryJobStatusHandle)
+	mockBigQueryRowIterator := &MockBigQueryRowIterator{
+		Rows: [][]bigquery.Value{{int64(1)}},
+	}
+	mockStorageClient := newMockSourceObject("src-bucket", "test.csv", "a\tb\n"+testLogLine())
+
+	// ステージングバケットがなければ行番号を付けられない
+	_, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+	assert.ErrorContains(t, err, "needs a staging bucket")
+
+	mockStagingBucketHandle := new(MockBucketHandle)
+	mockStagedObjectHandle := new(MockObjectHandle)
+	staged := new(bufferWriteCloser)
+	mockStorageClient.On("Bucket", "staging").Return(mockStagingBucketHandle)
+	mockStagingBucketHandle.On("Object", "src-bucket/test.csv").Return(mockStagedObjectHandle)
+	mockStagedObjectHandle.On("NewWriter", mock.Anything).Return(staged)
+	mockStagedObjectHandle.On("Delete", mock.Anything).Return(nil)
+	mockClient.On("Query", mock.Anything).Return(mockBigQueryQueryHandle)
+	mockBigQueryQueryHandle.On("SetParameters", mock.Anything).Return(nil)
+	mockBigQueryQueryHandle.On("Run", mock.Anything).Return(mockBigQueryJobHandle, nil)
+	mockBigQueryJobHandle.On("Wait", mock.Anything).Return(mockBigQueryJobStatusHandle, nil)
+	mockBigQueryJobHandle.On("Read", mock.Anything).Return(mockBigQueryRowIterator, nil)
+	mockBigQueryJobStatusHandle.On("Err").Return(nil)
+	mockBigQueryRowIterator.On("Next", mock.Anything).Return(nil)
+
+	opts.StagingBucket = "staging"
+	result, err := Load2Bq(ctx, mockClient, mockStorageClient, srcFileId, 1, opts)
+
+	// 先頭行の形式が分からなくても、その行を拒否して残りを読み込む
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, result.Rejected)
+		assert.False(t, result.SourceRejected)
+	}
+	assert.Equal(t, "1\x1funknown log format: no layout has 2 columns\x1fa\tb\n2\x1f\x1f"+testLogLine(), staged.String())
+}
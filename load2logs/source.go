@@ -0,0 +1,309 @@
+package load2logs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/common/go/schemata"
+)
+
+const (
+	// maxFirstLineLength bounds how much of a source file is read to detect its layout.
+	maxFirstLineLength = 64 * 1024
+	// maxStagedLineLength bounds the lines that StageSource rewrites.
+	maxStagedLineLength = 1 << 20
+	// redactedLine replaces the content of the lines rejected by LineNumberer
+	// when the client IPs are pseudonymized, as they cannot be found in a line
+	// of unknown layout.
+	redactedLine = "(redacted: client IPs cannot be pseudonymized in a line of unknown layout)"
+)
+
+// SplitSourceURI splits a gs://bucket/name URI into the bucket and object names.
+func SplitSourceURI(srcFileId string) (string, string, error) {
+	rest, ok := strings.CutPrefix(srcFileId, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf("not a gs:// URI: %s", srcFileId)
+	}
+	bucket, name, ok := strings.Cut(rest, "/")
+	if !ok || bucket == "" || name == "" {
+		return "", "", fmt.Errorf("no object name in URI: %s", srcFileId)
+	}
+	return bucket, name, nil
+}
+
+// SourceFile describes a source file to load.
+type SourceFile struct {
+	*schemata.DetectedLayout
+	// Compression is the compression of the file that LOAD DATA reads,
+	// common.CompressionNone or common.CompressionGzip.
+	Compression string
+	// LeadingRejects are why the layout could not be detected from each of
+	// the leading lines, which DetectTolerantSource rejects.
+	LeadingRejects []string
+	// Undetected is true when DetectTolerantSource found no line of a known
+	// layout. Every line is then rejected, and DetectedLayout is the default
+	// layout only to build the script.
+	Undetected bool
+}
+
+// nativeCompression reports whether LOAD DATA reads the compression natively.
+func nativeCompression(compression string) bool {
+	return compression == common.CompressionNone || compression == common.CompressionGzip
+}
+
+// OpenSource returns the decompressed content of the source file and the
+// detected compression.
+func OpenSource(ctx context.Context, storageClient common.StorageClient, srcFileId string) (io.ReadCloser, string, error) {
+	bucket, name, err := SplitSourceURI(srcFileId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	reader, err := storageClient.Bucket(bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("NewReader: %v", err)
+	}
+
+	decompressed, compression, err := common.OpenDecompressed(reader)
+	if err != nil {
+		reader.Close()
+		return nil, "", fmt.Errorf("OpenDecompressed: %v", err)
+	}
+	return &sourceReader{ReadCloser: decompressed, object: reader}, compression, nil
+}
+
+// sourceReader closes the object reader with the decompressor.
+type sourceReader struct {
+	io.ReadCloser
+	object io.Closer
+}
+
+func (r *sourceReader) Close() error {
+	return errors.Join(r.ReadCloser.Close(), r.object.Close())
+}
+
+// DetectSource reads the first line of the source file and returns the
+// matching layout from the schemata registry, with the compression of the
+// file.
+func DetectSource(ctx context.Context, storageClient common.StorageClient, srcFileId string) (*SourceFile, error) {
+	reader, compression, err := OpenSource(ctx, storageClient, srcFileId)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	line, err := bufio.NewReaderSize(reader, maxFirstLineLength).ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("first line of %s is longer than %d bytes", srcFileId, maxFirstLineLength)
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("ReadSlice: %v", err)
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%s is empty", srcFileId)
+	}
+
+	layout, err := schemata.DetectStagingLayout(string(line))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", srcFileId, err)
+	}
+	return &SourceFile{DetectedLayout: layout, Compression: compression}, nil
+}
+
+// DetectTolerantSource is DetectSource for the tolerant mode. Instead of
+// failing every retry of the load, the leading lines whose layout cannot be
+// detected are listed in SourceFile.LeadingRejects, up to one more than
+// maxBadRecords, which is enough to reject the whole source. The source is
+// Undetected when none of them has a known layout.
+func DetectTolerantSource(ctx context.Context, storageClient common.StorageClient, srcFileId string, maxBadRecords int) (*SourceFile, error) {
+	reader, compression, err := OpenSource(ctx, storageClient, srcFileId)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	br := bufio.NewReaderSize(reader, maxFirstLineLength)
+	var rejects []string
+	for len(rejects) <= maxBadRecords {
+		line, err := br.ReadSlice('\n')
+		if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("ReadSlice: %v", err)
+		}
+		if len(line) == 0 {
+			break
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// 行の残りを読み飛ばし、StageSource と同じ行番号を保つ
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = br.ReadSlice('\n')
+			}
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("ReadSlice: %v", err)
+			}
+			rejects = append(rejects, fmt.Sprintf("line is longer than %d bytes", maxFirstLineLength))
+			continue
+		}
+
+		layout, detectErr := schemata.DetectStagingLayout(string(line))
+		if detectErr == nil {
+			return &SourceFile{DetectedLayout: layout, Compression: compression, LeadingRejects: rejects}, nil
+		}
+		rejects = append(rejects, detectErr.Error())
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(rejects) == 0 {
+		return nil, fmt.Errorf("%s is empty", srcFileId)
+	}
+
+	staging, err := schemata.Staging()
+	if err != nil {
+		return nil, fmt.Errorf("schemata: %v", err)
+	}
+	return &SourceFile{DetectedLayout: &schemata.DetectedLayout{StagingLayout: staging}, Compression: compression, LeadingRejects: rejects, Undetected: true}, nil
+}
+
+// LineNumberer returns the rewrite of StageSource for the tolerant mode. It
+// writes every line of source with schemata.AppendNumberedLine, so that the
+// load script knows the line numbers. The lines of source.LeadingRejects,
+// or every line when source is Undetected, are rejected with the reason. The
+// header line and blank lines are dropped, and the other lines are passed
+// through rewrite, if it is not nil. The content of the rejected lines is
+// replaced when redact is true, as rewrite cannot pseudonymize them.
+func LineNumberer(source *SourceFile, rewrite func(line []byte) []byte, redact bool) func(line []byte) []byte {
+	number := 0
+	return func(line []byte) []byte {
+		number++
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return nil
+		}
+
+		reason := ""
+		switch {
+		case number <= len(source.LeadingRejects):
+			reason = source.LeadingRejects[number-1]
+		case source.Undetected:
+			reason = fmt.Sprintf("no known layout in the first %d lines", len(source.LeadingRejects))
+		case source.HasHeader && number == len(source.LeadingRejects)+1:
+			return nil
+		}
+
+		switch {
+		case reason != "" && redact:
+			line = []byte(redactedLine)
+		case reason == "" && rewrite != nil:
+			line = rewrite(line)
+		}
+		return schemata.AppendNumberedLine(nil, number, reason, line)
+	}
+}
+
+// StageDecompressed writes the decompressed content of the source file to
+// the staging bucket under the same path, and returns the URI of the staged
+// object. It is for the compressions that LOAD DATA cannot read.
+func StageDecompressed(ctx context.Context, storageClient common.StorageClient, srcFileId string, stagingBucket string) (string, error) {
+	return StageSource(ctx, storageClient, srcFileId, stagingBucket, nil)
+}
+
+// StageSource is StageDecompressed that also passes every line through
+// rewrite, if it is not nil.
+func StageSource(ctx context.Context, storageClient common.StorageClient, srcFileId string, stagingBucket string, rewrite func(line []byte) []byte) (string, error) {
+	bucket, name, err := SplitSourceURI(srcFileId)
+	if err != nil {
+		return "", err
+	}
+
+	reader, _, err := OpenSource(ctx, storageClient, srcFileId)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	var r io.Reader = reader
+	if rewrite != nil {
+		r = &rewriteReader{r: bufio.NewReaderSize(reader, maxStagedLineLength), rewrite: rewrite}
+	}
+	stagedName := path.Join(bucket, name)
+	if _, err := common.WriteObject(ctx, storageClient.Bucket(stagingBucket).Object(stagedName), stagedName, r); err != nil {
+		return "", err
+	}
+
+	return "gs://" + stagingBucket + "/" + stagedName, nil
+}
+
+// DeleteStaged deletes the object staged by StageSource at stagedURI. An
+// object that no longer exists is not an error.
+func DeleteStaged(ctx context.Context, storageClient common.StorageClient, stagedURI string) error {
+	bucket, name, err := SplitSourceURI(stagedURI)
+	if err != nil {
+		return err
+	}
+	if err := storageClient.Bucket(bucket).Object(name).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("Delete: %v", err)
+	}
+	return nil
+}
+
+// rewriteReader reads the lines of r passed through rewrite.
+type rewriteReader struct {
+	r       *bufio.Reader
+	rewrite func(line []byte) []byte
+	line    []byte
+	err     error
+}
+
+func (r *rewriteReader) Read(p []byte) (int, error) {
+	for len(r.line) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		line, err := r.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = fmt.Errorf("line longer than %d bytes", maxStagedLineLength)
+			line = nil
+		}
+		if len(line) > 0 {
+			r.line = r.rewrite(line)
+		}
+		r.err = err
+	}
+	n := copy(p, r.line)
+	r.line = r.line[n:]
+	return n, nil
+}
+
+// ClientIPPseudonymizer returns the rewrite of StageSource that replaces the
+// client IPs in the lines of layout with common.PseudonymizeClientIP, so that
+// the HMAC key is never sent to BigQuery. "-", which the load script reads
+// as NULL, and the header line are kept as is.
+func ClientIPPseudonymizer(layout *schemata.DetectedLayout, key []byte) (func(line []byte) []byte, error) {
+	column := slices.Index(layout.ColumnNames(), "client_ip")
+	if column < 0 {
+		return nil, fmt.Errorf("layout %s has no client_ip column", layout.Version)
+	}
+
+	header := layout.HasHeader
+	return func(line []byte) []byte {
+		if header {
+			header = false
+			return line
+		}
+		body := bytes.TrimRight(line, "\r\n")
+		fields := bytes.Split(body, []byte{'\t'})
+		if column >= len(fields) || len(fields[column]) == 0 || string(fields[column]) == "-" {
+			return line
+		}
+		fields[column] = []byte(common.PseudonymizeClientIP(key, string(fields[column])))
+		return append(bytes.Join(fields, []byte{'\t'}), line[len(body):]...)
+	}, nil
+}
@@ -0,0 +1,221 @@
+package load2logs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"testing"
+
+	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/common/go/schemata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/ulikunitz/xz"
+)
+
+// bufferWriteCloser keeps what is written to an object.
+type bufferWriteCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferWriteCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func gzipString(t *testing.T, s string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func xzString(t *testing.T, s string) string {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(s))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestSplitSourceURI(t *testing.T) {
+	bucket, name, err := SplitSourceURI("gs://src-bucket/test.zip/test.tgz/test.csv")
+	assert.NoError(t, err)
+	assert.Equal(t, "src-bucket", bucket)
+	assert.Equal(t, "test.zip/test.tgz/test.csv", name)
+
+	for _, uri := range []string{"src-bucket/test.csv", "gs://src-bucket", "gs://src-bucket/", "gs:///test.csv"} {
+		_, _, err := SplitSourceURI(uri)
+		assert.Error(t, err, uri)
+	}
+}
+
+func TestDetectSource(t *testing.T) {
+	ctx := context.Background()
+
+	mockStorageClient := newMockSourceObject("src-bucket", "test.csv", testLogLine()+testLogLine())
+
+	layout, err := DetectSource(ctx, mockStorageClient, "gs://src-bucket/test.csv")
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "v1", layout.Version)
+		assert.False(t, layout.HasHeader)
+		assert.Equal(t, common.CompressionNone, layout.Compression)
+	}
+	mockStorageClient.AssertExpectations(t)
+}
+
+func TestDetectSourceEmpty(t *testing.T) {
+	ctx := context.Background()
+
+	mockStorageClient := newMockSourceObject("src-bucket", "test.csv", "")
+
+	_, err := DetectSource(ctx, mockStorageClient, "gs://src-bucket/test.csv")
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is empty")
+	}
+}
+
+func TestDetectSourceGzip(t *testing.T) {
+	ctx := context.Background()
+
+	mockStorageClient := newMockSourceObject("src-bucket", "test.log.gz", gzipString(t, testLogLine()))
+
+	layout, err := DetectSource(ctx, mockStorageClient, "gs://src-bucket/test.log.gz")
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "v1", layout.Version)
+		assert.Equal(t, common.CompressionGzip, layout.Compression)
+	}
+}
+
+func TestDetectTolerantSource(t *testing.T) {
+	ctx := context.Background()
+
+	header := "#" + strings.Join(v1Layout(t).ColumnNames(), "\t") + "\n"
+	mockStorageClient := newMockSourceObject("src-bucket", "test.csv", "a\tb\n"+header+testLogLine())
+
+	layout, err := DetectTolerantSource(ctx, mockStorageClient, "gs://src-bucket/test.csv", 5)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "v1", layout.Version)
+		assert.True(t, layout.HasHeader)
+		assert.Equal(t, []string{"unknown log format: no layout has 2 columns"}, layout.LeadingRejects)
+		assert.False(t, layout.Undetected)
+	}
+}
+
+func TestDetectTolerantSourceUndetected(t *testing.T) {
+	ctx := context.Background()
+
+	// 長すぎる行も形式が分からない行として数える
+	long := strings.Repeat("x", maxFirstLineLength+1) + "\n"
+	mockStorageClient := newMockSourceObject("src-bucket", "test.csv", long+"a\tb\n"+"c\n"+testLogLine())
+
+	layout, err := DetectTolerantSource(ctx, mockStorageClient, "gs://src-bucket/test.csv", 2)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			"line is longer than 65536 bytes",
+			"unknown log format: no layout has 2 columns",
+			"unknown log format: no layout has 1 columns",
+		}, layout.LeadingRejects)
+		assert.True(t, layout.Undetected)
+		assert.NotNil(t, layout.DetectedLayout)
+	}
+
+	mockStorageClient = newMockSourceObject("src-bucket", "test.csv", "")
+	_, err = DetectTolerantSource(ctx, mockStorageClient, "gs://src-bucket/test.csv", 2)
+	assert.ErrorContains(t, err, "is empty")
+}
+
+func TestLineNumberer(t *testing.T) {
+	header := "#" + strings.Join(v1Layout(t).ColumnNames(), "\t") + "\n"
+	source := &SourceFile{
+		DetectedLayout: &schemata.DetectedLayout{StagingLayout: v1Layout(t), HasHeader: true},
+		LeadingRejects: []string{"unknown log format"},
+	}
+	upper := func(line []byte) []byte { return bytes.ToUpper(line) }
+
+	var staged []byte
+	number := LineNumberer(source, upper, false)
+	for _, line := range []string{"a\tb\n", header, "x\n", "\r\n", "y\x1fz\n"} {
+		staged = append(staged, number([]byte(line))...)
+	}
+	// 見出し行と空行は除き、行番号は元のファイルのものを使う
+	assert.Equal(t, "1\x1funknown log format\x1fa\tb\n3\x1f\x1fX\n5\x1fline contains U+001F\x1fY\ufffdZ\n", string(staged))
+
+	// 仮名化できない行は内容を残さない
+	source.Undetected = true
+	staged = nil
+	number = LineNumberer(source, upper, true)
+	for _, line := range []string{"192.0.2.10\n", "x\n"} {
+		staged = append(staged, number([]byte(line))...)
+	}
+	assert.Equal(t, "1\x1funknown log format\x1f"+redactedLine+"\n2\x1fno known layout in the first 1 lines\x1f"+redactedLine+"\n", string(staged))
+}
+
+func TestStageDecompressed(t *testing.T) {
+	ctx := context.Background()
+
+	mockStorageClient := newMockSourceObject("src-bucket", "test.log.xz", xzString(t, testLogLine()))
+	mockStagingBucketHandle := new(MockBucketHandle)
+	mockStagedObjectHandle := new(MockObjectHandle)
+	staged := new(bufferWriteCloser)
+	mockStorageClient.On("Bucket", "staging").Return(mockStagingBucketHandle)
+	mockStagingBucketHandle.On("Object", "src-bucket/test.log.xz").Return(mockStagedObjectHandle)
+	mockStagedObjectHandle.On("NewWriter", mock.Anything).Return(staged)
+
+	uri, err := StageDecompressed(ctx, mockStorageClient, "gs://src-bucket/test.log.xz", "staging")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "gs://staging/src-bucket/test.log.xz", uri)
+	assert.Equal(t, testLogLine(), staged.String())
+	assert.True(t, staged.closed)
+}
+
+func TestStageSourcePseudonymizesClientIP(t *testing.T) {
+	ctx := context.Background()
+
+	key := []byte("secret")
+	header := "#" + strings.Join(v1Layout(t).ColumnNames(), "\t") + "\n"
+	noClientIP := strings.Replace(testLogLine(), "192.0.2.10", "-", 1)
+	mockStorageClient := newMockSourceObject("src-bucket", "test.csv", header+testLogLine()+noClientIP)
+	mockStagingBucketHandle := new(MockBucketHandle)
+	mockStagedObjectHandle := new(MockObjectHandle)
+	staged := new(bufferWriteCloser)
+	mockStorageClient.On("Bucket", "staging").Return(mockStagingBucketHandle)
+	mockStagingBucketHandle.On("Object", "src-bucket/test.csv").Return(mockStagedObjectHandle)
+	mockStagedObjectHandle.On("NewWriter", mock.Anything).Return(staged)
+
+	rewrite, err := ClientIPPseudonymizer(&schemata.DetectedLayout{StagingLayout: v1Layout(t), HasHeader: true}, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	uri, err := StageSource(ctx, mockStorageClient, "gs://src-bucket/test.csv", "staging", rewrite)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "gs://staging/src-bucket/test.csv", uri)
+	pseudonymized := strings.Replace(testLogLine(), "192.0.2.10", common.PseudonymizeClientIP(key, "192.0.2.10"), 1)
+	assert.Equal(t, header+pseudonymized+noClientIP, staged.String())
+}
+
+func v1Layout(t *testing.T) *schemata.StagingLayout {
+	layout, err := schemata.StagingVersion("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
@@ -0,0 +1,54 @@
+#!/bin/sh
+# package_function.sh prepares the source of a function for deployment.
+#
+# The functions replace github.com/takotakot/iswf_log_to_bq/common/go with
+# ../common/go, which is not part of the uploaded source when a function
+# directory is deployed on its own. This script copies the function into
+# OUTPUT_DIR with every module it replaces by a relative path, rewrites the
+# replace directives to the copies and checks that the result builds. The
+# environments in terraform/envirionments run it to build the source archives
+# of the functions. An OUTPUT_DIR packaged before is packaged again.
+#
+# Usage: scripts/package_function.sh FUNCTION_DIR OUTPUT_DIR
+#
+#   scripts/package_function.sh untar build/untar
+#   gcloud functions deploy untar --gen2 --source build/untar ...
+set -eu
+
+marker=.packaged_function
+
+if [ $# -ne 2 ]; then
+	echo "usage: $0 FUNCTION_DIR OUTPUT_DIR" >&2
+	exit 2
+fi
+
+src=$(cd "$1" && pwd)
+if [ ! -f "$src/go.mod" ]; then
+	echo "$src has no go.mod" >&2
+	exit 1
+fi
+if [ -e "$2" ]; then
+	# 以前にパッケージしたディレクトリだけを作り直す
+	if [ ! -f "$2/$marker" ]; then
+		echo "$2 already exists" >&2
+		exit 1
+	fi
+	rm -rf "$2"
+fi
+
+mkdir -p "$2"
+out=$(cd "$2" && pwd)
+cp -R "$src"/. "$out"/
+
+# replace ディレクティブの相対パスを出力先にコピーしたモジュールへ向け直す
+awk '$1 == "replace" && $3 == "=>" && $4 ~ /^\.\.\// { print $2, $4 }' "$src/go.mod" |
+while read -r module dir; do
+	dest="_replaced/$(echo "$dir" | sed 's|\.\./||g')"
+	mkdir -p "$out/$dest"
+	cp -R "$src/$dir"/. "$out/$dest"/
+	(cd "$out" && go mod edit -replace "$module=./$dest")
+done
+
+(cd "$out" && go build ./...)
+touch "$out/$marker"
+echo "packaged $src into $out" >&2
@@ -1,8 +1,11 @@
 locals {
   project_id            = local.secret_project_id
   region                = "asia-northeast1"
-  funciton_template_dir = "${path.module}/../../../function_template"
+  repository_dir        = "${path.module}/../../.."
   artifact_dir          = "../../../artifacts"
+  function_runtime      = "go125"
   unzip_notify_topic    = "unzip"
   untar_notify_topic    = "untar"
+  # common/go を replace で参照する関数。scripts/package_function.sh でまとめてからアーカイブする
+  packaged_functions = ["unzip", "untar", "load2logs"]
 }
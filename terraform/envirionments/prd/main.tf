@@ -1,19 +1,28 @@
-data "archive_file" "funciton-template-archive" {
-  type        = "zip"
-  source_dir  = local.funciton_template_dir
-  output_path = "${local.artifact_dir}/funciton_template.zip"
-}
-
 module "source_archive_bucket" {
   source                = "../../modules/source_archive_bucket"
   source_archive_bucket = "${local.project_id}_artifact"
 }
 
-resource "google_storage_bucket_object" "funciton-template-gcs-archive" {
-  source = data.archive_file.funciton-template-archive.output_path
+data "external" "function-package" {
+  for_each    = toset(local.packaged_functions)
+  working_dir = local.repository_dir
+  program     = ["sh", "-c", "scripts/package_function.sh \"$1\" \"$2\" && printf '{\"dir\":\"%s\"}' \"$2\"", "sh", each.key, "build/${each.key}"]
+}
+
+data "archive_file" "function-archive" {
+  for_each    = data.external.function-package
+  type        = "zip"
+  source_dir  = "${local.repository_dir}/${each.value.result.dir}"
+  output_path = "${local.artifact_dir}/${each.key}.zip"
+}
+
+resource "google_storage_bucket_object" "function-gcs-archive" {
+  for_each = data.archive_file.function-archive
+  source   = each.value.output_path
 
   bucket = module.source_archive_bucket.source-archive-bucket.name
-  name   = "funciton-template.zip"
+  # 内容が変わったときに関数を作り直すよう、名前にハッシュを含める
+  name = "${each.key}-${each.value.output_md5}.zip"
 }
 
 module "unzip" {
@@ -21,8 +30,10 @@ module "unzip" {
   zip_bucket            = "${local.project_id}_zip"
   output_bucket         = "${local.project_id}_tgz"
   notify_topic          = local.unzip_notify_topic
-  source_archive_bucket = google_storage_bucket_object.funciton-template-gcs-archive.bucket
-  source_archive_object = google_storage_bucket_object.funciton-template-gcs-archive.name
+  source_archive_bucket = google_storage_bucket_object.function-gcs-archive["unzip"].bucket
+  source_archive_object = google_storage_bucket_object.function-gcs-archive["unzip"].name
+  entry_point           = "HandleUnzipEvent"
+  runtime               = local.function_runtime
 }
 
 module "untar" {
@@ -31,14 +42,18 @@ module "untar" {
   output_bucket         = "${local.project_id}_csv"
   source_topic_id       = module.unzip.output_topic.id
   notify_topic          = local.untar_notify_topic
-  source_archive_bucket = google_storage_bucket_object.funciton-template-gcs-archive.bucket
-  source_archive_object = google_storage_bucket_object.funciton-template-gcs-archive.name
+  source_archive_bucket = google_storage_bucket_object.function-gcs-archive["untar"].bucket
+  source_archive_object = google_storage_bucket_object.function-gcs-archive["untar"].name
+  entry_point           = "HandleUntarEvent"
+  runtime               = local.function_runtime
 }
 
 module "bigquery" {
-  source        = "../../modules/bigquery"
-  dataset_id    = "logs"
-  logs_table_id = "logs"
+  source            = "../../modules/bigquery"
+  dataset_id        = "logs"
+  logs_table_id     = "logs"
+  ledger_table_id   = "load_ledger"
+  rejected_table_id = "logs_rejected"
 }
 
 module "load2logs" {
@@ -47,8 +62,13 @@ module "load2logs" {
   source_topic_id       = module.untar.output_topic.id
   dataset_id            = "logs"
   logs_table_id         = "logs"
-  source_archive_bucket = google_storage_bucket_object.funciton-template-gcs-archive.bucket
-  source_archive_object = google_storage_bucket_object.funciton-template-gcs-archive.name
+  ledger_table_id       = "load_ledger"
+  rejected_table_id     = "logs_rejected"
+  source_archive_bucket = google_storage_bucket_object.function-gcs-archive["load2logs"].bucket
+  source_archive_object = google_storage_bucket_object.function-gcs-archive["load2logs"].name
+  entry_point           = "HandleLoadEvent"
+  janitor_entry_point   = "HandleCleanupEvent"
+  runtime               = local.function_runtime
 }
 
 module "bucket2logs" {
@@ -56,6 +76,10 @@ module "bucket2logs" {
   log_bucket            = "${local.project_id}_log"
   dataset_id            = "logs"
   logs_table_id         = "logs"
-  source_archive_bucket = google_storage_bucket_object.funciton-template-gcs-archive.bucket
-  source_archive_object = google_storage_bucket_object.funciton-template-gcs-archive.name
+  ledger_table_id       = "load_ledger"
+  rejected_table_id     = "logs_rejected"
+  source_archive_bucket = google_storage_bucket_object.function-gcs-archive["load2logs"].bucket
+  source_archive_object = google_storage_bucket_object.function-gcs-archive["load2logs"].name
+  entry_point           = "HandleLogLoadEvent"
+  runtime               = local.function_runtime
 }
@@ -20,12 +20,35 @@ resource "google_bigquery_table" "logs" {
 
   clustering = ["group_name", "account_name", "content_type", "determination_category"]
 
-  schema = jsonencode(yamldecode(file("${path.module}/../../../common/schemata/logs.yml")))
+  schema = jsonencode(yamldecode(file("${path.module}/../../../common/go/schemata/logs.yml")))
+}
+
+resource "google_bigquery_table" "load_ledger" {
+  dataset_id = google_bigquery_dataset.logs.dataset_id
+  table_id   = var.ledger_table_id
+
+  clustering = ["source_uri"]
+
+  schema = jsonencode(yamldecode(file("${path.module}/../../../common/go/schemata/load_ledger.yml")))
+}
+
+resource "google_bigquery_table" "logs_rejected" {
+  dataset_id = google_bigquery_dataset.logs.dataset_id
+  table_id   = var.rejected_table_id
+
+  time_partitioning {
+    field = "rejected_at"
+    type  = "DAY"
+  }
+
+  clustering = ["source_uri"]
+
+  schema = jsonencode(yamldecode(file("${path.module}/../../../common/go/schemata/logs_rejected.yml")))
 }
 
 # resource "google_bigquery_table" "load_template" {
 #   dataset_id          = google_bigquery_dataset.logs.dataset_id
 #   table_id            = var.load_template_table_id
 
-#   schema = jsonencode(yamldecode(file("${path.module}/../../../common/schemata/load_template.yml")))
+#   schema = jsonencode(yamldecode(file("${path.module}/../../../common/go/schemata/load_template.yml")))
 # }
@@ -6,6 +6,14 @@ output "logs_table" {
   value = google_bigquery_table.logs
 }
 
+output "load_ledger_table" {
+  value = google_bigquery_table.load_ledger
+}
+
+output "logs_rejected_table" {
+  value = google_bigquery_table.logs_rejected
+}
+
 output "load_template_table" {
   value = ""
 }
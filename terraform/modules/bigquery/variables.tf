@@ -6,6 +6,14 @@ variable "logs_table_id" {
   type = string
 }
 
+variable "ledger_table_id" {
+  type = string
+}
+
+variable "rejected_table_id" {
+  type = string
+}
+
 # variable "load_template_table_id" {
 #   type = string
 # }
@@ -82,6 +82,20 @@ resource "google_bigquery_dataset_iam_member" "logs" {
   member     = "serviceAccount:${google_service_account.default.email}"
 }
 
+resource "google_storage_bucket_iam_member" "staging" {
+  count  = var.staging_bucket == "" ? 0 : 1
+  bucket = var.staging_bucket
+  role   = "roles/storage.objectUser"
+  member = "serviceAccount:${google_service_account.default.email}"
+}
+
+resource "google_secret_manager_secret_iam_member" "client_ip_hmac_key" {
+  count     = var.client_ip_hmac_key_secret == "" ? 0 : 1
+  secret_id = var.client_ip_hmac_key_secret
+  role      = "roles/secretmanager.secretAccessor"
+  member    = "serviceAccount:${google_service_account.default.email}"
+}
+
 resource "google_cloudfunctions2_function" "default" {
   depends_on = [
     google_project_service.functions,
@@ -90,12 +104,12 @@ resource "google_cloudfunctions2_function" "default" {
     google_project_service.eventarc,
     google_project_iam_member.event-receiving,
     google_project_iam_member.artifactregistry-reader,
+    google_secret_manager_secret_iam_member.client_ip_hmac_key,
   ]
   lifecycle {
     ignore_changes = [
       service_config[0].service,
       service_config[0].service_account_email,
-      build_config[0].entry_point,
       build_config[0].docker_repository,
     ]
   }
@@ -105,8 +119,8 @@ resource "google_cloudfunctions2_function" "default" {
   location    = "us-central1"
 
   build_config {
-    entry_point = "template"
-    runtime     = "go121"
+    entry_point = var.entry_point
+    runtime     = var.runtime
     source {
       storage_source {
         bucket = var.source_archive_bucket
@@ -117,9 +131,27 @@ resource "google_cloudfunctions2_function" "default" {
   service_config {
     available_memory = "128Mi"
     environment_variables = {
-      PROJECT_ID = data.google_project.project.project_id
-      DATASET_ID = var.dataset_id
-      TABLE_ID   = var.logs_table_id
+      PROJECT_ID          = data.google_project.project.project_id
+      DATASET_ID          = var.dataset_id
+      TABLE_ID            = var.logs_table_id
+      LEDGER_TABLE_ID     = var.ledger_table_id
+      REJECTED_TABLE_ID   = var.rejected_table_id
+      MAX_BAD_RECORDS     = var.max_bad_records
+      LOAD_MODE           = var.load_mode
+      MAX_BYTES_BILLED    = var.max_bytes_billed
+      STAGING_BUCKET      = var.staging_bucket
+      TIME_ZONE           = var.time_zone
+      TIME_ZONE_OVERRIDES = var.time_zone_overrides
+      CLIENT_IP_MODE      = var.client_ip_mode
+    }
+    dynamic "secret_environment_variables" {
+      for_each = var.client_ip_hmac_key_secret == "" ? [] : [var.client_ip_hmac_key_secret]
+      content {
+        key        = "CLIENT_IP_HMAC_KEY"
+        project_id = data.google_project.project.project_id
+        secret     = secret_environment_variables.value
+        version    = "latest"
+      }
     }
     ingress_settings                 = "ALLOW_ALL"
     max_instance_count               = 1
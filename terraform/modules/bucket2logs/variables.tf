@@ -10,6 +10,18 @@ variable "source_archive_object" {
   type = string
 }
 
+variable "entry_point" {
+  type        = string
+  default     = "template"
+  description = "Function of source_archive_object that handles the events"
+}
+
+variable "runtime" {
+  type        = string
+  default     = "go121"
+  description = "Cloud Functions runtime of source_archive_object"
+}
+
 variable "dataset_id" {
   type = string
 }
@@ -17,3 +29,59 @@ variable "dataset_id" {
 variable "logs_table_id" {
   type = string
 }
+
+variable "ledger_table_id" {
+  type = string
+}
+
+variable "rejected_table_id" {
+  type    = string
+  default = "logs_rejected"
+}
+
+variable "max_bad_records" {
+  type        = number
+  default     = 0
+  description = "Number of bad lines per file written to rejected_table_id while the other lines are loaded. A file with more is rejected as a whole. Needs staging_bucket when positive, as the lines are numbered in a staged copy"
+}
+
+variable "load_mode" {
+  type        = string
+  default     = "append"
+  description = "append to insert rows, or replace to replace the rows on the request_time dates of each file"
+}
+
+variable "max_bytes_billed" {
+  type        = number
+  default     = 0
+  description = "Ceiling of the bytes billed by a load, 0 for the project default"
+}
+
+variable "staging_bucket" {
+  type        = string
+  default     = ""
+  description = "Bucket to stage decompressed bzip2, xz and zstd files, empty to reject them. Required when client_ip_mode is hmac or max_bad_records is positive. The staged copies are deleted after each load; give the bucket a lifecycle rule for the copies left by crashed instances"
+}
+
+variable "time_zone" {
+  type    = string
+  default = "Asia/Tokyo"
+}
+
+variable "time_zone_overrides" {
+  type        = string
+  default     = ""
+  description = "Comma separated prefix=time_zone pairs that override time_zone for the objects under the prefix"
+}
+
+variable "client_ip_mode" {
+  type        = string
+  default     = "raw"
+  description = "raw to store normalized client IPs, or hmac to pseudonymize them"
+}
+
+variable "client_ip_hmac_key_secret" {
+  type        = string
+  default     = ""
+  description = "Secret Manager secret that holds the HMAC key used when client_ip_mode is hmac"
+}
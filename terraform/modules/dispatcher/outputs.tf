@@ -0,0 +1,7 @@
+output "upload_bucket" {
+  value = google_storage_bucket.upload_bucket
+}
+
+output "output_topic" {
+  value = google_pubsub_topic.notify_topic
+}
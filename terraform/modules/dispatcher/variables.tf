@@ -0,0 +1,128 @@
+variable "upload_bucket" {
+  type = string
+}
+
+variable "output_bucket" {
+  type        = string
+  description = "Existing bucket the leaf log files are written to"
+}
+
+variable "notify_topic" {
+  type = string
+}
+
+variable "max_depth" {
+  type        = number
+  default     = 4
+  description = "How deep archives may be nested. A deeper source is rejected with a marker object in the output bucket"
+}
+
+variable "max_nested_zip_size" {
+  type        = string
+  default     = "256MiB"
+  description = "Size up to which a zip nested in another archive is buffered in memory, such as 256MiB"
+}
+
+variable "entry_include" {
+  type        = string
+  default     = ""
+  description = "Comma separated glob patterns of the leaf files to write, such as *.log. All leaf files when empty"
+}
+
+variable "entry_exclude" {
+  type        = string
+  default     = ""
+  description = "Comma separated glob patterns of the leaf files to skip, such as README*,*.sha256"
+}
+
+variable "entry_min_size" {
+  type        = string
+  default     = "0"
+  description = "Size under which a leaf file is skipped, such as 1B"
+}
+
+variable "entry_max_size" {
+  type        = string
+  default     = "0"
+  description = "Size over which a leaf file is skipped, such as 10GiB. 0 means no limit. Not checked for compressed leaf files"
+}
+
+variable "max_entries" {
+  type        = number
+  default     = 100000
+  description = "Number of entries, those of the nested archives included, over which a source is rejected. 0 means no limit"
+}
+
+variable "max_total_size" {
+  type        = string
+  default     = "4GiB"
+  description = "Size of the leaf files over which a source is rejected, such as 100GiB. 0 means no limit"
+}
+
+variable "max_compression_ratio" {
+  type        = number
+  default     = 1000
+  description = "Ratio of the size of the leaf files to the source size over which a source is rejected. 0 means no limit"
+}
+
+variable "charset" {
+  type        = string
+  default     = ""
+  description = "Charset of the leaf log files: auto, utf-8 or cp932. The files are transcoded to UTF-8 when it is set, except compressed or binary files, and written as is when it is empty"
+}
+
+variable "charset_overrides" {
+  type        = string
+  default     = ""
+  description = "Comma separated prefix=charset pairs that override charset for the objects under the prefix"
+}
+
+variable "source_archive_bucket" {
+  type = string
+}
+
+variable "source_archive_object" {
+  type = string
+}
+
+variable "entry_point" {
+  type        = string
+  default     = "template"
+  description = "Function of source_archive_object that handles the events"
+}
+
+variable "runtime" {
+  type        = string
+  default     = "go121"
+  description = "Cloud Functions runtime of source_archive_object"
+}
+
+variable "entry_name_policy" {
+  type        = string
+  default     = "reject"
+  description = "How to handle the archive entries with unsafe names such as ../a.log: reject, flatten or rewrite"
+}
+
+variable "name_charset" {
+  type        = string
+  default     = "auto"
+  description = "Charset of the zip entry names without the UTF-8 flag: auto, utf-8 or cp932"
+}
+
+variable "name_percent_decode" {
+  type        = bool
+  default     = false
+  description = "Whether to unescape the %XX sequences in the zip entry names"
+}
+
+variable "upload_concurrency" {
+  type        = number
+  default     = 8
+  description = "Number of leaf files written to the output bucket at a time"
+}
+
+variable "upload_buffer_size" {
+  type        = string
+  default     = "8MiB"
+  description = "Size up to which a leaf file is buffered for a parallel upload. Larger files are spooled to a temporary file"
+}
@@ -64,6 +64,20 @@ resource "google_bigquery_dataset_iam_member" "logs" {
   member     = "serviceAccount:${google_service_account.default.email}"
 }
 
+resource "google_storage_bucket_iam_member" "staging" {
+  count  = var.staging_bucket == "" ? 0 : 1
+  bucket = var.staging_bucket
+  role   = "roles/storage.objectUser"
+  member = "serviceAccount:${google_service_account.default.email}"
+}
+
+resource "google_secret_manager_secret_iam_member" "client_ip_hmac_key" {
+  count     = var.client_ip_hmac_key_secret == "" ? 0 : 1
+  secret_id = var.client_ip_hmac_key_secret
+  role      = "roles/secretmanager.secretAccessor"
+  member    = "serviceAccount:${google_service_account.default.email}"
+}
+
 resource "google_cloudfunctions2_function" "default" {
   depends_on = [
     google_project_service.functions,
@@ -72,12 +86,12 @@ resource "google_cloudfunctions2_function" "default" {
     google_project_service.eventarc,
     google_project_iam_member.event-receiving,
     google_project_iam_member.artifactregistry-reader,
+    google_secret_manager_secret_iam_member.client_ip_hmac_key,
   ]
   lifecycle {
     ignore_changes = [
       service_config[0].service,
       service_config[0].service_account_email,
-      build_config[0].entry_point,
       build_config[0].docker_repository
     ]
   }
@@ -87,8 +101,8 @@ resource "google_cloudfunctions2_function" "default" {
   location    = "us-central1"
 
   build_config {
-    entry_point = "template"
-    runtime     = "go121"
+    entry_point = var.entry_point
+    runtime     = var.runtime
     source {
       storage_source {
         bucket = var.source_archive_bucket
@@ -99,9 +113,27 @@ resource "google_cloudfunctions2_function" "default" {
   service_config {
     available_memory = "128Mi"
     environment_variables = {
-      PROJECT_ID = data.google_project.project.project_id
-      DATASET_ID = var.dataset_id
-      TABLE_ID   = var.logs_table_id
+      PROJECT_ID          = data.google_project.project.project_id
+      DATASET_ID          = var.dataset_id
+      TABLE_ID            = var.logs_table_id
+      LEDGER_TABLE_ID     = var.ledger_table_id
+      REJECTED_TABLE_ID   = var.rejected_table_id
+      MAX_BAD_RECORDS     = var.max_bad_records
+      LOAD_MODE           = var.load_mode
+      MAX_BYTES_BILLED    = var.max_bytes_billed
+      STAGING_BUCKET      = var.staging_bucket
+      TIME_ZONE           = var.time_zone
+      TIME_ZONE_OVERRIDES = var.time_zone_overrides
+      CLIENT_IP_MODE      = var.client_ip_mode
+    }
+    dynamic "secret_environment_variables" {
+      for_each = var.client_ip_hmac_key_secret == "" ? [] : [var.client_ip_hmac_key_secret]
+      content {
+        key        = "CLIENT_IP_HMAC_KEY"
+        project_id = data.google_project.project.project_id
+        secret     = secret_environment_variables.value
+        version    = "latest"
+      }
     }
     ingress_settings                 = "ALLOW_ALL"
     max_instance_count               = 1
@@ -118,3 +150,81 @@ resource "google_cloudfunctions2_function" "default" {
     service_account_email = google_service_account.default.email
   }
 }
+
+resource "google_project_service" "cloudscheduler" {
+  service            = "cloudscheduler.googleapis.com"
+  disable_on_destroy = false
+}
+
+resource "google_pubsub_topic" "janitor" {
+  name = "load2logs-janitor"
+}
+
+resource "google_cloud_scheduler_job" "janitor" {
+  depends_on = [google_project_service.cloudscheduler]
+
+  name        = "load2logs-janitor"
+  description = "Delete staging tables left by failed loads"
+  region      = "us-central1"
+  schedule    = var.janitor_schedule
+  time_zone   = "Etc/UTC"
+
+  pubsub_target {
+    topic_name = google_pubsub_topic.janitor.id
+    data       = base64encode("{}")
+  }
+}
+
+resource "google_cloudfunctions2_function" "janitor" {
+  depends_on = [
+    google_project_service.functions,
+    google_project_service.run,
+    google_project_service.cloudbuild,
+    google_project_service.eventarc,
+    google_project_iam_member.event-receiving,
+    google_project_iam_member.artifactregistry-reader,
+  ]
+  lifecycle {
+    ignore_changes = [
+      service_config[0].service,
+      service_config[0].service_account_email,
+      build_config[0].docker_repository
+    ]
+  }
+
+  name        = "load2logs-janitor"
+  description = "Delete orphaned staging tables of load2logs"
+  location    = "us-central1"
+
+  build_config {
+    entry_point = var.janitor_entry_point
+    runtime     = var.runtime
+    source {
+      storage_source {
+        bucket = var.source_archive_bucket
+        object = var.source_archive_object
+      }
+    }
+  }
+  service_config {
+    available_memory = "128Mi"
+    environment_variables = {
+      PROJECT_ID            = data.google_project.project.project_id
+      DATASET_ID            = var.dataset_id
+      STAGING_TABLE_MAX_AGE = var.staging_table_max_age
+    }
+    ingress_settings                 = "ALLOW_ALL"
+    max_instance_count               = 1
+    max_instance_request_concurrency = 1
+    min_instance_count               = 0
+    timeout_seconds                  = 300
+    service_account_email            = google_service_account.default.email
+  }
+  event_trigger {
+    trigger_region        = "us-central1"
+    event_type            = "google.cloud.pubsub.topic.v1.messagePublished"
+    pubsub_topic          = google_pubsub_topic.janitor.id
+    retry_policy          = "RETRY_POLICY_DO_NOT_RETRY"
+    service_account_email = google_service_account.default.email
+  }
+}
@@ -0,0 +1,3 @@
+output "janitor_function" {
+  value = google_cloudfunctions2_function.janitor
+}
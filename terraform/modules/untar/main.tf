@@ -91,7 +91,6 @@ resource "google_cloudfunctions2_function" "default" {
     ignore_changes = [
       service_config[0].service,
       service_config[0].service_account_email,
-      build_config[0].entry_point,
       build_config[0].docker_repository,
     ]
   }
@@ -101,8 +100,8 @@ resource "google_cloudfunctions2_function" "default" {
   location    = "us-central1"
 
   build_config {
-    entry_point = "template"
-    runtime     = "go121"
+    entry_point = var.entry_point
+    runtime     = var.runtime
     source {
       storage_source {
         bucket = var.source_archive_bucket
@@ -113,9 +112,21 @@ resource "google_cloudfunctions2_function" "default" {
   service_config {
     available_memory = "256M"
     environment_variables = {
-      CONTENT_TOPIC_ID = google_pubsub_topic.notify_topic.name
-      DEST_BUCKET_NAME = google_storage_bucket.output_bucket.name
-      PROJECT_ID       = data.google_project.project.project_id
+      CONTENT_TOPIC_ID      = google_pubsub_topic.notify_topic.name
+      DEST_BUCKET_NAME      = google_storage_bucket.output_bucket.name
+      PROJECT_ID            = data.google_project.project.project_id
+      CHARSET               = var.charset
+      CHARSET_OVERRIDES     = var.charset_overrides
+      ENTRY_NAME_POLICY     = var.entry_name_policy
+      MAX_ENTRIES           = var.max_entries
+      MAX_TOTAL_SIZE        = var.max_total_size
+      MAX_COMPRESSION_RATIO = var.max_compression_ratio
+      ENTRY_INCLUDE         = var.entry_include
+      ENTRY_EXCLUDE         = var.entry_exclude
+      ENTRY_MIN_SIZE        = var.entry_min_size
+      ENTRY_MAX_SIZE        = var.entry_max_size
+      UPLOAD_CONCURRENCY    = var.upload_concurrency
+      UPLOAD_BUFFER_SIZE    = var.upload_buffer_size
     }
     ingress_settings                 = "ALLOW_ALL"
     max_instance_count               = 1
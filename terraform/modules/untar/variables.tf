@@ -21,3 +21,87 @@ variable "source_archive_bucket" {
 variable "source_archive_object" {
   type = string
 }
+
+variable "entry_point" {
+  type        = string
+  default     = "template"
+  description = "Function of source_archive_object that handles the events"
+}
+
+variable "runtime" {
+  type        = string
+  default     = "go121"
+  description = "Cloud Functions runtime of source_archive_object"
+}
+
+variable "charset" {
+  type        = string
+  default     = ""
+  description = "Charset of the extracted log files: auto, utf-8 or cp932. The files are transcoded to UTF-8 when it is set, except compressed or binary files, and written as is when it is empty"
+}
+
+variable "charset_overrides" {
+  type        = string
+  default     = ""
+  description = "Comma separated prefix=charset pairs that override charset for the objects under the prefix"
+}
+
+variable "entry_name_policy" {
+  type        = string
+  default     = "reject"
+  description = "How to handle the archive entries with unsafe names such as ../a.log: reject, flatten or rewrite"
+}
+
+variable "max_entries" {
+  type        = number
+  default     = 100000
+  description = "Number of entries over which an archive is rejected. 0 means no limit"
+}
+
+variable "max_total_size" {
+  type        = string
+  default     = "4GiB"
+  description = "Extracted size over which an archive is rejected, such as 100GiB. 0 means no limit"
+}
+
+variable "max_compression_ratio" {
+  type        = number
+  default     = 1000
+  description = "Ratio of the extracted size to the archive size over which an archive is rejected. 0 means no limit"
+}
+
+variable "entry_include" {
+  type        = string
+  default     = ""
+  description = "Comma separated glob patterns of the archive entries to extract, such as *.log. All entries when empty"
+}
+
+variable "entry_exclude" {
+  type        = string
+  default     = ""
+  description = "Comma separated glob patterns of the archive entries to skip, such as README*,*.sha256"
+}
+
+variable "entry_min_size" {
+  type        = string
+  default     = "0"
+  description = "Size under which an archive entry is skipped, such as 1B"
+}
+
+variable "entry_max_size" {
+  type        = string
+  default     = "0"
+  description = "Size over which an archive entry is skipped, such as 10GiB. 0 means no limit"
+}
+
+variable "upload_concurrency" {
+  type        = number
+  default     = 8
+  description = "Number of archive entries written to the output bucket at a time"
+}
+
+variable "upload_buffer_size" {
+  type        = string
+  default     = "8MiB"
+  description = "Size up to which an archive entry is buffered for a parallel upload. Larger entries are spooled to a temporary file"
+}
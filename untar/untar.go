@@ -4,103 +4,173 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path"
-	"time"
 
 	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/common/go/config"
 
 	"cloud.google.com/go/storage"
 	_ "github.com/GoogleCloudPlatform/functions-framework-go/funcframework"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
-	"golang.org/x/sync/errgroup"
 )
 
 func init() {
+	common.InitLogging(os.Getenv("PROJECT_ID"))
 	// Register a CloudEvent function with the Functions Framework
 	functions.CloudEvent("HandleUntarEvent", HandleUntarEvent)
 }
 
-type MessagePublishedData struct {
-	Message PubSubMessage
-}
-
-type PubSubMessage struct {
-	ID string
-	Data []byte `json:"data"`
-	Attributes map[string]string
-	PublishTime time.Time
-	DeliveryAttempt *int
-	OrderingKey string
-}
-
 type EnvConfig struct {
-	ProjectID      string
-	ContentTopicID string
-	DestBucketName string
+	ProjectID      string `env:"PROJECT_ID,required"`
+	ContentTopicID string `env:"CONTENT_TOPIC_ID,required"`
+	DestBucketName string `env:"DEST_BUCKET_NAME,required"`
+	// Charset is the charset of the extracted files, common.CharsetAuto to
+	// detect it. The files are transcoded to UTF-8 when it is set, and
+	// written as is by default.
+	Charset string `env:"CHARSET"`
+	// CharsetOverrides replaces Charset for the source objects under a prefix.
+	CharsetOverrides common.PrefixOverrides `env:"CHARSET_OVERRIDES"`
+	// EntryNamePolicy is how the entries with unsafe names are written, see
+	// common.SanitizeEntryName.
+	EntryNamePolicy string `env:"ENTRY_NAME_POLICY" validate:"oneof=reject flatten rewrite"`
+	// EntryInclude and EntryExclude are the patterns of the entries to
+	// extract and to skip, and EntryMinSize and EntryMaxSize bound their
+	// sizes; see common.EntryFilter.
+	EntryInclude []string `env:"ENTRY_INCLUDE"`
+	EntryExclude []string `env:"ENTRY_EXCLUDE"`
+	EntryMinSize int64    `env:"ENTRY_MIN_SIZE,size" validate:"min=0"`
+	EntryMaxSize int64    `env:"ENTRY_MAX_SIZE,size" validate:"min=0"`
+	// MaxEntries, MaxTotalSize and MaxCompressionRatio reject the archives
+	// that would expand too much. 0 means no limit.
+	MaxEntries          int     `env:"MAX_ENTRIES" validate:"min=0"`
+	MaxTotalSize        int64   `env:"MAX_TOTAL_SIZE,size" validate:"min=0"`
+	MaxCompressionRatio float64 `env:"MAX_COMPRESSION_RATIO" validate:"min=0"`
+	// UploadConcurrency is the number of entries written at a time, and
+	// UploadBufferSize is the size up to which an entry is buffered for it.
+	UploadConcurrency int   `env:"UPLOAD_CONCURRENCY" validate:"min=1"`
+	UploadBufferSize  int64 `env:"UPLOAD_BUFFER_SIZE,size" validate:"min=1"`
 }
 
 func NewEnvConfig() (*EnvConfig, error) {
-	config := EnvConfig{}
-
-	requiredEnv := map[string]*string{
-		"PROJECT_ID":       &config.ProjectID,
-		"CONTENT_TOPIC_ID": &config.ContentTopicID,
-		"DEST_BUCKET_NAME": &config.DestBucketName,
+	envConfig := EnvConfig{
+		EntryNamePolicy:     common.EntryNamePolicyReject,
+		MaxEntries:          common.DefaultMaxEntries,
+		MaxTotalSize:        common.DefaultMaxTotalSize,
+		MaxCompressionRatio: common.DefaultMaxCompressionRatio,
+		UploadConcurrency:   common.DefaultUploadConcurrency,
+		UploadBufferSize:    common.DefaultUploadBufferSize,
+	}
+	if err := config.Load(&envConfig); err != nil {
+		return nil, err
 	}
+	return &envConfig, nil
+}
 
-	for envVar, valuePtr := range requiredEnv {
-		value := os.Getenv(envVar)
-		if value == "" {
-			return nil, fmt.Errorf("%s environment variable is not set", envVar)
+// Validate checks the charsets and the entry filter, as config.Load calls it.
+func (c *EnvConfig) Validate() error {
+	var errs []error
+	if err := c.ExtractOptions("").Filter.Validate(); err != nil {
+		errs = append(errs, &config.FieldError{Key: "ENTRY_INCLUDE/ENTRY_EXCLUDE", Err: err})
+	}
+	if c.Charset != "" {
+		if _, err := common.NormalizeCharset(c.Charset); err != nil {
+			errs = append(errs, &config.FieldError{Key: "CHARSET", Err: err})
 		}
-		*valuePtr = value
 	}
+	for prefix, charset := range c.CharsetOverrides {
+		if _, err := common.NormalizeCharset(charset); err != nil {
+			errs = append(errs, &config.FieldError{Key: "CHARSET_OVERRIDES", Err: fmt.Errorf("%s: %v", prefix, err)})
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	return &config, nil
+// ExtractOptions returns the options to extract the source object at srcPath.
+func (c *EnvConfig) ExtractOptions(srcPath string) ExtractOptions {
+	return ExtractOptions{
+		Charset:         c.CharsetOverrides.Lookup(srcPath, c.Charset),
+		EntryNamePolicy: c.EntryNamePolicy,
+		Filter: common.EntryFilter{
+			Include: c.EntryInclude,
+			Exclude: c.EntryExclude,
+			MinSize: c.EntryMinSize,
+			MaxSize: c.EntryMaxSize,
+		},
+		Limits: common.ExtractLimits{
+			MaxEntries:          c.MaxEntries,
+			MaxTotalSize:        c.MaxTotalSize,
+			MaxCompressionRatio: c.MaxCompressionRatio,
+		},
+		UploadConcurrency: c.UploadConcurrency,
+		UploadBufferSize:  c.UploadBufferSize,
+	}
+}
+
+// ExtractOptions describes how ExtractTgzAndUpload writes the entries.
+type ExtractOptions struct {
+	// Charset is the charset of the entries, which are transcoded to UTF-8.
+	// The entries are written as is when it is empty.
+	Charset string
+	// EntryNamePolicy is how the entries with unsafe names are written.
+	// They are rejected when it is empty.
+	EntryNamePolicy string
+	// Filter selects the entries to write. The others are skipped.
+	Filter common.EntryFilter
+	// UploadConcurrency and UploadBufferSize configure the common.UploadPool
+	// that writes the entries. The defaults are used when they are 0.
+	UploadConcurrency int
+	UploadBufferSize  int64
+	// Limits rejects the archive when it is exceeded. The written entries
+	// are deleted and a marker is left instead.
+	Limits common.ExtractLimits
 }
 
 func HandleUntarEvent(ctx context.Context, e event.Event) error {
-	envConfig, err := NewEnvConfig()
+	object, err := common.DecodeSourceObject(e)
+	if errors.Is(err, common.ErrNotFinalized) {
+		common.Logger(ctx).Info("Ignore event", common.LogKeyEventID, e.ID(), "reason", err)
+		return nil
+	}
 	if err != nil {
-		log.Printf("Failed to load EnvConfig: %v", err)
-		return fmt.Errorf("EnvConfig: %v", err)
+		return fmt.Errorf("DecodeSourceObject: %v", err)
 	}
 
-	var msg MessagePublishedData
-	if err := e.DataAs(&msg); err != nil {
-		return fmt.Errorf("event.DataAs: %w", err)
-	}
+	ctx = common.StartEvent(ctx, e.ID(), object.URI(), object.TraceID)
+	logger := common.Logger(ctx)
 
-	var fileInfo common.PubSubMessageData
-	if err := json.Unmarshal(msg.Message.Data, &fileInfo); err != nil {
-		return fmt.Errorf("json.Unmarshal: %v", err)
+	envConfig, err := NewEnvConfig()
+	if err != nil {
+		logger.Error("Failed to load EnvConfig", "error", err)
+		return fmt.Errorf("EnvConfig: %v", err)
 	}
 
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		log.Printf("Failed to create client: %v", err)
+		logger.Error("Failed to create client", "error", err)
 		return fmt.Errorf("storage.NewClient: %v", err)
 	}
 	defer client.Close()
 
 	realClient := &common.RealStorageClient{Client: client}
-	return ExtractTgzAndUpload(ctx, realClient, fileInfo.Bucket, fileInfo.FilePath, envConfig.DestBucketName, common.PubSubMessageSenderFactory(ctx, envConfig.ProjectID, envConfig.ContentTopicID))
+	return ExtractTgzAndUpload(ctx, realClient, object.Bucket, object.Name, envConfig.DestBucketName, common.PubSubMessageSenderFactory(ctx, envConfig.ProjectID, envConfig.ContentTopicID), envConfig.ExtractOptions(object.Name))
 }
 
-func ExtractTgzAndUpload(ctx context.Context, client common.StorageClient, srcBucketName string, srcPath string, destBucketName string, messageSender func(common.PubSubMessageData) error) error {
+func ExtractTgzAndUpload(ctx context.Context, client common.StorageClient, srcBucketName string, srcPath string, destBucketName string, messageSender func(common.PubSubMessageData) error, opts ExtractOptions) error {
+	logger := common.Logger(ctx)
 	r, err := client.Bucket(srcBucketName).Object(srcPath).NewReader(ctx)
 	if err != nil {
 		return fmt.Errorf("NewReader: %v", err)
 	}
 	defer r.Close()
 
-	gr, err := gzip.NewReader(r)
+	// 圧縮率は読み込んだアーカイブのバイト数に対して測る
+	compressed := &common.CountingReader{R: r}
+	gr, err := gzip.NewReader(compressed)
 	if err != nil {
 		return fmt.Errorf("gzip.NewReader: %v", err)
 	}
@@ -109,7 +179,11 @@ func ExtractTgzAndUpload(ctx context.Context, client common.StorageClient, srcBu
 	tr := tar.NewReader(gr)
 	destBucket := client.Bucket(destBucketName)
 
-	var errorGroup errgroup.Group
+	budget := common.NewExtractBudget(opts.Limits, func() int64 { return compressed.N })
+	// アーカイブは順に読み、エントリは並行して書き出す
+	pool := common.NewUploadPool(ctx, opts.UploadConcurrency, opts.UploadBufferSize)
+	defer pool.Abort()
+	skipped := common.SkippedEntries{}
 
 	for {
 		header, err := tr.Next()
@@ -119,34 +193,75 @@ func ExtractTgzAndUpload(ctx context.Context, client common.StorageClient, srcBu
 		if err != nil {
 			return fmt.Errorf("tar.Next: %v", err)
 		}
+		// 飛ばすエントリも数える
+		if err := budget.AddEntry(); err != nil {
+			pool.Abort()
+			return common.RejectArchive(ctx, client, srcBucketName, srcPath, destBucketName, pool.Names(), err)
+		}
 
 		if header.Typeflag == tar.TypeReg {
-			destObjectName := path.Join(srcPath, header.Name)
-			destObject := destBucket.Object(destObjectName)
-			w := destObject.NewWriter(ctx)
-			if _, err := io.Copy(w, tr); err != nil {
-				w.Close()
-				return fmt.Errorf("io.Copy: %v", err)
+			entryName, err := common.SanitizeEntryName(header.Name, opts.EntryNamePolicy)
+			if err != nil {
+				// 展開先の外に書き出す名前のエントリは飛ばして報告する
+				logger.Error("Rejected entry", "entry", header.Name, "error", err)
+				skipped.Add("unsafe name")
+				continue
 			}
-			if err := w.Close(); err != nil {
-				return fmt.Errorf("Close: %v", err)
+			if reason := opts.Filter.Skip(entryName, header.Size); reason != "" {
+				logger.Info("Skip entry", "entry", entryName, "reason", reason)
+				skipped.Add(reason)
+				continue
 			}
 
-			msgData := common.PubSubMessageData{
-				Bucket:   destBucketName,
-				FilePath: destObjectName,
+			destObjectName := path.Join(srcPath, entryName)
+			destObject := destBucket.Object(destObjectName)
+			var content io.Reader = budget.Reader(tr)
+			var transcoder *common.Transcoder
+			if opts.Charset != "" {
+				transcoder, err = common.NewTranscoder(content, opts.Charset)
+				if limitErr := budget.Exceeded(); limitErr != nil {
+					pool.Abort()
+					return common.RejectArchive(ctx, client, srcBucketName, srcPath, destBucketName, pool.Names(), limitErr)
+				}
+				if err != nil {
+					return fmt.Errorf("NewTranscoder: %v", err)
+				}
+				content = transcoder
+			}
+
+			if err := pool.Upload(destObject, destObjectName, content); err != nil {
+				pool.Abort()
+				if limitErr := budget.Exceeded(); limitErr != nil {
+					return common.RejectArchive(ctx, client, srcBucketName, srcPath, destBucketName, pool.Names(), limitErr)
+				}
+				return fmt.Errorf("Upload: %v", err)
 			}
 
-			errorGroup.Go(func() error {
-				return messageSender(msgData)
-			})
+			if transcoder != nil {
+				// 変換できなかったバイト列は置き換えて書き出し、報告に留める
+				if report := transcoder.Report(); report.InvalidSequences > 0 {
+					logger.Warn("Replaced undecodable byte sequences",
+						"object", destObjectName,
+						"invalidSequences", report.InvalidSequences,
+						"charset", report.Charset,
+						"lines", report.InvalidLines,
+					)
+				}
+			}
+		} else {
+			skipped.Add("not a regular file")
 		}
 	}
 
-	if err := errorGroup.Wait(); err != nil {
-		log.Printf("Failed to send Pub/Sub message: %v", err)
-		return fmt.Errorf("sendPubSubMessage: %v", err)
+	uploaded, err := pool.Wait()
+	if err != nil {
+		return fmt.Errorf("Upload: %v", err)
+	}
+
+	if err := common.PublishUploads(ctx, destBucketName, uploaded, messageSender); err != nil {
+		return err
 	}
 
+	logger.Info("Extracted archive", "extracted", len(uploaded), "skipped", skipped.Total(), "skippedByReason", skipped)
 	return nil
 }
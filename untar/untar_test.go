@@ -1,17 +1,23 @@
 package untar
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"io"
 	"log"
 	"os"
 	"path"
+	"sync"
 	"testing"
 
 	common "github.com/takotakot/iswf_log_to_bq/common/go"
 
+	"cloud.google.com/go/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/text/encoding/japanese"
 )
 
 type MockStorageClient struct {
@@ -38,6 +44,11 @@ func (m *MockBucketHandle) Object(name string) common.ObjectHandle {
 	return args.Get(0).(common.ObjectHandle)
 }
 
+func (m *MockBucketHandle) Objects(ctx context.Context, prefix string) common.ObjectIterator {
+	args := m.Called(ctx, prefix)
+	return args.Get(0).(common.ObjectIterator)
+}
+
 type MockObjectHandle struct {
 	mock.Mock
 	Name string
@@ -94,6 +105,34 @@ func (m *MockObjectHandle) NewWriter(ctx context.Context) io.WriteCloser {
 	return args.Get(0).(io.WriteCloser)
 }
 
+func (m *MockObjectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	args := m.Called(ctx, offset, length)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockObjectHandle) Attrs(ctx context.Context) (*storage.ObjectAttrs, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(*storage.ObjectAttrs), args.Error(1)
+}
+
+func (m *MockObjectHandle) Delete(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+// recordSender collects the paths of the messages sent by the extractor.
+type recordSender struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (s *recordSender) send(msgData common.PubSubMessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = append(s.paths, msgData.FilePath)
+	return nil
+}
+
 func readFileContent(path string) ([]byte, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -130,6 +169,7 @@ func TestExtractAndUpload(t *testing.T) {
 		expectedMsgData := common.PubSubMessageData{
 			Bucket:   destBucketName,
 			FilePath: path.Join(srcPath, contentFileName),
+			CRC32C:   common.EncodeCRC32C(common.ChecksumCRC32C(destFileData)),
 		}
 		assert.Equal(t, expectedMsgData, msgData, "Message data does not match the expected data")
 
@@ -163,7 +203,7 @@ func TestExtractAndUpload(t *testing.T) {
 	mockObjectWriter.On("Close").Return(nil)
 
 	// テストの実行
-	err = ExtractTgzAndUpload(ctx, mockClient, srcBucketName, srcPath, destBucketName, messageSender)
+	err = ExtractTgzAndUpload(ctx, mockClient, srcBucketName, srcPath, destBucketName, messageSender, ExtractOptions{Charset: common.CharsetAuto})
 	if err != nil {
 		t.Errorf("ExtractAndUpload failed: %v", err)
 	}
@@ -180,3 +220,195 @@ func TestExtractAndUpload(t *testing.T) {
 	mockReadCloser.AssertExpectations(t)
 	mockObjectWriter.AssertExpectations(t)
 }
+
+func makeTgz(t *testing.T, name string, content []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestExtractTgzAndUploadTranscodes(t *testing.T) {
+	ctx := context.Background()
+
+	content, err := japanese.ShiftJIS.NewEncoder().Bytes([]byte("営業部\t髙橋\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockClient := new(MockStorageClient)
+	mockSrcBucketHandle := new(MockBucketHandle)
+	mockDestBucketHandle := new(MockBucketHandle)
+	mockSrcObjectHandle := new(MockObjectHandle)
+	mockDestObjectHandle := new(MockObjectHandle)
+	mockReadCloser := &MockReadCloser{
+		data: makeTgz(t, "access.log", content),
+	}
+	mockObjectWriter := new(MockObjectWriter)
+
+	mockClient.On("Bucket", "src-bucket").Return(mockSrcBucketHandle)
+	mockClient.On("Bucket", "dest-bucket").Return(mockDestBucketHandle)
+	mockSrcBucketHandle.On("Object", "test.tgz").Return(mockSrcObjectHandle)
+	mockDestBucketHandle.On("Object", "test.tgz/access.log").Return(mockDestObjectHandle)
+	mockSrcObjectHandle.On("NewReader", mock.Anything).Return(mockReadCloser, nil)
+	mockDestObjectHandle.On("NewWriter", mock.Anything).Return(mockObjectWriter)
+	mockReadCloser.On("Read", mock.Anything)
+	mockReadCloser.On("Close").Return(nil)
+	mockObjectWriter.On("Write", mock.Anything)
+	mockObjectWriter.On("Close").Return(nil)
+
+	messageSender := func(msgData common.PubSubMessageData) error { return nil }
+
+	err = ExtractTgzAndUpload(ctx, mockClient, "src-bucket", "test.tgz", "dest-bucket", messageSender, ExtractOptions{Charset: common.CharsetAuto})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "営業部\t髙橋\n", string(mockObjectWriter.WrittenData))
+
+	// 文字コードの指定がなければそのまま書き出す
+	mockReadCloser.pos = 0
+	mockObjectWriter.WrittenData = nil
+	err = ExtractTgzAndUpload(ctx, mockClient, "src-bucket", "test.tgz", "dest-bucket", messageSender, ExtractOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, content, mockObjectWriter.WrittenData)
+}
+
+func TestExtractTgzAndUploadEntryNamePolicy(t *testing.T) {
+	ctx := context.Background()
+
+	mockClient := new(MockStorageClient)
+	mockSrcBucketHandle := new(MockBucketHandle)
+	mockDestBucketHandle := new(MockBucketHandle)
+	mockSrcObjectHandle := new(MockObjectHandle)
+	mockDestObjectHandle := new(MockObjectHandle)
+	mockReadCloser := &MockReadCloser{
+		data: makeTgz(t, "../../other/x.log", []byte("line\n")),
+	}
+	mockObjectWriter := new(MockObjectWriter)
+
+	mockClient.On("Bucket", "src-bucket").Return(mockSrcBucketHandle)
+	mockClient.On("Bucket", "dest-bucket").Return(mockDestBucketHandle)
+	mockSrcBucketHandle.On("Object", "test.tgz").Return(mockSrcObjectHandle)
+	mockDestBucketHandle.On("Object", "test.tgz/other/x.log").Return(mockDestObjectHandle)
+	mockSrcObjectHandle.On("NewReader", mock.Anything).Return(mockReadCloser, nil)
+	mockDestObjectHandle.On("NewWriter", mock.Anything).Return(mockObjectWriter)
+	mockReadCloser.On("Read", mock.Anything)
+	mockReadCloser.On("Close").Return(nil)
+	mockObjectWriter.On("Write", mock.Anything)
+	mockObjectWriter.On("Close").Return(nil)
+
+	sender := &recordSender{}
+
+	// 既定では展開先の外を指すエントリを書き出さない
+	err := ExtractTgzAndUpload(ctx, mockClient, "src-bucket", "test.tgz", "dest-bucket", sender.send, ExtractOptions{})
+
+	assert.NoError(t, err)
+	assert.Empty(t, sender.paths)
+	mockDestBucketHandle.AssertNotCalled(t, "Object", mock.Anything)
+
+	mockReadCloser.pos = 0
+	err = ExtractTgzAndUpload(ctx, mockClient, "src-bucket", "test.tgz", "dest-bucket", sender.send, ExtractOptions{EntryNamePolicy: common.EntryNamePolicyRewrite})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test.tgz/other/x.log"}, sender.paths)
+	assert.Equal(t, "line\n", string(mockObjectWriter.WrittenData))
+}
+
+func TestExtractTgzAndUploadRejectsTooManyEntries(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 5, Typeflag: tar.TypeReg})
+		tw.Write([]byte("line\n"))
+	}
+	tw.Close()
+	gw.Close()
+	w := client.Bucket("src-bucket").Object("test.tgz").NewWriter(ctx)
+	w.Write(buf.Bytes())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &recordSender{}
+
+	// 上限を超えたアーカイブは再試行させず、書き出した分を消して印を残す
+	err := ExtractTgzAndUpload(ctx, client, "src-bucket", "test.tgz", "dest-bucket", sender.send, ExtractOptions{Limits: common.ExtractLimits{MaxEntries: 2}})
+
+	assert.NoError(t, err)
+	assert.Empty(t, sender.paths)
+	_, err = client.Bucket("dest-bucket").Object("test.tgz/a.log").Attrs(ctx)
+	assert.Error(t, err)
+	_, err = client.Bucket("dest-bucket").Object("test.tgz" + common.RejectedMarkerSuffix).Attrs(ctx)
+	assert.NoError(t, err)
+}
+
+func TestExtractTgzAndUploadFiltersEntries(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "logs/", Mode: 0o755, Typeflag: tar.TypeDir})
+	for _, e := range []struct{ name, content string }{
+		{"logs/a.log", "line\n"},
+		{"logs/README", "readme\n"},
+		{"logs/a.log.sha256", "checksum\n"},
+		{"logs/empty.log", ""},
+	} {
+		tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+	gw.Close()
+	w := client.Bucket("src-bucket").Object("test.tgz").NewWriter(ctx)
+	w.Write(buf.Bytes())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &recordSender{}
+
+	filter := common.EntryFilter{Include: []string{"*.log", "*.sha256"}, Exclude: []string{"*.sha256"}, MinSize: 1}
+	err := ExtractTgzAndUpload(ctx, client, "src-bucket", "test.tgz", "dest-bucket", sender.send, ExtractOptions{Filter: filter})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test.tgz/logs/a.log"}, sender.paths)
+	_, err = client.Bucket("dest-bucket").Object("test.tgz/logs/README").Attrs(ctx)
+	assert.Error(t, err)
+}
+
+func TestNewEnvConfigCharset(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("CONTENT_TOPIC_ID", "topic")
+	t.Setenv("DEST_BUCKET_NAME", "bucket")
+	t.Setenv("CHARSET", "")
+	t.Setenv("CHARSET_OVERRIDES", "tokyo/=cp932")
+
+	config, err := NewEnvConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", config.ExtractOptions("osaka/a.tgz").Charset)
+		assert.Equal(t, "cp932", config.ExtractOptions("tokyo/a.tgz").Charset)
+	}
+
+	t.Setenv("CHARSET_OVERRIDES", "tokyo/=euc-jp")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "CHARSET_OVERRIDES")
+
+	t.Setenv("CHARSET_OVERRIDES", "")
+	t.Setenv("ENTRY_INCLUDE", "*.log,[a-")
+	_, err = NewEnvConfig()
+	assert.ErrorContains(t, err, "ENTRY_INCLUDE")
+}
@@ -2,163 +2,261 @@ package unzip
 
 import (
 	"archive/zip"
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/url"
 	"os"
 	"path"
 
 	common "github.com/takotakot/iswf_log_to_bq/common/go"
+	"github.com/takotakot/iswf_log_to_bq/common/go/config"
 
 	"cloud.google.com/go/storage"
 	_ "github.com/GoogleCloudPlatform/functions-framework-go/funcframework"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
-	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
-	"golang.org/x/sync/errgroup"
-	"google.golang.org/protobuf/encoding/protojson"
 )
 
 func init() {
+	common.InitLogging(os.Getenv("PROJECT_ID"))
 	// Register a CloudEvent function with the Functions Framework
 	functions.CloudEvent("HandleUnzipEvent", HandleUnzipEvent)
 }
 
 type EnvConfig struct {
-	ProjectID      string
-	ContentTopicID string
-	DestBucketName string
+	ProjectID      string `env:"PROJECT_ID,required"`
+	ContentTopicID string `env:"CONTENT_TOPIC_ID,required"`
+	DestBucketName string `env:"DEST_BUCKET_NAME,required"`
+	// EntryNamePolicy is how the entries with unsafe names are written, see
+	// common.SanitizeEntryName.
+	EntryNamePolicy string `env:"ENTRY_NAME_POLICY" validate:"oneof=reject flatten rewrite"`
+	// NameCharset is the charset of the entry names without the UTF-8 flag,
+	// common.CharsetAuto to detect it.
+	NameCharset string `env:"NAME_CHARSET"`
+	// NamePercentDecode unescapes the %XX sequences in the entry names.
+	NamePercentDecode bool `env:"NAME_PERCENT_DECODE"`
+	// EntryInclude and EntryExclude are the patterns of the entries to
+	// extract and to skip, and EntryMinSize and EntryMaxSize bound their
+	// sizes; see common.EntryFilter.
+	EntryInclude []string `env:"ENTRY_INCLUDE"`
+	EntryExclude []string `env:"ENTRY_EXCLUDE"`
+	EntryMinSize int64    `env:"ENTRY_MIN_SIZE,size" validate:"min=0"`
+	EntryMaxSize int64    `env:"ENTRY_MAX_SIZE,size" validate:"min=0"`
+	// MaxEntries, MaxTotalSize and MaxCompressionRatio reject the archives
+	// that would expand too much. 0 means no limit.
+	MaxEntries          int     `env:"MAX_ENTRIES" validate:"min=0"`
+	MaxTotalSize        int64   `env:"MAX_TOTAL_SIZE,size" validate:"min=0"`
+	MaxCompressionRatio float64 `env:"MAX_COMPRESSION_RATIO" validate:"min=0"`
+	// UploadConcurrency is the number of entries written at a time, and
+	// UploadBufferSize is the size up to which an entry is buffered for it.
+	UploadConcurrency int   `env:"UPLOAD_CONCURRENCY" validate:"min=1"`
+	UploadBufferSize  int64 `env:"UPLOAD_BUFFER_SIZE,size" validate:"min=1"`
 }
 
 func NewEnvConfig() (*EnvConfig, error) {
-	config := EnvConfig{}
+	envConfig := EnvConfig{
+		EntryNamePolicy:     common.EntryNamePolicyReject,
+		NameCharset:         common.CharsetAuto,
+		MaxEntries:          common.DefaultMaxEntries,
+		MaxTotalSize:        common.DefaultMaxTotalSize,
+		MaxCompressionRatio: common.DefaultMaxCompressionRatio,
+		UploadConcurrency:   common.DefaultUploadConcurrency,
+		UploadBufferSize:    common.DefaultUploadBufferSize,
+	}
+	if err := config.Load(&envConfig); err != nil {
+		return nil, err
+	}
+	return &envConfig, nil
+}
 
-	requiredEnv := map[string]*string{
-		"PROJECT_ID":       &config.ProjectID,
-		"CONTENT_TOPIC_ID": &config.ContentTopicID,
-		"DEST_BUCKET_NAME": &config.DestBucketName,
+// Validate checks the charset and the entry filter, as config.Load calls it.
+func (c *EnvConfig) Validate() error {
+	var errs []error
+	if _, err := common.NormalizeCharset(c.NameCharset); err != nil {
+		errs = append(errs, &config.FieldError{Key: "NAME_CHARSET", Err: err})
 	}
+	if err := c.ExtractOptions().Filter.Validate(); err != nil {
+		errs = append(errs, &config.FieldError{Key: "ENTRY_INCLUDE/ENTRY_EXCLUDE", Err: err})
+	}
+	return errors.Join(errs...)
+}
 
-	for envVar, valuePtr := range requiredEnv {
-		value := os.Getenv(envVar)
-		if value == "" {
-			return nil, fmt.Errorf("%s environment variable is not set", envVar)
-		}
-		*valuePtr = value
+// ExtractOptions returns the options to extract the source objects.
+func (c *EnvConfig) ExtractOptions() ExtractOptions {
+	return ExtractOptions{
+		EntryNamePolicy: c.EntryNamePolicy,
+		Name: common.ZipNameOptions{
+			Charset:       c.NameCharset,
+			PercentDecode: c.NamePercentDecode,
+		},
+		Filter: common.EntryFilter{
+			Include: c.EntryInclude,
+			Exclude: c.EntryExclude,
+			MinSize: c.EntryMinSize,
+			MaxSize: c.EntryMaxSize,
+		},
+		Limits: common.ExtractLimits{
+			MaxEntries:          c.MaxEntries,
+			MaxTotalSize:        c.MaxTotalSize,
+			MaxCompressionRatio: c.MaxCompressionRatio,
+		},
+		UploadConcurrency: c.UploadConcurrency,
+		UploadBufferSize:  c.UploadBufferSize,
 	}
+}
 
-	return &config, nil
+// ExtractOptions describes how ExtractAndUpload writes the entries.
+type ExtractOptions struct {
+	// EntryNamePolicy is how the entries with unsafe names are written.
+	// They are rejected when it is empty.
+	EntryNamePolicy string
+	// Name is how the entry names are decoded.
+	Name common.ZipNameOptions
+	// Filter selects the entries to write. The others are skipped.
+	Filter common.EntryFilter
+	// UploadConcurrency and UploadBufferSize configure the common.UploadPool
+	// that writes the entries. The defaults are used when they are 0.
+	UploadConcurrency int
+	UploadBufferSize  int64
+	// Limits rejects the archive when it is exceeded. The written entries
+	// are deleted and a marker is left instead.
+	Limits common.ExtractLimits
 }
 
 func HandleUnzipEvent(ctx context.Context, e event.Event) error {
-	envConfig, err := NewEnvConfig()
+	object, err := common.DecodeSourceObject(e)
+	if errors.Is(err, common.ErrNotFinalized) {
+		common.Logger(ctx).Info("Ignore event", common.LogKeyEventID, e.ID(), "reason", err)
+		return nil
+	}
 	if err != nil {
-		log.Printf("Failed to load EnvConfig: %v", err)
-		return fmt.Errorf("EnvConfig: %v", err)
+		return fmt.Errorf("DecodeSourceObject: %v", err)
 	}
 
-	log.Printf("Event ID: %s", e.ID())
-	log.Printf("Event Type: %s", e.Type())
+	// アップロードされた zip から始まる一連の処理をトレース ID で関連付ける
+	ctx = common.StartEvent(ctx, e.ID(), object.URI(), object.TraceID)
+	logger := common.Logger(ctx)
 
-	var eventData storagedata.StorageObjectData
-	if err := protojson.Unmarshal(e.Data(), &eventData); err != nil {
-		return fmt.Errorf("protojson.Unmarshal: %w", err)
+	envConfig, err := NewEnvConfig()
+	if err != nil {
+		logger.Error("Failed to load EnvConfig", "error", err)
+		return fmt.Errorf("EnvConfig: %v", err)
 	}
 
-	log.Printf("Bucket: %s", eventData.GetBucket())
-	log.Printf("File: %s", eventData.GetName())
-	log.Printf("Metageneration: %d", eventData.GetMetageneration())
-	log.Printf("Created: %s", eventData.GetTimeCreated().AsTime())
-	log.Printf("Updated: %s", eventData.GetUpdated().AsTime())
+	logger.Info("Received event", "eventType", e.Type(), "generation", object.Generation, "size", object.Size)
 
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		log.Printf("Failed to create client: %v", err)
+		logger.Error("Failed to create client", "error", err)
 		return fmt.Errorf("storage.NewClient: %v", err)
 	}
 	defer client.Close()
 
 	realClient := &common.RealStorageClient{Client: client}
-	return ExtractAndUpload(ctx, realClient, eventData.GetBucket(), eventData.GetName(), eventData.GetSize(), envConfig.DestBucketName, common.PubSubMessageSenderFactory(ctx, envConfig.ProjectID, envConfig.ContentTopicID))
+	return ExtractAndUpload(ctx, realClient, object.Bucket, object.Name, object.Size, object.Generation, envConfig.DestBucketName, common.PubSubMessageSenderFactory(ctx, envConfig.ProjectID, envConfig.ContentTopicID), envConfig.ExtractOptions())
 }
 
-func ExtractAndUpload(ctx context.Context, client common.StorageClient, srcBucketName string, srcPath string, srcSize int64, destBucketName string, messageSender func(common.PubSubMessageData) error) error {
-	srcBucket := client.Bucket(srcBucketName)
-	srcObject := srcBucket.Object(srcPath)
-
-	reader, err := srcObject.NewReader(ctx)
-	if err != nil {
-		log.Printf("Failed to read source object: %v", err)
-		return fmt.Errorf("NewReader: %v", err)
-	}
-	defer reader.Close()
-
-	// ファイルの内容をバッファに読み込む
-	buf, err := io.ReadAll(reader)
-	if err != nil {
-		return fmt.Errorf("reading file to buffer: %v", err)
+// ExtractAndUpload extracts the generation srcGeneration of the zip object
+// and uploads its entries. The size and the generation are read from the
+// object when srcSize is 0, and the live object is read when srcGeneration
+// is 0.
+func ExtractAndUpload(ctx context.Context, client common.StorageClient, srcBucketName string, srcPath string, srcSize int64, srcGeneration int64, destBucketName string, messageSender func(common.PubSubMessageData) error, opts ExtractOptions) error {
+	logger := common.Logger(ctx)
+	srcObject := client.Bucket(srcBucketName).Object(srcPath)
+	if srcSize <= 0 {
+		// Pub/Sub のメッセージにはサイズが含まれない
+		attrs, err := srcObject.Attrs(ctx)
+		if err != nil {
+			logger.Error("Failed to read source object attributes", "error", err)
+			return fmt.Errorf("Attrs: %v", err)
+		}
+		srcSize = attrs.Size
+		srcGeneration = attrs.Generation
 	}
 
-	// バイトスライスからReaderAtを作成
-	bufReader := bytes.NewReader(buf)
+	// アーカイブ全体をメモリに載せず、必要な範囲だけを読み込む
+	readerAt := common.NewObjectReaderAt(ctx, srcObject, srcSize, srcGeneration, 0, 0)
 
-	zr, err := zip.NewReader(bufReader, srcSize)
+	zr, err := zip.NewReader(readerAt, srcSize)
 	if err != nil {
-		log.Printf("Failed to create zip reader: %v", err)
+		logger.Error("Failed to create zip reader", "error", err)
 		return fmt.Errorf("NewReader: %v", err)
 	}
 
-	var errorGroup errgroup.Group
+	// 展開しながら上限を確かめる。圧縮率はアーカイブ全体のサイズに対して測る
+	budget := common.NewExtractBudget(opts.Limits, func() int64 { return srcSize })
+	// エントリの数は中央ディレクトリで分かるため、展開する前に確かめる
+	if err := budget.CheckEntries(len(zr.File)); err != nil {
+		return common.RejectArchive(ctx, client, srcBucketName, srcPath, destBucketName, nil, err)
+	}
+	// アーカイブは順に読み、エントリは並行して書き出す
+	pool := common.NewUploadPool(ctx, opts.UploadConcurrency, opts.UploadBufferSize)
+	defer pool.Abort()
+	skipped := common.SkippedEntries{}
 
 	destBucket := client.Bucket(destBucketName)
 	for _, f := range zr.File {
-		rc, err := f.Open()
-		if err != nil {
-			log.Printf("Failed to open file from zip: %v", err)
-			return fmt.Errorf("Open: %v", err)
+		// 飛ばすエントリも数える
+		if err := budget.AddEntry(); err != nil {
+			pool.Abort()
+			return common.RejectArchive(ctx, client, srcBucketName, srcPath, destBucketName, pool.Names(), err)
 		}
-		defer rc.Close()
-
-		decodedName, err := url.QueryUnescape(f.Name)
+		// ディレクトリのエントリはオブジェクトにしない
+		if f.FileInfo().IsDir() {
+			skipped.Add("directory")
+			continue
+		}
+		decodedName, err := common.DecodeZipEntryName(&f.FileHeader, opts.Name)
 		if err != nil {
-			log.Printf("Failed to decode filename: %v", err)
-			return fmt.Errorf("QueryUnescape: %v", err)
+			logger.Error("Failed to decode filename", "error", err)
+			return fmt.Errorf("DecodeZipEntryName: %v", err)
 		}
-
-		destObjectName := path.Join(srcPath, decodedName)
-		object := destBucket.Object(destObjectName)
-		w := object.NewWriter(ctx)
-
-		_, err = io.Copy(w, rc)
+		entryName, err := common.SanitizeEntryName(decodedName, opts.EntryNamePolicy)
 		if err != nil {
-			log.Printf("Failed to write to destination bucket: %v", err)
-			return fmt.Errorf("Copy: %v", err)
+			// 展開先の外に書き出す名前のエントリは飛ばして報告する
+			logger.Error("Rejected entry", "entry", decodedName, "error", err)
+			skipped.Add("unsafe name")
+			continue
+		}
+		if reason := opts.Filter.Skip(entryName, int64(f.UncompressedSize64)); reason != "" {
+			logger.Info("Skip entry", "entry", entryName, "reason", reason)
+			skipped.Add(reason)
+			continue
 		}
 
-		err = w.Close()
+		rc, err := f.Open()
 		if err != nil {
-			log.Printf("Failed to close writer: %v", err)
-			return fmt.Errorf("Close: %v", err)
+			logger.Error("Failed to open file from zip", "error", err)
+			return fmt.Errorf("Open: %v", err)
 		}
 
-		// ファイルが正常に保存された後、Pub/Subメッセージを送信
-		msgData := common.PubSubMessageData{
-			Bucket:   destBucketName,
-			FilePath: destObjectName,
+		destObjectName := path.Join(srcPath, entryName)
+		err = pool.Upload(destBucket.Object(destObjectName), destObjectName, budget.EntryReader(rc, int64(f.CompressedSize64)))
+		rc.Close()
+		if err != nil {
+			pool.Abort()
+			if limitErr := budget.Exceeded(); limitErr != nil {
+				return common.RejectArchive(ctx, client, srcBucketName, srcPath, destBucketName, pool.Names(), limitErr)
+			}
+			// zip.Reader はエントリの CRC-32 を読み終えたときに確かめる。壊れたアーカイブは再試行しない
+			if errors.Is(err, zip.ErrChecksum) {
+				return common.RejectArchive(ctx, client, srcBucketName, srcPath, destBucketName, pool.Names(), fmt.Errorf("%s: %v", entryName, err))
+			}
+			logger.Error("Failed to write to destination bucket", "error", err)
+			return fmt.Errorf("Upload: %v", err)
 		}
+	}
 
-		errorGroup.Go(func() error {
-			return messageSender(msgData)
-		})
+	uploaded, err := pool.Wait()
+	if err != nil {
+		logger.Error("Failed to write to destination bucket", "error", err)
+		return fmt.Errorf("Upload: %v", err)
 	}
 
-	if err := errorGroup.Wait(); err != nil {
-		log.Printf("Failed to send Pub/Sub message: %v", err)
-		return fmt.Errorf("sendPubSubMessage: %v", err)
+	if err := common.PublishUploads(ctx, destBucketName, uploaded, messageSender); err != nil {
+		return err
 	}
 
+	logger.Info("Extracted archive", "extracted", len(uploaded), "skipped", skipped.Total(), "skippedByReason", skipped)
 	return nil
 }
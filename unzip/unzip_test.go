@@ -1,16 +1,21 @@
 package unzip
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
 	"io"
 	"log"
+	"math/rand"
 	"os"
 	"path"
 
+	"sync"
 	"testing"
 
 	common "github.com/takotakot/iswf_log_to_bq/common/go"
 
+	"cloud.google.com/go/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -35,6 +40,11 @@ func (m *MockBucketHandle) Object(name string) common.ObjectHandle {
 	return args.Get(0).(common.ObjectHandle)
 }
 
+func (m *MockBucketHandle) Objects(ctx context.Context, prefix string) common.ObjectIterator {
+	args := m.Called(ctx, prefix)
+	return args.Get(0).(common.ObjectIterator)
+}
+
 type MockObjectHandle struct {
 	mock.Mock
 	Name string
@@ -89,6 +99,42 @@ func (m *MockObjectHandle) NewWriter(ctx context.Context) io.WriteCloser {
 	return args.Get(0).(io.WriteCloser)
 }
 
+func (m *MockObjectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	args := m.Called(ctx, offset, length)
+	// バイト列が指定された場合はその範囲を返す
+	if data, ok := args.Get(0).([]byte); ok {
+		end := int64(len(data))
+		if length >= 0 {
+			end = min(offset+length, end)
+		}
+		return io.NopCloser(bytes.NewReader(data[offset:end])), args.Error(1)
+	}
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockObjectHandle) Attrs(ctx context.Context) (*storage.ObjectAttrs, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(*storage.ObjectAttrs), args.Error(1)
+}
+
+func (m *MockObjectHandle) Delete(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+// recordSender collects the paths of the messages sent by the extractor.
+type recordSender struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (s *recordSender) send(msgData common.PubSubMessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = append(s.paths, msgData.FilePath)
+	return nil
+}
+
 func readFileContent(path string) ([]byte, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -126,6 +172,7 @@ func TestExtractAndUpload(t *testing.T) {
 		expectedMsgData := common.PubSubMessageData{
 			Bucket:   destBucketName,
 			FilePath: path.Join(srcPath, contentFileName),
+			CRC32C:   common.EncodeCRC32C(common.ChecksumCRC32C(destFileData)),
 		}
 		assert.Equal(t, expectedMsgData, msgData, "Message data does not match the expected data")
 
@@ -141,9 +188,6 @@ func TestExtractAndUpload(t *testing.T) {
 	}
 	mockSrcObjectHandle := new(MockObjectHandle)
 	mockDestObjectHandle := new(MockObjectHandle)
-	mockReadCloser := &MockReadCloser{
-		data: fileData,
-	}
 	mockObjectWriter := new(MockObjectWriter)
 
 	mockClient.On("Bucket", srcBucketName).Return(mockSrcBucketHandle)
@@ -151,15 +195,13 @@ func TestExtractAndUpload(t *testing.T) {
 	mockSrcBucketHandle.On("Object", srcPath).Return(mockSrcObjectHandle)
 	mockDestBucketHandle.On("Object", destPath).Return(mockDestObjectHandle)
 
-	mockSrcObjectHandle.On("NewReader", mock.Anything).Return(mockReadCloser, nil)
+	mockSrcObjectHandle.On("NewRangeReader", mock.Anything, mock.Anything, mock.Anything).Return(fileData, nil)
 	mockDestObjectHandle.On("NewWriter", mock.Anything).Return(mockObjectWriter)
-	mockReadCloser.On("Read", mock.Anything)
-	mockReadCloser.On("Close").Return(nil)
 	mockObjectWriter.On("Write", mock.Anything)
 	mockObjectWriter.On("Close").Return(nil)
 
 	// テストの実行
-	err = ExtractAndUpload(ctx, mockClient, srcBucketName, srcPath, srcSize, destBucketName, messageSender)
+	err = ExtractAndUpload(ctx, mockClient, srcBucketName, srcPath, srcSize, 0, destBucketName, messageSender, ExtractOptions{})
 	if err != nil {
 		t.Errorf("ExtractAndUpload failed: %v", err)
 	}
@@ -173,6 +215,173 @@ func TestExtractAndUpload(t *testing.T) {
 	mockDestBucketHandle.AssertExpectations(t)
 	mockSrcObjectHandle.AssertExpectations(t)
 	mockDestObjectHandle.AssertExpectations(t)
-	mockReadCloser.AssertExpectations(t)
 	mockObjectWriter.AssertExpectations(t)
 }
+
+func TestExtractAndUploadRejectsCompressionRatio(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a.log", "b.log"} {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(make([]byte, 4<<20))
+	}
+	zw.Close()
+	w := client.Bucket("src-bucket").Object("bomb.zip").NewWriter(ctx)
+	w.Write(buf.Bytes())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &recordSender{}
+
+	err := ExtractAndUpload(ctx, client, "src-bucket", "bomb.zip", int64(buf.Len()), 0, "dest-bucket", sender.send, ExtractOptions{Limits: common.ExtractLimits{MaxCompressionRatio: 100}})
+
+	assert.NoError(t, err)
+	assert.Empty(t, sender.paths)
+	_, err = client.Bucket("dest-bucket").Object("bomb.zip/a.log").Attrs(ctx)
+	assert.Error(t, err)
+	_, err = client.Bucket("dest-bucket").Object("bomb.zip" + common.RejectedMarkerSuffix).Attrs(ctx)
+	assert.NoError(t, err)
+}
+
+func TestExtractAndUploadRejectsEntryCompressionRatio(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	// 圧縮しない大きなエントリでアーカイブ全体の圧縮率を下げても、爆弾のエントリで止める
+	random := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "a.bin", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(random)
+	fw, err = zw.Create("bomb.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(make([]byte, 16<<20))
+	zw.Close()
+	w := client.Bucket("src-bucket").Object("bomb.zip").NewWriter(ctx)
+	w.Write(buf.Bytes())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &recordSender{}
+
+	err = ExtractAndUpload(ctx, client, "src-bucket", "bomb.zip", int64(buf.Len()), 0, "dest-bucket", sender.send, ExtractOptions{Limits: common.ExtractLimits{MaxCompressionRatio: 100}})
+
+	assert.NoError(t, err)
+	assert.Empty(t, sender.paths)
+	_, err = client.Bucket("dest-bucket").Object("bomb.zip/a.bin").Attrs(ctx)
+	assert.Error(t, err)
+	_, err = client.Bucket("dest-bucket").Object("bomb.zip" + common.RejectedMarkerSuffix).Attrs(ctx)
+	assert.NoError(t, err)
+}
+
+func TestExtractAndUploadRejectsEntryCount(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	// ディレクトリや飛ばすエントリも数える
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"d/", "d/a.log", "d/a.log.md5"} {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("line\n"))
+	}
+	zw.Close()
+	w := client.Bucket("src-bucket").Object("many.zip").NewWriter(ctx)
+	w.Write(buf.Bytes())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &recordSender{}
+
+	err := ExtractAndUpload(ctx, client, "src-bucket", "many.zip", int64(buf.Len()), 0, "dest-bucket", sender.send, ExtractOptions{Filter: common.EntryFilter{Exclude: []string{"*.md5"}}, Limits: common.ExtractLimits{MaxEntries: 2}})
+
+	assert.NoError(t, err)
+	assert.Empty(t, sender.paths)
+	_, err = client.Bucket("dest-bucket").Object("many.zip/d/a.log").Attrs(ctx)
+	assert.Error(t, err)
+	_, err = client.Bucket("dest-bucket").Object("many.zip" + common.RejectedMarkerSuffix).Attrs(ctx)
+	assert.NoError(t, err)
+}
+
+func TestExtractAndUploadDecodesAndFiltersNames(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	// CP932 の "ログ/a+b.log" と、UTF-8 フラグ付きの名前。ディレクトリは書き出さない
+	for _, h := range []*zip.FileHeader{
+		{Name: "\x83\x8d\x83\x4f/", NonUTF8: true},
+		{Name: "\x83\x8d\x83\x4f/a+b.log", NonUTF8: true},
+		{Name: "日本語/c%20d.log"},
+		{Name: "日本語/c%20d.log.md5"},
+	} {
+		fw, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("line\n"))
+	}
+	zw.Close()
+	w := client.Bucket("src-bucket").Object("names.zip").NewWriter(ctx)
+	w.Write(buf.Bytes())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &recordSender{}
+
+	err := ExtractAndUpload(ctx, client, "src-bucket", "names.zip", int64(buf.Len()), 0, "dest-bucket", sender.send, ExtractOptions{Name: common.ZipNameOptions{Charset: common.CharsetAuto}, Filter: common.EntryFilter{Exclude: []string{"*.md5"}}})
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"names.zip/ログ/a+b.log", "names.zip/日本語/c%20d.log"}, sender.paths)
+}
+
+func TestExtractAndUploadRejectsCorruptedEntry(t *testing.T) {
+	ctx := context.Background()
+	client := &common.FileStorageClient{Root: t.TempDir()}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "a.log", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("good line\n"))
+	zw.Close()
+	// 格納された内容を書き換え、CRC-32 を合わなくする
+	data := bytes.Replace(buf.Bytes(), []byte("good line\n"), []byte("evil line\n"), 1)
+	w := client.Bucket("src-bucket").Object("broken.zip").NewWriter(ctx)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &recordSender{}
+	err = ExtractAndUpload(ctx, client, "src-bucket", "broken.zip", int64(len(data)), 0, "dest-bucket", sender.send, ExtractOptions{})
+
+	assert.NoError(t, err)
+	assert.Empty(t, sender.paths)
+	_, err = client.Bucket("dest-bucket").Object("broken.zip/a.log").Attrs(ctx)
+	assert.Error(t, err)
+	_, err = client.Bucket("dest-bucket").Object("broken.zip" + common.RejectedMarkerSuffix).Attrs(ctx)
+	assert.NoError(t, err)
+}